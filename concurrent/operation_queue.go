@@ -7,11 +7,30 @@ package concurrent
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const defaultQueueSize = 256
 
+const pendingOperationsPollInterval = time.Millisecond * 50
+
+// pendingOperations counts enqueued operations not yet processed by any queue.
+var pendingOperations int64
+
+// WaitPendingOperations blocks until all enqueued operations have been processed,
+// returning false if timeout expires before that happens.
+func WaitPendingOperations(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&pendingOperations) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pendingOperationsPollInterval)
+	}
+	return true
+}
+
 type OperationQueue struct {
 	QueueSize int
 	Timeout   time.Duration
@@ -46,7 +65,11 @@ func (oq *OperationQueue) enqueueItem(item func()) {
 		oq.items = make(chan func(), queueSize)
 		go oq.run(oq.Timeout)
 	}
-	oq.items <- item
+	atomic.AddInt64(&pendingOperations, 1)
+	oq.items <- func() {
+		defer atomic.AddInt64(&pendingOperations, -1)
+		item()
+	}
 	oq.Unlock()
 }
 
@@ -29,3 +29,21 @@ func TestAsync(t *testing.T) {
 	time.Sleep(time.Second)
 	assert.Equal(t, v, 256)
 }
+
+func TestWaitPendingOperations(t *testing.T) {
+	queue := concurrent.OperationQueue{}
+	var v int
+	for i := 0; i < 4; i++ {
+		queue.Async(func() {
+			time.Sleep(time.Millisecond * 100)
+			v++
+		})
+	}
+	assert.True(t, concurrent.WaitPendingOperations(time.Second*5))
+	assert.Equal(t, v, 4)
+
+	queue.Async(func() {
+		time.Sleep(time.Millisecond * 500)
+	})
+	assert.False(t, concurrent.WaitPendingOperations(time.Millisecond*100))
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+const defaultBOSHWait = 60
+
+const defaultBOSHHold = 1
+
+const defaultBOSHInactivity = 60
+
+// BOSHConfig contains the limits negotiated with BOSH clients (XEP-0124).
+type BOSHConfig struct {
+	// Wait is the maximum time (in seconds) a request is held
+	// by the connection manager waiting for payloads to deliver.
+	Wait int
+
+	// Hold is the maximum number of requests held simultaneously.
+	Hold int
+
+	// Inactivity is the maximum time (in seconds) a session is kept
+	// alive without pending requests.
+	Inactivity int
+}
+
+type boshProxyType struct {
+	Wait       int `yaml:"wait"`
+	Hold       int `yaml:"hold"`
+	Inactivity int `yaml:"inactivity"`
+}
+
+func (b *BOSHConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := boshProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	b.Wait = p.Wait
+	if b.Wait == 0 {
+		b.Wait = defaultBOSHWait
+	}
+	b.Hold = p.Hold
+	if b.Hold == 0 {
+		b.Hold = defaultBOSHHold
+	}
+	b.Inactivity = p.Inactivity
+	if b.Inactivity == 0 {
+		b.Inactivity = defaultBOSHInactivity
+	}
+	return nil
+}
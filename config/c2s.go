@@ -5,14 +5,22 @@
 
 package config
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 type C2S struct {
 	Domains []string
+
+	// VirtualHosts contains per domain settings,
+	// overriding the ones of the server a stream is connected to.
+	VirtualHosts map[string]*VirtualHost
 }
 
 type c2sProxyType struct {
-	Domains []string `yaml:"domains"`
+	Domains      []string                `yaml:"domains"`
+	VirtualHosts map[string]*VirtualHost `yaml:"virtual_hosts"`
 }
 
 func (c *C2S) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -23,6 +31,77 @@ func (c *C2S) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if len(p.Domains) == 0 {
 		return errors.New("config.C2S: no domain specified")
 	}
+	for domain := range p.VirtualHosts {
+		if !containsString(p.Domains, domain) {
+			return fmt.Errorf("config.C2S: virtual host domain not specified: %s", domain)
+		}
+	}
 	c.Domains = p.Domains
+	c.VirtualHosts = p.VirtualHosts
+	return nil
+}
+
+// validateVirtualHosts checks that per domain settings
+// can be honored by every configured c2s server.
+func (c *C2S) validateVirtualHosts(servers []Server) error {
+	for domain, vh := range c.VirtualHosts {
+		if vh.TLSRequired == nil {
+			continue
+		}
+		for _, srv := range servers {
+			if srv.Type == C2SServerType && srv.TLS == nil {
+				return fmt.Errorf("config.C2S: %s tls_required setting needs tls configuration in server: %s", domain, srv.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// VirtualHost represents a C2S domain settings.
+// Unset values are inherited from server configuration.
+type VirtualHost struct {
+	Modules          map[string]struct{}
+	SASL             []string
+	TLSRequired      *bool
+	ModRegistration  *ModRegistration
+	OfflineQueueSize int
+}
+
+type virtualHostProxyType struct {
+	Modules          []string         `yaml:"modules"`
+	SASL             []string         `yaml:"sasl"`
+	TLSRequired      *bool            `yaml:"tls_required"`
+	ModRegistration  *ModRegistration `yaml:"mod_registration"`
+	OfflineQueueSize int              `yaml:"offline_queue_size"`
+}
+
+func (v *VirtualHost) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := virtualHostProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if err := validateSASL(p.SASL); err != nil {
+		return err
+	}
+	if p.Modules != nil {
+		modules, err := validateModules(p.Modules)
+		if err != nil {
+			return err
+		}
+		v.Modules = modules
+	}
+	v.SASL = p.SASL
+	v.TLSRequired = p.TLSRequired
+	v.ModRegistration = p.ModRegistration
+	v.OfflineQueueSize = p.OfflineQueueSize
 	return nil
 }
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
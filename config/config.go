@@ -31,5 +31,8 @@ func Load(configFile string) error {
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(b, &DefaultConfig)
+	if err := yaml.Unmarshal(b, &DefaultConfig); err != nil {
+		return err
+	}
+	return DefaultConfig.C2S.validateVirtualHosts(DefaultConfig.Servers)
 }
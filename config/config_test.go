@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadVirtualHostTLSRequired(t *testing.T) {
+	defer func(cfg Config) { DefaultConfig = cfg }(DefaultConfig)
+
+	dir, err := ioutil.TempDir("", "jackal-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "jackal.yaml")
+	writeTestConfig := func(tlsBlock string) {
+		ioutil.WriteFile(cfgFile, []byte(`
+c2s:
+  domains: [jackal.im]
+  virtual_hosts:
+    jackal.im:
+      tls_required: true
+servers:
+  - id: c2s
+    type: c2s
+    transport:
+      type: socket
+      port: 5222
+`+tlsBlock), 0600)
+	}
+
+	writeTestConfig("")
+	DefaultConfig = Config{}
+	assert.NotNil(t, Load(cfgFile))
+
+	writeTestConfig(`
+    tls:
+      cert_path: cert.pem
+      privkey_path: key.pem
+`)
+	DefaultConfig = Config{}
+	assert.Nil(t, Load(cfgFile))
+	assert.True(t, *DefaultConfig.C2S.VirtualHosts["jackal.im"].TLSRequired)
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+const defaultS2SDialTimeout = 15
+
+const defaultS2SConnectRetries = 3
+
+const defaultS2SConnectBackoff = 1
+
+type S2S struct {
+	DialbackSecret string
+	DialTimeout    int
+
+	// ConnectRetries is the number of times an outgoing connection
+	// is retried before bouncing its queued stanzas.
+	ConnectRetries int
+
+	// ConnectBackoff is the initial delay (in seconds) between connection retries.
+	ConnectBackoff int
+
+	// Hosts maps remote domains to static addresses,
+	// bypassing SRV resolution.
+	Hosts map[string]string
+}
+
+type s2sProxyType struct {
+	DialbackSecret string            `yaml:"dialback_secret"`
+	DialTimeout    int               `yaml:"dial_timeout"`
+	ConnectRetries int               `yaml:"connect_retries"`
+	ConnectBackoff int               `yaml:"connect_backoff"`
+	Hosts          map[string]string `yaml:"hosts"`
+}
+
+func (s *S2S) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := s2sProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	s.DialbackSecret = p.DialbackSecret
+	s.DialTimeout = p.DialTimeout
+	if s.DialTimeout == 0 {
+		s.DialTimeout = defaultS2SDialTimeout
+	}
+	s.ConnectRetries = p.ConnectRetries
+	if s.ConnectRetries == 0 {
+		s.ConnectRetries = defaultS2SConnectRetries
+	}
+	s.ConnectBackoff = p.ConnectBackoff
+	if s.ConnectBackoff == 0 {
+		s.ConnectBackoff = defaultS2SConnectBackoff
+	}
+	s.Hosts = p.Hosts
+	return nil
+}
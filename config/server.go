@@ -6,6 +6,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -16,14 +17,25 @@ const defaultTransportBufferSize = 4096
 
 const defaultTransportConnectTimeout = 5
 const defaultTransportKeepAlive = 120
+const defaultTransportMaxStanzaSize = 262144
+
+const defaultWebSocketURLPath = "/xmpp/ws"
+
+const defaultBOSHURLPath = "/http-bind"
+
+const defaultStreamMgmtResumeTimeout = 300
+
+const defaultMAMDefault = "always"
 
 type ServerType int
 
 const (
 	// C2S represents a client to client server type.
 	C2SServerType ServerType = iota
-	// S2S represents a server-to-client server type.
+	// S2S represents a server-to-server server type.
 	S2SServerType
+	// Component represents an external component server type (XEP-0114).
+	ComponentServerType
 )
 
 type ChannelBindingMechanism int
@@ -38,6 +50,8 @@ func (st ServerType) String() string {
 		return "c2s"
 	case S2SServerType:
 		return "s2s"
+	case ComponentServerType:
+		return "component"
 	}
 	return ""
 }
@@ -46,12 +60,20 @@ type TransportType int
 
 const (
 	Socket TransportType = iota
+	// WebSocket represents an XMPP over WebSocket transport type (RFC 7395).
+	WebSocket
+	// BOSH represents an XMPP over BOSH transport type (XEP-0206).
+	BOSH
 )
 
 func (tt TransportType) String() string {
 	switch tt {
 	case Socket:
 		return "socket"
+	case WebSocket:
+		return "websocket"
+	case BOSH:
+		return "bosh"
 	}
 	return ""
 }
@@ -84,10 +106,15 @@ type Server struct {
 	TLS             *TLS
 	Modules         map[string]struct{}
 	Compression     *Compression
+	S2S             *S2S
+	Components      []Component
+	BOSH            *BOSHConfig
 	ModOffline      ModOffline
 	ModRegistration ModRegistration
 	ModVersion      ModVersion
 	ModPing         ModPing
+	ModStreamMgmt   ModStreamMgmt
+	ModMAM          ModMAM
 }
 
 type serverProxyType struct {
@@ -98,10 +125,15 @@ type serverProxyType struct {
 	TLS             *TLS            `yaml:"tls"`
 	Modules         []string        `yaml:"modules"`
 	Compression     *Compression    `yaml:"compression"`
+	S2S             *S2S            `yaml:"s2s"`
+	Components      []Component     `yaml:"components"`
+	BOSH            *BOSHConfig     `yaml:"bosh"`
 	ModOffline      ModOffline      `yaml:"mod_offline"`
 	ModRegistration ModRegistration `yaml:"mod_registration"`
 	ModVersion      ModVersion      `yaml:"mod_version"`
 	ModPing         ModPing         `yaml:"mod_ping"`
+	ModStreamMgmt   ModStreamMgmt   `yaml:"mod_stream_mgmt"`
+	ModMAM          ModMAM          `yaml:"mod_mam"`
 }
 
 func (s *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -115,42 +147,104 @@ func (s *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		s.Type = C2SServerType
 	case "s2s":
 		s.Type = S2SServerType
+	case "component":
+		s.Type = ComponentServerType
 	default:
 		return fmt.Errorf("config.Server: unrecognized server type: %s", p.Type)
 	}
+	if s.Type != C2SServerType && p.Transport.Type != Socket {
+		return fmt.Errorf("config.Server: %v transport not supported by %v servers", p.Transport.Type, s.Type)
+	}
+	if p.Transport.DirectTLS && p.TLS == nil {
+		return errors.New("config.Server: direct TLS requires tls configuration")
+	}
 	// validate SASL mechanisms
-	for _, sasl := range p.SASL {
-		switch sasl {
-		case "plain", "digest_md5", "scram_sha_1", "scram_sha_256":
-			continue
-		default:
-			return fmt.Errorf("config.Server: unrecognized SASL mechanism: %s", sasl)
+	if err := validateSASL(p.SASL); err != nil {
+		return err
+	}
+	// validate components
+	for _, c := range p.Components {
+		if len(c.Domain) == 0 || len(c.Secret) == 0 {
+			return errors.New("config.Server: component domain and secret are required")
 		}
 	}
+	if s.Type == ComponentServerType && len(p.Components) == 0 {
+		return errors.New("config.Server: no component specified")
+	}
 	// validate modules
-	s.Modules = map[string]struct{}{}
-	for _, module := range p.Modules {
-		switch module {
-		case "roster", "private", "vcard", "registration", "version", "ping", "offline":
-			break
-		default:
-			return fmt.Errorf("config.Server: unrecognized module: %s", module)
-		}
-		s.Modules[module] = struct{}{}
+	modules, err := validateModules(p.Modules)
+	if err != nil {
+		return err
 	}
+	s.Modules = modules
 
 	s.ID = p.ID
 	s.Transport = p.Transport
 	s.SASL = p.SASL
 	s.TLS = p.TLS
 	s.Compression = p.Compression
+	s.S2S = p.S2S
+	s.Components = p.Components
+	s.BOSH = p.BOSH
+	if s.Transport.Type == BOSH && s.BOSH == nil {
+		s.BOSH = &BOSHConfig{
+			Wait:       defaultBOSHWait,
+			Hold:       defaultBOSHHold,
+			Inactivity: defaultBOSHInactivity,
+		}
+	}
+	if s.Type == S2SServerType && s.S2S == nil {
+		s.S2S = &S2S{
+			DialTimeout:    defaultS2SDialTimeout,
+			ConnectRetries: defaultS2SConnectRetries,
+			ConnectBackoff: defaultS2SConnectBackoff,
+		}
+	}
 	s.ModOffline = p.ModOffline
 	s.ModRegistration = p.ModRegistration
 	s.ModVersion = p.ModVersion
 	s.ModPing = p.ModPing
+	s.ModStreamMgmt = p.ModStreamMgmt
+	if s.ModStreamMgmt.ResumeTimeout == 0 {
+		s.ModStreamMgmt.ResumeTimeout = defaultStreamMgmtResumeTimeout
+	}
+	switch p.ModMAM.Default {
+	case "":
+		s.ModMAM.Default = defaultMAMDefault
+	case "always", "never", "roster":
+		s.ModMAM.Default = p.ModMAM.Default
+	default:
+		return fmt.Errorf("config.ModMAM: unrecognized default archiving preference: %s", p.ModMAM.Default)
+	}
 	return nil
 }
 
+func validateSASL(mechanisms []string) error {
+	for _, sasl := range mechanisms {
+		switch sasl {
+		case "plain", "digest_md5", "scram_sha_1", "scram_sha_256", "external":
+			continue
+		default:
+			return fmt.Errorf("config.Server: unrecognized SASL mechanism: %s", sasl)
+		}
+	}
+	return nil
+}
+
+func validateModules(modules []string) (map[string]struct{}, error) {
+	ret := map[string]struct{}{}
+	for _, module := range modules {
+		switch module {
+		case "roster", "private", "vcard", "registration", "version", "ping", "offline", "stream_mgmt", "carbons", "mam":
+			break
+		default:
+			return nil, fmt.Errorf("config.Server: unrecognized module: %s", module)
+		}
+		ret[module] = struct{}{}
+	}
+	return ret, nil
+}
+
 type Transport struct {
 	Type           TransportType
 	BindAddress    string
@@ -158,16 +252,33 @@ type Transport struct {
 	ConnectTimeout int
 	KeepAlive      int
 	BufferSize     int
+
+	// MaxStanzaSize is the maximum size in bytes of any received element.
+	MaxStanzaSize int
+
+	// DirectTLS determines whether or not accepted connections are secured
+	// right away (XEP-0368), instead of negotiating STARTTLS.
+	DirectTLS bool
+
+	// URLPath is the HTTP path serving WebSocket and BOSH connections.
+	URLPath string
+
+	// Origins contains the web origins allowed to open a WebSocket or BOSH connection.
+	// Only same origin requests are allowed if empty.
+	Origins []string
 }
 
 type transportProxyType struct {
-	Type           string `yaml:"type"`
-	BindAddress    string `yaml:"bind_addr"`
-	Port           int    `yaml:"port"`
-	ConnectTimeout int    `yaml:"connect_timeout"`
-	KeepAlive      int    `yaml:"keep_alive"`
-	MaxStanzaSize  int    `yaml:"max_stanza_size"`
-	BufferSize     int    `yaml:"buf_size"`
+	Type           string   `yaml:"type"`
+	BindAddress    string   `yaml:"bind_addr"`
+	Port           int      `yaml:"port"`
+	ConnectTimeout int      `yaml:"connect_timeout"`
+	KeepAlive      int      `yaml:"keep_alive"`
+	MaxStanzaSize  int      `yaml:"max_stanza_size"`
+	BufferSize     int      `yaml:"buf_size"`
+	TLS            string   `yaml:"tls"`
+	URLPath        string   `yaml:"url_path"`
+	Origins        []string `yaml:"origins"`
 }
 
 func (t *Transport) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -179,9 +290,25 @@ func (t *Transport) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	switch p.Type {
 	case "socket":
 		t.Type = Socket
+	case "websocket":
+		t.Type = WebSocket
+	case "bosh":
+		t.Type = BOSH
 	default:
 		return fmt.Errorf("config.Transport: unrecognized transport type: %s", p.Type)
 	}
+	// validate TLS negotiation
+	switch p.TLS {
+	case "", "starttls":
+		break
+	case "direct":
+		if t.Type != Socket {
+			return fmt.Errorf("config.Transport: direct TLS not supported by %v transport", t.Type)
+		}
+		t.DirectTLS = true
+	default:
+		return fmt.Errorf("config.Transport: unrecognized TLS negotiation: %s", p.TLS)
+	}
 	t.BindAddress = p.BindAddress
 	t.Port = p.Port
 
@@ -201,15 +328,48 @@ func (t *Transport) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if t.BufferSize == 0 {
 		t.BufferSize = defaultTransportBufferSize
 	}
+	t.MaxStanzaSize = p.MaxStanzaSize
+	if t.MaxStanzaSize == 0 {
+		t.MaxStanzaSize = defaultTransportMaxStanzaSize
+	}
+	t.URLPath = p.URLPath
+	if len(t.URLPath) == 0 {
+		switch t.Type {
+		case WebSocket:
+			t.URLPath = defaultWebSocketURLPath
+		case BOSH:
+			t.URLPath = defaultBOSHURLPath
+		}
+	}
+	t.Origins = p.Origins
 	return nil
 }
 
 type TLS struct {
-	Required    bool   `yaml:"required"`
+	Required    bool     `yaml:"required"`
+	CertFile    string   `yaml:"cert_path"`
+	PrivKeyFile string   `yaml:"privkey_path"`
+	CAFiles     []string `yaml:"ca_paths"`
+
+	// Certificates contains virtual host certificates, selected by means
+	// of SNI and falling back to the default certificate otherwise.
+	Certificates []TLSCertificate `yaml:"certificates"`
+}
+
+// TLSCertificate represents the certificate used to secure a virtual host's streams.
+type TLSCertificate struct {
+	Domain      string `yaml:"domain"`
 	CertFile    string `yaml:"cert_path"`
 	PrivKeyFile string `yaml:"privkey_path"`
 }
 
+// Component represents an external component allowed to connect
+// using the Jabber Component Protocol (XEP-0114).
+type Component struct {
+	Domain string `yaml:"domain"`
+	Secret string `yaml:"secret"`
+}
+
 type Compression struct {
 	Level CompressionLevel
 }
@@ -237,7 +397,8 @@ func (c *Compression) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type ModOffline struct {
-	QueueSize int `yaml:"queue_size"`
+	QueueSize   int `yaml:"queue_size"`
+	ExpireAfter int `yaml:"expire_after"`
 }
 
 type ModRegistration struct {
@@ -253,3 +414,17 @@ type ModPing struct {
 	Send         bool `yaml:"send"`
 	SendInterval int  `yaml:"send_interval"`
 }
+
+// ModStreamMgmt represents XEP-0198 Stream Management settings.
+type ModStreamMgmt struct {
+	// ResumeTimeout is the time in seconds a disconnected session is kept waiting to be resumed.
+	// A negative value disables session resumption.
+	ResumeTimeout int `yaml:"resume_timeout"`
+}
+
+// ModMAM represents XEP-0313 Message Archive Management settings.
+type ModMAM struct {
+	// Default is the archiving preference ('always', 'never' or 'roster')
+	// applied to users who haven't set their own.
+	Default string `yaml:"default"`
+}
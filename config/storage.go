@@ -12,15 +12,63 @@ import (
 
 const defaultMySQLPoolSize = 16
 
+const defaultPostgreSQLPoolSize = 16
+
+const defaultPostgreSQLSSLMode = "disable"
+
+const defaultSQLitePath = "jackal.db"
+
+const defaultCacheSize = 8192
+
+const defaultCacheTTL = 60
+
+const defaultConnectRetries = 10
+
+const defaultConnectBackoff = 1
+
 type StorageType int
 
 const (
 	MySQL StorageType = iota
+	SQLite
+	Memory
+	PostgreSQL
+)
+
+// PasswordHashType represents the hash algorithm used to store
+// a password verifier for PLAIN authentication.
+type PasswordHashType int
+
+const (
+	NoPasswordHash PasswordHashType = iota
+	BCryptPasswordHash
 )
 
 type Storage struct {
-	Type  StorageType
-	MySQL *MySQLDb
+	Type         StorageType
+	PasswordHash PasswordHashType
+	AutoMigrate  bool
+	MySQL        *MySQLDb
+	SQLite       *SQLiteDb
+	PostgreSQL   *PostgreSQLDb
+	Cache        *StorageCache
+
+	// SlowQueryThreshold is the duration (in milliseconds) above which
+	// storage operations get logged. Zero disables slow-query logging.
+	SlowQueryThreshold int
+
+	// ConnectRetries is the number of times database connection
+	// is retried at startup before giving up.
+	ConnectRetries int
+
+	// ConnectBackoff is the initial delay (in seconds) between connection retries.
+	ConnectBackoff int
+}
+
+// StorageCache represents the storage lookup cache configuration.
+type StorageCache struct {
+	Size int `yaml:"size"`
+	TTL  int `yaml:"ttl"`
 }
 
 type MySQLDb struct {
@@ -29,11 +77,36 @@ type MySQLDb struct {
 	Password string `yaml:"password"`
 	Database string `yaml:"database"`
 	PoolSize int    `yaml:"pool_size"`
+
+	// Replicas holds read replica hosts sharing primary database credentials.
+	Replicas []string `yaml:"replicas"`
+}
+
+type PostgreSQLDb struct {
+	Host     string `yaml:"host"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+	SSLMode  string `yaml:"ssl_mode"`
+	PoolSize int    `yaml:"pool_size"`
+}
+
+type SQLiteDb struct {
+	Path string `yaml:"path"`
 }
 
 type storageProxyType struct {
-	Type  string   `yaml:"type"`
-	MySQL *MySQLDb `yaml:"mysql"`
+	Type         string        `yaml:"type"`
+	PasswordHash string        `yaml:"password_hash"`
+	AutoMigrate  *bool         `yaml:"auto_migrate"`
+	MySQL        *MySQLDb      `yaml:"mysql"`
+	SQLite       *SQLiteDb     `yaml:"sqlite"`
+	PostgreSQL   *PostgreSQLDb `yaml:"postgresql"`
+	Cache        *StorageCache `yaml:"cache"`
+
+	SlowQueryThreshold int `yaml:"slow_query_threshold"`
+	ConnectRetries     int `yaml:"connect_retries"`
+	ConnectBackoff     int `yaml:"connect_backoff"`
 }
 
 func (s *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -47,14 +120,68 @@ func (s *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return errors.New("config.Storage: couldn't read MySQL configuration")
 		}
 		s.Type = MySQL
+	case "postgresql":
+		if p.PostgreSQL == nil {
+			return errors.New("config.Storage: couldn't read PostgreSQL configuration")
+		}
+		s.Type = PostgreSQL
+	case "sqlite":
+		if p.SQLite == nil {
+			p.SQLite = &SQLiteDb{}
+		}
+		s.Type = SQLite
+	case "memory":
+		s.Type = Memory
 	default:
 		return fmt.Errorf("config.Storage: unrecognized storage type: %s", p.Type)
 	}
+	switch p.PasswordHash {
+	case "":
+		s.PasswordHash = NoPasswordHash
+	case "bcrypt":
+		s.PasswordHash = BCryptPasswordHash
+	default:
+		return fmt.Errorf("config.Storage: unrecognized password hash: %s", p.PasswordHash)
+	}
 	s.MySQL = p.MySQL
+	s.SQLite = p.SQLite
+	s.PostgreSQL = p.PostgreSQL
+	s.Cache = p.Cache
+	s.SlowQueryThreshold = p.SlowQueryThreshold
+	s.ConnectRetries = p.ConnectRetries
+	s.ConnectBackoff = p.ConnectBackoff
+
+	// apply schema migrations on startup unless explicitly disabled
+	s.AutoMigrate = p.AutoMigrate == nil || *p.AutoMigrate
 
 	// assign storage defaults
+	if s.ConnectRetries == 0 {
+		s.ConnectRetries = defaultConnectRetries
+	}
+	if s.ConnectBackoff == 0 {
+		s.ConnectBackoff = defaultConnectBackoff
+	}
 	if s.MySQL != nil && s.MySQL.PoolSize == 0 {
 		s.MySQL.PoolSize = defaultMySQLPoolSize
 	}
+	if s.PostgreSQL != nil {
+		if s.PostgreSQL.PoolSize == 0 {
+			s.PostgreSQL.PoolSize = defaultPostgreSQLPoolSize
+		}
+		if len(s.PostgreSQL.SSLMode) == 0 {
+			s.PostgreSQL.SSLMode = defaultPostgreSQLSSLMode
+		}
+	}
+	if s.SQLite != nil && len(s.SQLite.Path) == 0 {
+		s.SQLite.Path = defaultSQLitePath
+	}
+	if s.Cache != nil {
+		if s.Cache.Size == 0 {
+			s.Cache.Size = defaultCacheSize
+		}
+		if s.Cache.TTL == 0 {
+			s.Cache.TTL = defaultCacheTTL
+		}
+	}
 	return nil
 }
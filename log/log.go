@@ -83,6 +83,12 @@ func Error(err error) {
 	Errorf("%v", err)
 }
 
+// Flush waits until all pending messages
+// have been written to the log file.
+func Flush() {
+	instance().flush()
+}
+
 // singleton interface
 var (
 	logInst *Logger
@@ -99,6 +105,7 @@ type record struct {
 	file       string
 	line       int
 	log        string
+	flush      bool
 	continueCh chan struct{}
 }
 
@@ -149,9 +156,26 @@ func (l *Logger) writeLog(file string, line int, format string, async bool, args
 	}
 }
 
+func (l *Logger) flush() {
+	if !l.initialized {
+		return
+	}
+	entry := record{
+		flush:      true,
+		continueCh: make(chan struct{}),
+	}
+	l.logChan <- entry
+	<-entry.continueCh // wait until done
+}
+
 func (l *Logger) loop() {
 	for {
 		rec := <-l.logChan
+		if rec.flush {
+			l.f.Sync()
+			close(rec.continueCh)
+			continue
+		}
 
 		t := time.Now()
 		tm := t.Format("2006-01-02 15:04:05")
@@ -9,9 +9,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/ortuman/jackal/concurrent"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/server"
@@ -19,14 +23,18 @@ import (
 	"github.com/ortuman/jackal/version"
 )
 
+const shutdownTimeout = time.Second * 10
+
 func main() {
 	var configFile string
 	var showVersion bool
 	var showUsage bool
+	var migrate bool
 
 	flag.BoolVar(&showUsage, "help", false, "show application usage")
 	flag.BoolVar(&showVersion, "version", false, "show application version")
 	flag.StringVar(&configFile, "config", "/etc/jackal/jackal.yaml", "configuration path file")
+	flag.BoolVar(&migrate, "migrate", false, "apply pending storage schema migrations and exit")
 	flag.Parse()
 
 	// print usage
@@ -57,6 +65,14 @@ func main() {
 		os.Exit(-1)
 	}
 
+	// apply storage schema migrations
+	if migrate {
+		config.DefaultConfig.Storage.AutoMigrate = true
+		storage.Instance()
+		log.Infof("storage schema is up to date")
+		os.Exit(0)
+	}
+
 	// initialize storage subsystem
 	storage.Instance()
 
@@ -69,7 +85,31 @@ func main() {
 
 	// start serving...
 	log.Infof("jackal %v", version.ApplicationVersion)
-	server.Initialize()
+	go server.Initialize()
+
+	// wait for termination signal
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Infof("received %v signal... shutting down", sig)
+
+	shutdown()
+}
+
+func shutdown() {
+	server.Shutdown(shutdownTimeout)
+
+	// wait for pending operations (offline archiving, roster updates...)
+	if !concurrent.WaitPendingOperations(shutdownTimeout) {
+		log.Warnf("shutdown timeout expired while waiting for pending operations")
+	}
+	if len(config.DefaultConfig.PIDFile) > 0 {
+		if err := os.Remove(config.DefaultConfig.PIDFile); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+	log.Infof("jackal stopped")
+	log.Flush()
 }
 
 func createPIDFile(PIDFile string) error {
@@ -6,6 +6,7 @@
 package module
 
 import (
+	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -18,3 +19,17 @@ type IQHandler interface {
 	MatchesIQ(*xml.IQ) bool
 	ProcessIQ(*xml.IQ)
 }
+
+type stanzaErrorReplier interface {
+	InternalServerError() *xml.XElement
+	ResourceConstraintError() *xml.XElement
+}
+
+// storageErrorElement returns the error element to reply with
+// when a stanza couldn't be processed due to a storage failure.
+func storageErrorElement(stanza stanzaErrorReplier, err error) *xml.XElement {
+	if err == storage.ErrUnavailable {
+		return stanza.ResourceConstraintError()
+	}
+	return stanza.InternalServerError()
+}
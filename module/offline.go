@@ -6,6 +6,7 @@
 package module
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/ortuman/jackal/concurrent"
@@ -16,6 +17,13 @@ import (
 	"github.com/ortuman/jackal/xml"
 )
 
+const (
+	ampNamespace          = "http://jabber.org/protocol/amp"
+	legacyExpireNamespace = "jabber:x:expire"
+)
+
+const offlinePurgeInterval = time.Minute
+
 type ModOffline struct {
 	queue concurrent.OperationQueue
 	cfg   *config.ModOffline
@@ -60,29 +68,41 @@ func (o *ModOffline) archiveMessage(message *xml.Message) {
 	queueSize, err := storage.Instance().CountOfflineMessages(toJid.Node())
 	if err != nil {
 		log.Error(err)
+		o.strm.SendElement(storageErrorElement(o.errorResponse(message), err))
 		return
 	}
 	exists, err := storage.Instance().UserExists(toJid.Node())
 	if err != nil {
 		log.Error(err)
+		o.strm.SendElement(storageErrorElement(o.errorResponse(message), err))
 		return
 	}
 	if !exists || queueSize >= o.cfg.QueueSize {
-		response := message.Copy()
-		response.SetFrom(toJid.String())
-		response.SetTo(o.strm.JID().String())
-		o.strm.SendElement(response.ServiceUnavailableError())
+		o.strm.SendElement(o.errorResponse(message).ServiceUnavailableError())
+		return
+	}
+	expiresAt := messageExpiration(message)
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		log.Infof("discarding expired offline message... id: %s", message.ID())
 		return
 	}
 	delayed := message.Copy()
 	delayed.Delay(o.strm.Domain(), "Offline Storage")
-	if err := storage.Instance().InsertOfflineMessage(delayed, toJid.Node()); err != nil {
+	if err := storage.Instance().InsertOfflineMessage(delayed, toJid.Node(), expiresAt); err != nil {
 		log.Errorf("%v", err)
+		o.strm.SendElement(storageErrorElement(o.errorResponse(message), err))
 		return
 	}
 	log.Infof("archived offline message... id: %s", message.ID())
 }
 
+func (o *ModOffline) errorResponse(message *xml.Message) *xml.Message {
+	response := message.Copy()
+	response.SetFrom(message.ToJID().String())
+	response.SetTo(message.FromJID().String())
+	return response
+}
+
 func (o *ModOffline) deliverOfflineMessages() {
 	messages, err := storage.Instance().FetchOfflineMessages(o.strm.Username())
 	if err != nil {
@@ -94,10 +114,77 @@ func (o *ModOffline) deliverOfflineMessages() {
 	}
 	log.Infof("delivering offline messages... count: %d", len(messages))
 
+	var lastID int64
 	for _, m := range messages {
-		o.strm.SendElement(m)
+		// stop delivering as soon as stream goes away,
+		// keeping remaining messages for a later session
+		if !o.isStreamAvailable() {
+			break
+		}
+		if !o.isExpired(&m) {
+			o.strm.SendElement(m.Message)
+		}
+		lastID = m.ID
+	}
+	if lastID == 0 {
+		return
 	}
-	if err := storage.Instance().DeleteOfflineMessages(o.strm.Username()); err != nil {
+	if err := storage.Instance().DeleteOfflineMessages(o.strm.Username(), lastID); err != nil {
 		log.Error(err)
 	}
 }
+
+func (o *ModOffline) isExpired(m *storage.OfflineMessage) bool {
+	now := time.Now()
+	if !m.ExpiresAt.IsZero() && !m.ExpiresAt.After(now) {
+		return true
+	}
+	maxAge := time.Duration(o.cfg.ExpireAfter) * time.Second
+	return maxAge > 0 && now.Sub(m.CreatedAt) > maxAge
+}
+
+func (o *ModOffline) isStreamAvailable() bool {
+	for _, strm := range stream.C2S().AvailableStreams(o.strm.JID()) {
+		if strm.ID() == o.strm.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// messageExpiration returns message expiration time as requested by either
+// an XEP-0079 'expire-at' rule or a legacy XEP-0023 expiration element.
+// A zero time is returned for messages that don't expire.
+func messageExpiration(message *xml.Message) time.Time {
+	if amp := message.FindElementNamespace("amp", ampNamespace); amp != nil {
+		for _, rule := range amp.FindElements("rule") {
+			if rule.Attribute("condition") != "expire-at" {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, rule.Attribute("value")); err == nil {
+				return t
+			}
+		}
+	}
+	if x := message.FindElementNamespace("x", legacyExpireNamespace); x != nil {
+		if secs, err := strconv.Atoi(x.Attribute("seconds")); err == nil && secs >= 0 {
+			return time.Now().Add(time.Duration(secs) * time.Second)
+		}
+	}
+	return time.Time{}
+}
+
+// StartOfflinePurge starts a background task periodically deleting expired
+// offline messages, along with those older than maxAge if not zero.
+// Offline storage is shared by every domain, hence a single task must be started.
+func StartOfflinePurge(maxAge time.Duration) {
+	go func() {
+		tc := time.NewTicker(offlinePurgeInterval)
+		defer tc.Stop()
+		for range tc.C {
+			if err := storage.Instance().DeleteExpiredOfflineMessages(maxAge); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
@@ -73,6 +73,25 @@ func (r *ModRoster) ProcessPresence(presence *xml.Presence) {
 	r.queue.Async(func() {
 		if err := r.processPresence(presence); err != nil {
 			log.Error(err)
+			response := presence.Copy()
+			response.SetFrom(presence.ToJID().String())
+			response.SetTo(r.strm.JID().String())
+			r.strm.SendElement(storageErrorElement(response, err))
+		}
+	})
+}
+
+// ProcessRemotePresence processes a subscription or probe presence sent by a remote
+// entity to a local user. Only the local user roster is updated, as the remote one
+// is maintained by its own server.
+func (r *ModRoster) ProcessRemotePresence(presence *xml.Presence) {
+	r.queue.Async(func() {
+		if err := r.processRemotePresence(presence); err != nil {
+			log.Error(err)
+			response := presence.Copy()
+			response.SetFrom(presence.ToJID().String())
+			response.SetTo(presence.FromJID().String())
+			r.strm.SendElement(storageErrorElement(response, err))
 		}
 	})
 }
@@ -115,13 +134,53 @@ func (r *ModRoster) processPresence(presence *xml.Presence) error {
 	return nil
 }
 
+func (r *ModRoster) processRemotePresence(presence *xml.Presence) error {
+	fromJID := presence.FromJID()
+	toJID := presence.ToJID()
+
+	log.Infof("processing remote '%s' - from: %s to: %s", presence.Type(), fromJID, toJID)
+
+	switch presence.Type() {
+	case xml.SubscribeType:
+		return r.receiveSubscribe(fromJID, toJID, presence)
+	case xml.SubscribedType:
+		return r.receiveSubscribed(toJID, fromJID, presence)
+	case xml.UnsubscribeType:
+		return r.receiveUnsubscribe(fromJID, toJID, presence)
+	case xml.UnsubscribedType:
+		return r.receiveUnsubscribed(toJID, fromJID, presence)
+	case xml.ProbeType:
+		return r.receiveProbe(toJID, fromJID)
+	}
+	return nil
+}
+
+// receiveProbe answers a remote contact presence probe with the current
+// presence of the user, as long as the contact is subscribed to it.
+func (r *ModRoster) receiveProbe(userJID *xml.JID, contactJID *xml.JID) error {
+	ri, err := storage.Instance().FetchRosterItem(userJID.Node(), contactJID.ToBareJID().String())
+	if err != nil {
+		return err
+	}
+	if ri == nil || (ri.Subscription != subscriptionFrom && ri.Subscription != subscriptionBoth) {
+		r.routePresence(xml.NewPresence(userJID.ToBareJID(), contactJID.ToBareJID(), xml.UnsubscribedType), contactJID)
+		return nil
+	}
+	if len(stream.C2S().AvailableStreams(userJID)) == 0 {
+		r.routePresence(xml.NewPresence(userJID.ToBareJID(), contactJID, xml.UnavailableType), contactJID)
+		return nil
+	}
+	r.routePresencesFrom(userJID, contactJID, xml.AvailableType)
+	return nil
+}
+
 func (r *ModRoster) deliverPendingApprovalNotifications() error {
 	rosterNotifications, err := storage.Instance().FetchRosterNotifications(r.strm.Username())
 	if err != nil {
 		return err
 	}
 	for _, rosterNotification := range rosterNotifications {
-		fromJID, err := xml.NewJID(rosterNotification.User, r.strm.Domain(), "", true)
+		fromJID, err := xml.NewJIDString(rosterNotification.User, true)
 		if err != nil {
 			return err
 		}
@@ -145,7 +204,12 @@ func (r *ModRoster) receivePresences() error {
 			if err != nil {
 				return err
 			}
-			r.routePresencesFrom(itemJID, userJID, xml.AvailableType)
+			if r.isLocalJID(itemJID) {
+				r.routePresencesFrom(itemJID, userJID, xml.AvailableType)
+			} else {
+				// remote contact presence is requested to its server
+				r.routePresence(xml.NewPresence(userJID.ToBareJID(), itemJID, xml.ProbeType), itemJID)
+			}
 		}
 	}
 	return nil
@@ -153,7 +217,7 @@ func (r *ModRoster) receivePresences() error {
 
 func (r *ModRoster) broadcastPresence(presence *xml.Presence) error {
 	contactJID := presence.FromJID()
-	items, err := storage.Instance().FetchRosterItemsAsContact(contactJID.Node())
+	items, err := storage.Instance().FetchRosterItemsAsContact(contactJID.ToBareJID().String())
 	if err != nil {
 		return err
 	}
@@ -171,6 +235,28 @@ func (r *ModRoster) broadcastPresence(presence *xml.Presence) error {
 		}
 		r.routePresence(presence, userJID)
 	}
+	// remote subscribers are only known by user roster
+	items, err = storage.Instance().FetchRosterItemsAsUser(contactJID.Node())
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		switch item.Subscription {
+		case subscriptionFrom, subscriptionBoth:
+			break
+		default:
+			continue
+		}
+		itemJID, err := r.rosterItemJID(&item)
+		if err != nil {
+			return err
+		}
+		if !r.isLocalJID(itemJID) {
+			p := xml.NewPresence(presence.FromJID(), itemJID, presence.Type())
+			p.AppendElements(presence.Elements())
+			r.routePresence(p, itemJID)
+		}
+	}
 	return nil
 }
 
@@ -187,7 +273,7 @@ func (r *ModRoster) sendRoster(iq *xml.IQ, query xml.Element) {
 	items, err := storage.Instance().FetchRosterItemsAsUser(r.strm.Username())
 	if err != nil {
 		log.Error(err)
-		r.strm.SendElement(iq.InternalServerError())
+		r.strm.SendElement(storageErrorElement(iq, err))
 		return
 	}
 	if items != nil {
@@ -224,13 +310,13 @@ func (r *ModRoster) updateRoster(iq *xml.IQ, query xml.Element) {
 	case subscriptionRemove:
 		if err := r.removeRosterItem(ri); err != nil {
 			log.Error(err)
-			r.strm.SendElement(iq.InternalServerError())
+			r.strm.SendElement(storageErrorElement(iq, err))
 			return
 		}
 	default:
 		if err := r.updateRosterItem(ri); err != nil {
 			log.Error(err)
-			r.strm.SendElement(iq.InternalServerError())
+			r.strm.SendElement(storageErrorElement(iq, err))
 			return
 		}
 	}
@@ -375,7 +461,7 @@ func (r *ModRoster) processSubscribe(presence *xml.Presence) error {
 		// create roster item if not previously created
 		ri = &storage.RosterItem{
 			User:         userJID.Node(),
-			Contact:      contactJID.Node(),
+			Contact:      contactJID.ToBareJID().String(),
 			Subscription: subscriptionNone,
 			Ask:          true,
 		}
@@ -386,6 +472,11 @@ func (r *ModRoster) processSubscribe(presence *xml.Presence) error {
 	if err := r.pushRosterItem(ri, userJID); err != nil {
 		return err
 	}
+	return r.receiveSubscribe(userJID, contactJID, presence)
+}
+
+// receiveSubscribe delivers a 'subscribe' presence sent by userJID to contactJID.
+func (r *ModRoster) receiveSubscribe(userJID *xml.JID, contactJID *xml.JID, presence *xml.Presence) error {
 	// stamp the presence stanza of type "subscribe" with the user's bare JID as the 'from' address
 	p := xml.NewPresence(userJID.ToBareJID(), contactJID.ToBareJID(), xml.SubscribeType)
 	p.AppendElements(presence.Elements())
@@ -420,13 +511,30 @@ func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
 		case subscriptionNone:
 			contactRi.Subscription = subscriptionFrom
 		}
-		if err := r.insertOrUpdateRosterItem(contactRi); err != nil {
-			return err
-		}
-		if err := r.pushRosterItem(contactRi, contactJID); err != nil {
-			return err
+	} else {
+		// keep track of the approved subscription, as contact roster is
+		// the only place where a remote subscriber can be found.
+		contactRi = &storage.RosterItem{
+			User:         contactJID.Node(),
+			Contact:      userJID.ToBareJID().String(),
+			Subscription: subscriptionFrom,
 		}
 	}
+	if err := r.insertOrUpdateRosterItem(contactRi); err != nil {
+		return err
+	}
+	if err := r.pushRosterItem(contactRi, contactJID); err != nil {
+		return err
+	}
+	if err := r.receiveSubscribed(userJID, contactJID, presence); err != nil {
+		return err
+	}
+	r.routePresencesFrom(contactJID, userJID, xml.AvailableType)
+	return nil
+}
+
+// receiveSubscribed delivers a 'subscribed' presence sent by contactJID to userJID.
+func (r *ModRoster) receiveSubscribed(userJID *xml.JID, contactJID *xml.JID, presence *xml.Presence) error {
 	// stamp the presence stanza of type "subscribed" with the contact's bare JID as the 'from' address
 	p := xml.NewPresence(contactJID.ToBareJID(), userJID.ToBareJID(), xml.SubscribedType)
 	p.AppendElements(presence.Elements())
@@ -455,7 +563,6 @@ func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
 		}
 	}
 	r.routePresence(p, userJID)
-	r.routePresencesFrom(contactJID, userJID, xml.AvailableType)
 	return nil
 }
 
@@ -469,10 +576,8 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 	if err != nil {
 		return err
 	}
-	userSubscription := subscriptionNone
 	if userRi != nil {
-		userSubscription = userRi.Subscription
-		switch userSubscription {
+		switch userRi.Subscription {
 		case subscriptionBoth:
 			userRi.Subscription = subscriptionFrom
 		default:
@@ -485,17 +590,24 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 			return err
 		}
 	}
+	return r.receiveUnsubscribe(userJID, contactJID, presence)
+}
+
+// receiveUnsubscribe delivers an 'unsubscribe' presence sent by userJID to contactJID.
+func (r *ModRoster) receiveUnsubscribe(userJID *xml.JID, contactJID *xml.JID, presence *xml.Presence) error {
 	// stamp the presence stanza of type "unsubscribe" with the users's bare JID as the 'from' address
 	p := xml.NewPresence(userJID.ToBareJID(), contactJID.ToBareJID(), xml.UnsubscribeType)
 	p.AppendElements(presence.Elements())
 
+	contactSubscription := subscriptionNone
 	if r.isLocalJID(contactJID) {
 		contactRi, err := r.fetchRosterItem(contactJID, userJID)
 		if err != nil {
 			return err
 		}
 		if contactRi != nil {
-			switch contactRi.Subscription {
+			contactSubscription = contactRi.Subscription
+			switch contactSubscription {
 			case subscriptionBoth:
 				contactRi.Subscription = subscriptionTo
 			default:
@@ -511,7 +623,7 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 	}
 	r.routePresence(p, contactJID)
 
-	if userSubscription == subscriptionTo || userSubscription == subscriptionBoth {
+	if contactSubscription == subscriptionFrom || contactSubscription == subscriptionBoth {
 		r.routePresencesFrom(contactJID, userJID, xml.UnavailableType)
 	}
 	return nil
@@ -546,6 +658,17 @@ func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
 			return err
 		}
 	}
+	if err := r.receiveUnsubscribed(userJID, contactJID, presence); err != nil {
+		return err
+	}
+	if contactSubscription == subscriptionFrom || contactSubscription == subscriptionBoth {
+		r.routePresencesFrom(contactJID, userJID, xml.UnavailableType)
+	}
+	return nil
+}
+
+// receiveUnsubscribed delivers an 'unsubscribed' presence sent by contactJID to userJID.
+func (r *ModRoster) receiveUnsubscribed(userJID *xml.JID, contactJID *xml.JID, presence *xml.Presence) error {
 	// stamp the presence stanza of type "unsubscribed" with the contact's bare JID as the 'from' address
 	p := xml.NewPresence(contactJID.ToBareJID(), userJID.ToBareJID(), xml.UnsubscribedType)
 	p.AppendElements(presence.Elements())
@@ -572,16 +695,12 @@ func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
 		}
 	}
 	r.routePresence(p, userJID)
-
-	if contactSubscription == subscriptionFrom || contactSubscription == subscriptionBoth {
-		r.routePresencesFrom(contactJID, userJID, xml.UnavailableType)
-	}
 	return nil
 }
 
 func (r *ModRoster) insertOrUpdateRosterNotification(userJID *xml.JID, contactJID *xml.JID, presence *xml.Presence) error {
 	rn := &storage.RosterNotification{
-		User:     userJID.Node(),
+		User:     userJID.ToBareJID().String(),
 		Contact:  contactJID.Node(),
 		Elements: presence.Elements(),
 	}
@@ -589,11 +708,11 @@ func (r *ModRoster) insertOrUpdateRosterNotification(userJID *xml.JID, contactJI
 }
 
 func (r *ModRoster) deleteRosterNotification(userJID *xml.JID, contactJID *xml.JID) error {
-	return storage.Instance().DeleteRosterNotification(userJID.Node(), contactJID.Node())
+	return storage.Instance().DeleteRosterNotification(userJID.ToBareJID().String(), contactJID.Node())
 }
 
 func (r *ModRoster) fetchRosterItem(userJID *xml.JID, contactJID *xml.JID) (*storage.RosterItem, error) {
-	ri, err := storage.Instance().FetchRosterItem(userJID.Node(), contactJID.Node())
+	ri, err := storage.Instance().FetchRosterItem(userJID.Node(), contactJID.ToBareJID().String())
 	if err != nil {
 		return nil, err
 	}
@@ -608,7 +727,7 @@ func (r *ModRoster) insertOrUpdateRosterItem(ri *storage.RosterItem) error {
 }
 
 func (r *ModRoster) deleteRosterItem(userJID *xml.JID, contactJID *xml.JID) error {
-	return storage.Instance().DeleteRosterItem(userJID.Node(), contactJID.Node())
+	return storage.Instance().DeleteRosterItem(userJID.Node(), contactJID.ToBareJID().String())
 }
 
 func (r *ModRoster) pushRosterItem(ri *storage.RosterItem, to *xml.JID) error {
@@ -619,7 +738,7 @@ func (r *ModRoster) pushRosterItem(ri *storage.RosterItem, to *xml.JID) error {
 	query := xml.NewElementNamespace("query", rosterNamespace)
 	query.AppendElement(elem)
 
-	streams := stream.C2S().AvailableStreams(to.Node())
+	streams := stream.C2S().AvailableStreams(to)
 	for _, strm := range streams {
 		if !strm.IsRosterRequested() {
 			continue
@@ -637,7 +756,7 @@ func (r *ModRoster) isLocalJID(jid *xml.JID) bool {
 }
 
 func (r *ModRoster) routePresencesFrom(from *xml.JID, to *xml.JID, presenceType string) {
-	fromStreams := stream.C2S().AvailableStreams(from.Node())
+	fromStreams := stream.C2S().AvailableStreams(from)
 	for _, fromStream := range fromStreams {
 		p := xml.NewPresence(fromStream.JID(), to.ToBareJID(), presenceType)
 		if presenceType == xml.AvailableType {
@@ -649,19 +768,25 @@ func (r *ModRoster) routePresencesFrom(from *xml.JID, to *xml.JID, presenceType
 
 func (r *ModRoster) routePresence(presence *xml.Presence, to *xml.JID) {
 	if stream.C2S().IsLocalDomain(to.Domain()) {
-		toStreams := stream.C2S().AvailableStreams(to.Node())
+		toStreams := stream.C2S().AvailableStreams(to)
 		for _, toStream := range toStreams {
 			p := xml.NewPresence(presence.FromJID(), toStream.JID(), presence.Type())
 			p.AppendElements(presence.Elements())
 			toStream.SendElement(p)
 		}
+	} else if stream.Components().IsComponentDomain(to.Domain()) {
+		if comp := stream.Components().Component(to.Domain()); comp != nil {
+			comp.SendElement(presence)
+		}
 	} else {
-		// TODO(ortuman): Implement XMPP federation
+		if err := stream.S2S().Route(presence, r.strm.Domain(), to.Domain()); err != nil {
+			log.Error(err)
+		}
 	}
 }
 
 func (r *ModRoster) rosterItemJID(ri *storage.RosterItem) (*xml.JID, error) {
-	return xml.NewJIDString(fmt.Sprintf("%s@%s", ri.Contact, r.strm.Domain()), true)
+	return xml.NewJIDString(ri.Contact, true)
 }
 
 func (r *ModRoster) rosterItemFromElement(item xml.Element) (*storage.RosterItem, error) {
@@ -671,7 +796,7 @@ func (r *ModRoster) rosterItemFromElement(item xml.Element) (*storage.RosterItem
 		if err != nil {
 			return nil, err
 		}
-		ri.Contact = j.Node()
+		ri.Contact = j.ToBareJID().String()
 	} else {
 		return nil, errors.New("item 'jid' attribute is required")
 	}
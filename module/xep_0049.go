@@ -80,7 +80,7 @@ func (x *XEPPrivateStorage) getPrivate(iq *xml.IQ, q xml.Element) {
 	privElements, err := storage.Instance().FetchPrivateXML(privNS, x.strm.Username())
 	if err != nil {
 		log.Errorf("%v", err)
-		x.strm.SendElement(iq.InternalServerError())
+		x.strm.SendElement(storageErrorElement(iq, err))
 		return
 	}
 	res := iq.ResultIQ()
@@ -121,7 +121,7 @@ func (x *XEPPrivateStorage) setPrivate(iq *xml.IQ, q xml.Element) {
 
 		if err := storage.Instance().InsertOrUpdatePrivateXML(elements, ns, x.strm.Username()); err != nil {
 			log.Errorf("%v", err)
-			x.strm.SendElement(iq.InternalServerError())
+			x.strm.SendElement(storageErrorElement(iq, err))
 			return
 		}
 	}
@@ -69,7 +69,7 @@ func (x *XEPVCard) getVCard(vCard xml.Element, iq *xml.IQ) {
 	resElem, err := storage.Instance().FetchVCard(username)
 	if err != nil {
 		log.Errorf("%v", err)
-		x.strm.SendElement(iq.InternalServerError())
+		x.strm.SendElement(storageErrorElement(iq, err))
 		return
 	}
 	log.Infof("retrieving vcard... (%s/%s)", x.strm.Username(), x.strm.Resource())
@@ -92,7 +92,7 @@ func (x *XEPVCard) setVCard(vCard xml.Element, iq *xml.IQ) {
 		err := storage.Instance().InsertOrUpdateVCard(vCard, x.strm.Username())
 		if err != nil {
 			log.Errorf("%v", err)
-			x.strm.SendElement(iq.InternalServerError())
+			x.strm.SendElement(storageErrorElement(iq, err))
 			return
 		}
 		x.strm.SendElement(iq.ResultIQ())
@@ -100,7 +100,7 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.Element) {
 	exists, err := storage.Instance().UserExists(userEl.Text())
 	if err != nil {
 		log.Errorf("%v", err)
-		x.strm.SendElement(iq.InternalServerError())
+		x.strm.SendElement(storageErrorElement(iq, err))
 		return
 	}
 	if exists {
@@ -109,13 +109,17 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.Element) {
 	}
 	user := storage.User{
 		Username: userEl.Text(),
-		Password: passwordEl.Text(),
 	}
-	if err := storage.Instance().InsertOrUpdateUser(&user); err != nil {
+	if err := user.SetPassword(passwordEl.Text()); err != nil {
 		log.Errorf("%v", err)
 		x.strm.SendElement(iq.InternalServerError())
 		return
 	}
+	if err := storage.Instance().InsertOrUpdateUser(&user); err != nil {
+		log.Errorf("%v", err)
+		x.strm.SendElement(storageErrorElement(iq, err))
+		return
+	}
 	x.strm.SendElement(iq.ResultIQ())
 	x.registered = true
 }
@@ -131,7 +135,7 @@ func (x *XEPRegister) cancelRegistration(iq *xml.IQ, query xml.Element) {
 	}
 	if err := storage.Instance().DeleteUser(x.strm.Username()); err != nil {
 		log.Error(err)
-		x.strm.SendElement(iq.InternalServerError())
+		x.strm.SendElement(storageErrorElement(iq, err))
 		return
 	}
 	x.strm.SendElement(iq.ResultIQ())
@@ -154,20 +158,24 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 	user, err := storage.Instance().FetchUser(username)
 	if err != nil {
 		log.Error(err)
-		x.strm.SendElement(iq.InternalServerError())
+		x.strm.SendElement(storageErrorElement(iq, err))
 		return
 	}
-	if user == nil || user.Password == password {
+	if user == nil || (!user.HasPlaintextPassword() && user.VerifyPassword(password)) {
 		// nothing to do
 		x.strm.SendElement(iq.ResultIQ())
 		return
 	}
-	user.Password = password
-	if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
+	if err := user.SetPassword(password); err != nil {
 		log.Error(err)
 		x.strm.SendElement(iq.InternalServerError())
 		return
 	}
+	if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
+		log.Error(err)
+		x.strm.SendElement(storageErrorElement(iq, err))
+		return
+	}
 	x.strm.SendElement(iq.ResultIQ())
 }
 
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"sync/atomic"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	carbonsNamespace = "urn:xmpp:carbons:2"
+	forwardNamespace = "urn:xmpp:forward:0"
+	hintsNamespace   = "urn:xmpp:hints"
+
+	jabberClientNamespace = "jabber:client"
+)
+
+type XEPCarbons struct {
+	strm    stream.C2SStream
+	enabled uint32
+}
+
+func NewXEPCarbons(strm stream.C2SStream) *XEPCarbons {
+	return &XEPCarbons{
+		strm: strm,
+	}
+}
+
+func (x *XEPCarbons) AssociatedNamespaces() []string {
+	return []string{carbonsNamespace}
+}
+
+func (x *XEPCarbons) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("enable", carbonsNamespace) != nil ||
+		iq.FindElementNamespace("disable", carbonsNamespace) != nil
+}
+
+func (x *XEPCarbons) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && (!toJid.IsBare() || toJid.Node() != x.strm.Username()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	if !iq.IsSet() || iq.Elements()[0].ElementsCount() > 0 {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if iq.FindElementNamespace("enable", carbonsNamespace) != nil {
+		atomic.StoreUint32(&x.enabled, 1)
+		log.Infof("enabled carbons... (%s/%s)", x.strm.Username(), x.strm.Resource())
+	} else {
+		atomic.StoreUint32(&x.enabled, 0)
+		log.Infof("disabled carbons... (%s/%s)", x.strm.Username(), x.strm.Resource())
+	}
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+// IsEnabled returns whether the stream has requested carbon copies of its user messages.
+func (x *XEPCarbons) IsEnabled() bool {
+	return atomic.LoadUint32(&x.enabled) == 1
+}
+
+// IsCarbonsEligible returns true if a carbon copy of message should be
+// delivered to the rest of its sender and recipient resources.
+func IsCarbonsEligible(message *xml.Message) bool {
+	if !message.IsChat() {
+		return false
+	}
+	// already a carbon copy
+	if message.FindElementNamespace("sent", carbonsNamespace) != nil ||
+		message.FindElementNamespace("received", carbonsNamespace) != nil {
+		return false
+	}
+	return message.FindElementNamespace("private", carbonsNamespace) == nil &&
+		message.FindElementNamespace("no-copy", hintsNamespace) == nil
+}
+
+// StripCarbonsPrivate removes the carbons 'private' element from a message
+// before delivering it to its recipient.
+func StripCarbonsPrivate(message *xml.Message) {
+	message.RemoveElementsNamespace("private", carbonsNamespace)
+}
+
+// SendCarbons delivers a 'sent' or 'received' carbon copy of message
+// to every carbons enabled stream bound to jid, except for 'origin' stream.
+func SendCarbons(message *xml.Message, jid *xml.JID, sent bool, origin stream.C2SStream) {
+	label := "received"
+	if sent {
+		label = "sent"
+	}
+	fwd := forwardedStanza(message)
+	for _, strm := range stream.C2S().AvailableStreams(jid) {
+		if strm == origin || !strm.IsCarbonsEnabled() {
+			continue
+		}
+		forwarded := xml.NewElementNamespace("forwarded", forwardNamespace)
+		forwarded.AppendElement(fwd)
+		carbon := xml.NewElementNamespace(label, carbonsNamespace)
+		carbon.AppendElement(forwarded)
+
+		cc := xml.NewElementName("message")
+		cc.SetFrom(strm.JID().ToBareJID().String())
+		cc.SetTo(strm.JID().String())
+		cc.SetType(xml.ChatType)
+		cc.AppendElement(carbon)
+		strm.SendElement(cc)
+	}
+}
+
+// forwardedStanza qualifies a stanza by its own namespace (XEP-0297),
+// so that it can be embedded into a 'forwarded' element.
+func forwardedStanza(stanza xml.Element) xml.Element {
+	if len(stanza.Namespace()) > 0 {
+		return stanza
+	}
+	attrs := append([]xml.Attribute{{Label: "xmlns", Value: jabberClientNamespace}}, stanza.Attributes()...)
+	fwd := xml.NewElementAttributes(stanza.Name(), attrs)
+	fwd.SetText(stanza.Text())
+	fwd.AppendElements(stanza.Elements())
+	return fwd
+}
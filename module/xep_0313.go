@@ -0,0 +1,497 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/concurrent"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	mamNamespace      = "urn:xmpp:mam:2"
+	rsmNamespace      = "http://jabber.org/protocol/rsm"
+	stanzaIDNamespace = "urn:xmpp:sid:0"
+	xDataNamespace    = "jabber:x:data"
+	delayNamespace    = "urn:xmpp:delay"
+)
+
+const (
+	mamDefaultPageSize = 50
+	mamMaxPageSize     = 250
+)
+
+const (
+	archiveAlways = "always"
+	archiveNever  = "never"
+	archiveRoster = "roster"
+)
+
+var errInvalidArchiveQuery = errors.New("mam: invalid archive query")
+
+// archiveQueues serialize message archiving storage operations per user,
+// so that a slow archive only holds back its own user streams.
+var (
+	archiveQueuesMu sync.Mutex
+	archiveQueues   = make(map[string]*concurrent.OperationQueue)
+)
+
+// XEPMessageArchive implements XEP-0313 Message Archive Management,
+// along with XEP-0059 Result Set Management paging of archive queries.
+type XEPMessageArchive struct {
+	cfg  *config.ModMAM
+	strm stream.C2SStream
+}
+
+func NewXEPMessageArchive(config *config.ModMAM, strm stream.C2SStream) *XEPMessageArchive {
+	return &XEPMessageArchive{
+		cfg:  config,
+		strm: strm,
+	}
+}
+
+func (x *XEPMessageArchive) AssociatedNamespaces() []string {
+	return []string{mamNamespace, stanzaIDNamespace}
+}
+
+func (x *XEPMessageArchive) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("query", mamNamespace) != nil || iq.FindElementNamespace("prefs", mamNamespace) != nil
+}
+
+func (x *XEPMessageArchive) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && (!toJid.IsBare() || toJid.Node() != x.strm.Username()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	if q := iq.FindElementNamespace("query", mamNamespace); q != nil {
+		switch {
+		case iq.IsGet():
+			x.sendQueryForm(iq)
+		case iq.IsSet():
+			x.queryArchive(iq, q)
+		default:
+			x.strm.SendElement(iq.BadRequestError())
+		}
+		return
+	}
+	prefs := iq.FindElementNamespace("prefs", mamNamespace)
+	switch {
+	case iq.IsGet():
+		x.sendPrefs(iq)
+	case iq.IsSet():
+		x.updatePrefs(iq, prefs)
+	default:
+		x.strm.SendElement(iq.BadRequestError())
+	}
+}
+
+func (x *XEPMessageArchive) sendQueryForm(iq *xml.IQ) {
+	form := xml.NewElementNamespace("x", xDataNamespace)
+	form.SetAttribute("type", "form")
+	form.AppendElement(formField("FORM_TYPE", "hidden", mamNamespace))
+	form.AppendElement(formField("with", "jid-single", ""))
+	form.AppendElement(formField("start", "text-single", ""))
+	form.AppendElement(formField("end", "text-single", ""))
+
+	query := xml.NewElementNamespace("query", mamNamespace)
+	query.AppendElement(form)
+
+	result := iq.ResultIQ()
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPMessageArchive) queryArchive(iq *xml.IQ, q xml.Element) {
+	query, err := parseArchiveQuery(q)
+	if err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	var messages []storage.ArchivedMessage
+	var complete bool
+	if query.Max > 0 {
+		messages, complete, err = storage.Instance().FetchArchivedMessages(x.strm.Username(), query)
+		switch err {
+		case nil:
+			break
+		case storage.ErrArchiveItemNotFound:
+			x.strm.SendElement(iq.ItemNotFoundError())
+			return
+		default:
+			log.Error(err)
+			x.strm.SendElement(storageErrorElement(iq, err))
+			return
+		}
+	}
+	log.Infof("retrieved archived messages... count: %d (%s/%s)", len(messages), x.strm.Username(), x.strm.Resource())
+
+	queryID := q.Attribute("queryid")
+	for i := range messages {
+		x.strm.SendElement(x.resultMessage(&messages[i], queryID))
+	}
+	set := xml.NewElementNamespace("set", rsmNamespace)
+	if len(messages) > 0 {
+		first := xml.NewElementName("first")
+		first.SetText(messages[0].ID)
+		set.AppendElement(first)
+
+		last := xml.NewElementName("last")
+		last.SetText(messages[len(messages)-1].ID)
+		set.AppendElement(last)
+	}
+	fin := xml.NewElementNamespace("fin", mamNamespace)
+	if complete {
+		fin.SetAttribute("complete", "true")
+	}
+	fin.AppendElement(set)
+
+	result := iq.ResultIQ()
+	result.AppendElement(fin)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPMessageArchive) resultMessage(m *storage.ArchivedMessage, queryID string) xml.Element {
+	delay := xml.NewElementNamespace("delay", delayNamespace)
+	delay.SetAttribute("stamp", m.CreatedAt.UTC().Format(time.RFC3339))
+
+	forwarded := xml.NewElementNamespace("forwarded", forwardNamespace)
+	forwarded.AppendElement(delay)
+	forwarded.AppendElement(forwardedStanza(m.Message))
+
+	result := xml.NewElementNamespace("result", mamNamespace)
+	if len(queryID) > 0 {
+		result.SetAttribute("queryid", queryID)
+	}
+	result.SetAttribute("id", m.ID)
+	result.AppendElement(forwarded)
+
+	message := xml.NewElementName("message")
+	message.SetFrom(x.strm.JID().ToBareJID().String())
+	message.SetTo(x.strm.JID().String())
+	message.AppendElement(result)
+	return message
+}
+
+func (x *XEPMessageArchive) sendPrefs(iq *xml.IQ) {
+	prefs, err := archivePrefs(x.cfg, x.strm.Username())
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(storageErrorElement(iq, err))
+		return
+	}
+	result := iq.ResultIQ()
+	result.AppendElement(prefsElement(prefs))
+	x.strm.SendElement(result)
+}
+
+func (x *XEPMessageArchive) updatePrefs(iq *xml.IQ, elem xml.Element) {
+	prefs := &storage.ArchivePrefs{
+		Username: x.strm.Username(),
+		Default:  elem.Attribute("default"),
+	}
+	switch prefs.Default {
+	case archiveAlways, archiveNever, archiveRoster:
+		break
+	default:
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	var err error
+	if prefs.Always, err = prefsJIDs(elem.FindElement("always")); err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if prefs.Never, err = prefsJIDs(elem.FindElement("never")); err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if err := storage.Instance().InsertOrUpdateArchivePrefs(prefs); err != nil {
+		log.Error(err)
+		x.strm.SendElement(storageErrorElement(iq, err))
+		return
+	}
+	log.Infof("updated archiving preferences... default: %s (%s/%s)", prefs.Default, x.strm.Username(), x.strm.Resource())
+
+	result := iq.ResultIQ()
+	result.AppendElement(prefsElement(prefs))
+	x.strm.SendElement(result)
+}
+
+// ArchiveOutgoingMessage stores a message sent by a local user into its archive,
+// as long as user archiving preferences allow it.
+func ArchiveOutgoingMessage(config *config.ModMAM, message *xml.Message) {
+	if !isArchivable(message) {
+		return
+	}
+	username := message.FromJID().Node()
+	peer := message.ToJID()
+	m := newArchivedMessage(uuid.New(), message, peer)
+	archiveQueue(username).Async(func() {
+		archive, err := shouldArchive(config, username, peer)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if archive {
+			storeArchivedMessage(m, username)
+		}
+	})
+}
+
+// ArchiveIncomingMessage stores a message addressed to a local user into its archive,
+// as long as user archiving preferences allow it, stamping its archive
+// identifier into the message before being delivered (XEP-0359).
+func ArchiveIncomingMessage(config *config.ModMAM, message *xml.Message) {
+	by := message.ToJID().ToBareJID().String()
+
+	// a stanza-id claimed by us can't be trusted
+	removeStanzaIDs(message, by)
+
+	if !isArchivable(message) {
+		return
+	}
+	// only archived messages are stamped... decide it before delivery
+	username := message.ToJID().Node()
+	peer := message.FromJID()
+	exists, err := storage.Instance().UserExists(username)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !exists {
+		return
+	}
+	archive, err := shouldArchive(config, username, peer)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !archive {
+		return
+	}
+	id := uuid.New()
+	m := newArchivedMessage(id, message, peer)
+	archiveQueue(username).Async(func() {
+		storeArchivedMessage(m, username)
+	})
+	stanzaID := xml.NewElementNamespace("stanza-id", stanzaIDNamespace)
+	stanzaID.SetAttribute("id", id)
+	stanzaID.SetAttribute("by", by)
+	message.AppendElement(stanzaID)
+}
+
+// archiveQueue returns the queue where username archive operations take place.
+func archiveQueue(username string) *concurrent.OperationQueue {
+	archiveQueuesMu.Lock()
+	defer archiveQueuesMu.Unlock()
+	q := archiveQueues[username]
+	if q == nil {
+		q = &concurrent.OperationQueue{QueueSize: 32, Timeout: time.Second}
+		archiveQueues[username] = q
+	}
+	return q
+}
+
+func newArchivedMessage(id string, message *xml.Message, peer *xml.JID) *storage.ArchivedMessage {
+	return &storage.ArchivedMessage{
+		ID:        id,
+		Peer:      peer.String(),
+		Message:   message.Copy(),
+		CreatedAt: time.Now(),
+	}
+}
+
+func storeArchivedMessage(m *storage.ArchivedMessage, username string) {
+	if err := storage.Instance().InsertArchivedMessage(m, username); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("archived message... id: %s (%s)", m.ID, username)
+}
+
+func isArchivable(message *xml.Message) bool {
+	if !message.IsChat() && !message.IsNormal() {
+		return false
+	}
+	if message.FindElement("body") == nil {
+		return false
+	}
+	return message.FindElementNamespace("no-store", hintsNamespace) == nil &&
+		message.FindElementNamespace("no-permanent-store", hintsNamespace) == nil
+}
+
+func shouldArchive(config *config.ModMAM, username string, peer *xml.JID) (bool, error) {
+	prefs, err := archivePrefs(config, username)
+	if err != nil {
+		return false, err
+	}
+	if containsJID(prefs.Never, peer) {
+		return false, nil
+	}
+	if containsJID(prefs.Always, peer) {
+		return true, nil
+	}
+	switch prefs.Default {
+	case archiveAlways:
+		return true, nil
+	case archiveRoster:
+		ri, err := storage.Instance().FetchRosterItem(username, peer.ToBareJID().String())
+		if err != nil {
+			return false, err
+		}
+		return ri != nil, nil
+	}
+	return false, nil
+}
+
+// archivePrefs returns user archiving preferences,
+// falling back to configured default preference.
+func archivePrefs(config *config.ModMAM, username string) (*storage.ArchivePrefs, error) {
+	prefs, err := storage.Instance().FetchArchivePrefs(username)
+	if err != nil {
+		return nil, err
+	}
+	if prefs == nil {
+		prefs = &storage.ArchivePrefs{Username: username, Default: config.Default}
+	}
+	return prefs, nil
+}
+
+func parseArchiveQuery(q xml.Element) (*storage.ArchiveQuery, error) {
+	query := &storage.ArchiveQuery{Max: mamDefaultPageSize}
+	if form := q.FindElementNamespace("x", xDataNamespace); form != nil {
+		for _, field := range form.FindElements("field") {
+			var value string
+			if v := field.FindElement("value"); v != nil {
+				value = v.Text()
+			}
+			var err error
+			switch field.Attribute("var") {
+			case "FORM_TYPE":
+				if value != mamNamespace {
+					return nil, errInvalidArchiveQuery
+				}
+			case "with":
+				query.With, err = xml.NewJIDString(value, false)
+			case "start":
+				query.Start, err = time.Parse(time.RFC3339, value)
+			case "end":
+				query.End, err = time.Parse(time.RFC3339, value)
+			default:
+				return nil, errInvalidArchiveQuery
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if set := q.FindElementNamespace("set", rsmNamespace); set != nil {
+		if max := set.FindElement("max"); max != nil {
+			n, err := strconv.Atoi(max.Text())
+			if err != nil || n < 0 {
+				return nil, errInvalidArchiveQuery
+			}
+			query.Max = n
+		}
+		if after := set.FindElement("after"); after != nil {
+			query.AfterID = after.Text()
+		}
+		if before := set.FindElement("before"); before != nil {
+			query.BeforeID = before.Text()
+			query.LastPage = len(query.BeforeID) == 0
+		}
+	}
+	if query.Max > mamMaxPageSize {
+		query.Max = mamMaxPageSize
+	}
+	return query, nil
+}
+
+func prefsElement(prefs *storage.ArchivePrefs) xml.Element {
+	elem := xml.NewElementNamespace("prefs", mamNamespace)
+	elem.SetAttribute("default", prefs.Default)
+
+	always := xml.NewElementName("always")
+	for _, j := range prefs.Always {
+		jid := xml.NewElementName("jid")
+		jid.SetText(j)
+		always.AppendElement(jid)
+	}
+	elem.AppendElement(always)
+
+	never := xml.NewElementName("never")
+	for _, j := range prefs.Never {
+		jid := xml.NewElementName("jid")
+		jid.SetText(j)
+		never.AppendElement(jid)
+	}
+	elem.AppendElement(never)
+	return elem
+}
+
+func prefsJIDs(elem xml.Element) ([]string, error) {
+	if elem == nil {
+		return nil, nil
+	}
+	var ret []string
+	for _, jidElem := range elem.FindElements("jid") {
+		jid, err := xml.NewJIDString(jidElem.Text(), false)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, jid.String())
+	}
+	return ret, nil
+}
+
+func containsJID(jids []string, jid *xml.JID) bool {
+	full := jid.String()
+	bare := jid.ToBareJID().String()
+	for _, j := range jids {
+		if j == full || j == bare {
+			return true
+		}
+	}
+	return false
+}
+
+func removeStanzaIDs(message *xml.Message, by string) {
+	var spoofed bool
+	var elems []xml.Element
+	for _, elem := range message.Elements() {
+		if elem.Name() == "stanza-id" && elem.Namespace() == stanzaIDNamespace && elem.Attribute("by") == by {
+			spoofed = true
+			continue
+		}
+		elems = append(elems, elem)
+	}
+	if spoofed {
+		message.ClearElements()
+		message.AppendElements(elems)
+	}
+}
+
+func formField(name, typ, value string) xml.Element {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", name)
+	field.SetAttribute("type", typ)
+	if len(value) > 0 {
+		v := xml.NewElementName("value")
+		v.SetText(value)
+		field.AppendElement(v)
+	}
+	return field
+}
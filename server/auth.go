@@ -5,7 +5,11 @@
 
 package server
 
-import "github.com/ortuman/jackal/xml"
+import (
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+)
 
 const saslNamespace = "urn:ietf:params:xml:ns:xmpp-sasl"
 
@@ -45,3 +49,17 @@ var (
 	errSASLNotAuthorized        = newSASLError("not-authorized")
 	errSASLTemporaryAuthFailure = newSASLError("temporary-auth-failure")
 )
+
+// upgradeUserCredentials replaces a legacy plaintext password
+// with its hashed form once it has been successfully verified.
+func upgradeUserCredentials(user *storage.User, password string) {
+	if err := user.SetPassword(password); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("upgraded user credentials... (%s)", user.Username)
+}
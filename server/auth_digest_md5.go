@@ -184,7 +184,8 @@ func (d *digestMD5Authenticator) handleChallenged(elem xml.Element) error {
 	if err != nil {
 		return err
 	}
-	if user == nil {
+	if user == nil || !user.HasPlaintextPassword() {
+		// DIGEST-MD5 can only be verified against a plaintext password
 		return errSASLNotAuthorized
 	}
 	// validate response
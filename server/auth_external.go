@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+)
+
+// id-on-xmppAddr (https://tools.ietf.org/html/rfc6120#section-13.7.1.4)
+var oidXMPPAddr = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// externalAuthenticator implements SASL EXTERNAL mechanism
+// authenticating clients by means of their TLS certificate (XEP-0178).
+type externalAuthenticator struct {
+	strm          *serverStream
+	username      string
+	authenticated bool
+}
+
+func newExternalAuthenticator(strm *serverStream) authenticator {
+	return &externalAuthenticator{strm: strm}
+}
+
+func (e *externalAuthenticator) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (e *externalAuthenticator) Username() string {
+	return e.username
+}
+
+func (e *externalAuthenticator) Authenticated() bool {
+	return e.authenticated
+}
+
+func (e *externalAuthenticator) UsesChannelBinding() bool {
+	return false
+}
+
+func (e *externalAuthenticator) ProcessElement(elem xml.Element) error {
+	if e.authenticated {
+		return nil
+	}
+	certs := e.strm.tr.PeerCertificates()
+	if len(certs) == 0 {
+		return errSASLNotAuthorized
+	}
+	authzID, err := decodeAuthzID(elem)
+	if err != nil {
+		return err
+	}
+	var userJID *xml.JID
+	for _, j := range certificateJIDs(certs[0]) {
+		if len(j.Node()) == 0 || j.Domain() != e.strm.Domain() {
+			continue
+		}
+		if len(authzID) == 0 || authzID == j.ToBareJID().String() {
+			userJID = j
+			break
+		}
+	}
+	if userJID == nil {
+		return errSASLNotAuthorized
+	}
+	exists, err := storage.Instance().UserExists(userJID.Node())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errSASLNotAuthorized
+	}
+	e.username = userJID.Node()
+	e.authenticated = true
+
+	e.strm.SendElement(xml.NewElementNamespace("success", saslNamespace))
+	return nil
+}
+
+func (e *externalAuthenticator) Reset() {
+	e.username = ""
+	e.authenticated = false
+}
+
+// decodeAuthzID returns the authorization identity sent along with
+// an EXTERNAL auth element, or an empty string if none was provided.
+func decodeAuthzID(elem xml.Element) (string, error) {
+	if elem.TextLen() == 0 || elem.Text() == "=" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(elem.Text())
+	if err != nil {
+		return "", errSASLIncorrectEncoding
+	}
+	return string(b), nil
+}
+
+// certificateJIDs maps a certificate to the JIDs it identifies.
+// XmppAddr subject alternative names take precedence, followed by
+// e-mail subject alternative names and, lastly, subject common name.
+func certificateJIDs(cert *x509.Certificate) []*xml.JID {
+	var jids []*xml.JID
+	for _, addr := range certificateXMPPAddrs(cert) {
+		if j, err := xml.NewJIDString(addr, false); err == nil {
+			jids = append(jids, j)
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if j, err := xml.NewJIDString(email, false); err == nil {
+			jids = append(jids, j)
+		}
+	}
+	if cn := cert.Subject.CommonName; len(cn) > 0 {
+		if j, err := xml.NewJIDString(cn, false); err == nil {
+			jids = append(jids, j)
+		}
+	}
+	return jids
+}
+
+// certificateMatchesDomain returns whether or not a server certificate
+// identifies domain either by an XmppAddr or a DNS subject alternative name.
+func certificateMatchesDomain(cert *x509.Certificate, domain string) bool {
+	for _, addr := range certificateXMPPAddrs(cert) {
+		if addr == domain {
+			return true
+		}
+	}
+	return cert.VerifyHostname(domain) == nil
+}
+
+func certificateXMPPAddrs(cert *x509.Certificate) []string {
+	var addrs []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &seq); err != nil {
+			return nil
+		}
+		rest := seq.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return addrs
+			}
+			// otherName [0]
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var otherName struct {
+				TypeID asn1.ObjectIdentifier
+				Value  asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &otherName, "tag:0"); err != nil {
+				continue
+			}
+			if !otherName.TypeID.Equal(oidXMPPAddr) {
+				continue
+			}
+			var addr string
+			if _, err := asn1.UnmarshalWithParams(otherName.Value.Bytes, &addr, "utf8"); err != nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateJIDs(t *testing.T) {
+	cert := newTestClientCertificate(t, "romeo@jackal.im", []string{"ortuman@jackal.im"}, []string{"noelia@jackal.im"})
+	assert.Equal(t, certificateXMPPAddrs(cert), []string{"ortuman@jackal.im"})
+	assert.Equal(t, jidStrings(certificateJIDs(cert)), []string{"ortuman@jackal.im", "noelia@jackal.im", "romeo@jackal.im"})
+
+	// common name fallback
+	cert = newTestClientCertificate(t, "romeo@jackal.im", nil, nil)
+	assert.Equal(t, len(certificateXMPPAddrs(cert)), 0)
+	assert.Equal(t, jidStrings(certificateJIDs(cert)), []string{"romeo@jackal.im"})
+}
+
+func TestExternalAuthentication(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	s.InsertOrUpdateUser(&storage.User{Username: "ortuman"})
+	s.InsertOrUpdateUser(&storage.User{Username: "noelia"})
+	storage.Set(s)
+
+	cert := newTestClientCertificate(t, "", []string{"ortuman@jackal.im"}, []string{"noelia@jackal.im"})
+
+	// no authorization identity
+	authr := newTestExternalAuthenticator(cert, "jackal.im")
+	assert.Nil(t, authr.ProcessElement(externalAuthElement("")))
+	assert.True(t, authr.Authenticated())
+	assert.Equal(t, authr.Username(), "ortuman")
+
+	// authorization identity matching e-mail address
+	authr = newTestExternalAuthenticator(cert, "jackal.im")
+	assert.Nil(t, authr.ProcessElement(externalAuthElement("noelia@jackal.im")))
+	assert.Equal(t, authr.Username(), "noelia")
+
+	// authorization identity not present in certificate
+	authr = newTestExternalAuthenticator(cert, "jackal.im")
+	assert.Equal(t, authr.ProcessElement(externalAuthElement("romeo@jackal.im")), errSASLNotAuthorized)
+	assert.False(t, authr.Authenticated())
+
+	// certificate issued for another domain
+	authr = newTestExternalAuthenticator(cert, "jackal.net")
+	assert.Equal(t, authr.ProcessElement(externalAuthElement("")), errSASLNotAuthorized)
+
+	// no client certificate
+	authr = newTestExternalAuthenticator(nil, "jackal.im")
+	assert.Equal(t, authr.ProcessElement(externalAuthElement("")), errSASLNotAuthorized)
+}
+
+// certTransport is a transport presenting a fixed set of client certificates.
+type certTransport struct {
+	transport.Transport
+	certs []*x509.Certificate
+}
+
+func (t *certTransport) PeerCertificates() []*x509.Certificate {
+	return t.certs
+}
+
+func newTestExternalAuthenticator(cert *x509.Certificate, domain string) authenticator {
+	tr := &certTransport{}
+	if cert != nil {
+		tr.certs = []*x509.Certificate{cert}
+	}
+	strm := &serverStream{tr: tr, domain: domain, writeCh: make(chan xml.Element, 1)}
+	return newExternalAuthenticator(strm)
+}
+
+func externalAuthElement(authzID string) xml.Element {
+	auth := xml.NewElementNamespace("auth", saslNamespace)
+	auth.SetAttribute("mechanism", "EXTERNAL")
+	if len(authzID) > 0 {
+		auth.SetText(base64.StdEncoding.EncodeToString([]byte(authzID)))
+	} else {
+		auth.SetText("=")
+	}
+	return auth
+}
+
+// newTestClientCertificate generates a self-signed certificate carrying
+// the given XmppAddr and e-mail subject alternative names.
+func newTestClientCertificate(t *testing.T, commonName string, xmppAddrs, emails []string) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(xmppAddrs) > 0 || len(emails) > 0 {
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: marshalTestSubjectAltName(t, xmppAddrs, emails)}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert
+}
+
+func marshalTestSubjectAltName(t *testing.T, xmppAddrs, emails []string) []byte {
+	var names []byte
+	for _, addr := range xmppAddrs {
+		value, err := asn1.MarshalWithParams(addr, "utf8")
+		assert.Nil(t, err)
+		otherName, err := asn1.Marshal(struct {
+			TypeID asn1.ObjectIdentifier
+			Value  asn1.RawValue
+		}{
+			TypeID: oidXMPPAddr,
+			Value:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+		})
+		assert.Nil(t, err)
+		otherName[0] = 0xa0 // otherName [0] IMPLICIT SEQUENCE
+		names = append(names, otherName...)
+	}
+	for _, email := range emails {
+		rfc822Name, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)})
+		assert.Nil(t, err)
+		names = append(names, rfc822Name...)
+	}
+	san, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: names})
+	assert.Nil(t, err)
+	return san
+}
+
+func jidStrings(jids []*xml.JID) []string {
+	var strs []string
+	for _, j := range jids {
+		strs = append(strs, j.String())
+	}
+	return strs
+}
@@ -62,9 +62,12 @@ func (p *plainAuthenticator) ProcessElement(elem xml.Element) error {
 	if err != nil {
 		return err
 	}
-	if user == nil || user.Password != password {
+	if user == nil || !user.VerifyPassword(password) {
 		return errSASLNotAuthorized
 	}
+	if user.HasPlaintextPassword() {
+		upgradeUserCredentials(user, password)
+	}
 	p.username = username
 	p.authenticated = true
 
@@ -10,6 +10,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"hash"
@@ -21,11 +22,8 @@ import (
 	"github.com/ortuman/jackal/util"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
-	"golang.org/x/crypto/pbkdf2"
 )
 
-const iterationsCount = 4096
-
 type scramType int
 
 const (
@@ -78,11 +76,10 @@ type scramAuthenticator struct {
 	tp            scramType
 	usesCb        bool
 	h             func() hash.Hash
-	hKeyLen       int
 	state         scramState
 	params        *scramParameters
 	user          *storage.User
-	salt          []byte
+	creds         *storage.ScramCredentials
 	srvNonce      string
 	firstMessage  string
 	authenticated bool
@@ -98,10 +95,8 @@ func newScram(strm *serverStream, tr transport.Transport, scramType scramType, u
 	}
 	if s.tp == sha1ScramType {
 		s.h = sha1.New
-		s.hKeyLen = sha1.Size
 	} else {
 		s.h = sha256.New
-		s.hKeyLen = sha256.Size
 	}
 	return s
 }
@@ -161,7 +156,7 @@ func (s *scramAuthenticator) Reset() {
 	s.state = startScramState
 	s.params = nil
 	s.user = nil
-	s.salt = nil
+	s.creds = nil
 	s.srvNonce = ""
 	s.firstMessage = ""
 }
@@ -187,12 +182,16 @@ func (s *scramAuthenticator) handleStart(elem xml.Element) error {
 	if user == nil {
 		return errSASLNotAuthorized
 	}
+	creds := s.userCredentials(user)
+	if creds == nil {
+		return errSASLNotAuthorized
+	}
 	s.user = user
+	s.creds = creds
 
 	s.srvNonce = cNonce + "-" + uuid.New()
-	s.salt = util.RandomBytes(32)
-	sb64 := base64.StdEncoding.EncodeToString(s.salt)
-	s.firstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.srvNonce, sb64, iterationsCount)
+	sb64 := base64.StdEncoding.EncodeToString(creds.Salt)
+	s.firstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.srvNonce, sb64, creds.Iterations)
 
 	respElem := xml.NewElementNamespace("challenge", saslNamespace)
 	respElem.SetText(base64.StdEncoding.EncodeToString([]byte(s.firstMessage)))
@@ -211,33 +210,56 @@ func (s *scramAuthenticator) handleChallenged(elem xml.Element) error {
 	initialMessage := s.params.String()
 	clientFinalMessageBare := fmt.Sprintf("c=%s,r=%s", c, s.srvNonce)
 
-	saltedPassword := s.pbkdf2([]byte(s.user.Password))
-	clientKey := s.hmac([]byte("Client Key"), saltedPassword)
-	storedKey := s.hash(clientKey)
+	proofPrefix := clientFinalMessageBare + ",p="
+	if !strings.HasPrefix(p, proofPrefix) {
+		return errSASLNotAuthorized
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(p[len(proofPrefix):])
+	if err != nil {
+		return errSASLIncorrectEncoding
+	}
 	authMessage := initialMessage + "," + s.firstMessage + "," + clientFinalMessageBare
-	clientSignature := s.hmac([]byte(authMessage), storedKey)
-
-	clientProof := make([]byte, len(clientKey))
-	for i := 0; i < len(clientKey); i++ {
-		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	clientSignature := s.hmac([]byte(authMessage), s.creds.StoredKey)
+	if len(clientProof) != len(clientSignature) {
+		return errSASLNotAuthorized
 	}
-	serverKey := s.hmac([]byte("Server Key"), saltedPassword)
-	serverSignature := s.hmac([]byte(authMessage), serverKey)
-
-	clientFinalMessage := clientFinalMessageBare + ",p=" + base64.StdEncoding.EncodeToString(clientProof)
-	if clientFinalMessage != p {
+	// recover client key from proof and check it against stored key
+	clientKey := make([]byte, len(clientProof))
+	for i := 0; i < len(clientProof); i++ {
+		clientKey[i] = clientProof[i] ^ clientSignature[i]
+	}
+	if subtle.ConstantTimeCompare(s.hash(clientKey), s.creds.StoredKey) != 1 {
 		return errSASLNotAuthorized
 	}
+	serverSignature := s.hmac([]byte(authMessage), s.creds.ServerKey)
 	v := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
 
 	respElem := xml.NewElementNamespace("success", saslNamespace)
 	respElem.SetText(base64.StdEncoding.EncodeToString([]byte(v)))
 	s.strm.SendElement(respElem)
 
+	if s.user.HasPlaintextPassword() {
+		upgradeUserCredentials(s.user, s.user.Password)
+	}
 	s.authenticated = true
 	return nil
 }
 
+func (s *scramAuthenticator) userCredentials(user *storage.User) *storage.ScramCredentials {
+	var creds *storage.ScramCredentials
+	switch s.tp {
+	case sha1ScramType:
+		creds = user.ScramSHA1
+	case sha256ScramType:
+		creds = user.ScramSHA256
+	}
+	if creds == nil && user.HasPlaintextPassword() {
+		// legacy plaintext password
+		creds = storage.NewScramCredentials(s.h, user.Password, util.RandomBytes(32), storage.ScramIterations)
+	}
+	return creds
+}
+
 func (s *scramAuthenticator) getElementPayload(elem xml.Element) (string, error) {
 	if elem.TextLen() == 0 {
 		return "", errSASLIncorrectEncoding
@@ -304,10 +326,6 @@ func (s *scramAuthenticator) getCBindInputString() string {
 	return base64.StdEncoding.EncodeToString(buf.Bytes())
 }
 
-func (s *scramAuthenticator) pbkdf2(b []byte) []byte {
-	return pbkdf2.Key(b, s.salt, iterationsCount, s.hKeyLen, s.h)
-}
-
 func (s *scramAuthenticator) hmac(b []byte, key []byte) []byte {
 	m := hmac.New(s.h, key)
 	m.Write(b)
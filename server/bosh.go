@@ -0,0 +1,389 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	boshNamespace  = "http://jabber.org/protocol/httpbind"
+	xboshNamespace = "urn:xmpp:xbosh"
+)
+
+const boshVersion = "1.6"
+
+const boshMaxRequestSize = 1024 * 1024
+
+var errBOSHSessionClosed = errors.New("bosh: session closed")
+
+var errBOSHClientTLS = errors.New("bosh: TLS negotiation not supported")
+
+// boshHandler is the BOSH connection manager (XEP-0124),
+// binding HTTP requests to their corresponding XMPP session (XEP-0206).
+type boshHandler struct {
+	srv      *server
+	lock     sync.RWMutex
+	sessions map[string]*boshSession
+}
+
+func newBOSHHandler(srv *server) *boshHandler {
+	return &boshHandler{
+		srv:      srv,
+		sessions: make(map[string]*boshSession),
+	}
+}
+
+func (h *boshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); len(origin) > 0 {
+		if !h.srv.checkOrigin(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		break
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := xml.NewParser(io.LimitReader(r.Body, boshMaxRequestSize)).ParseElement()
+	if err != nil || body.Name() != "body" || body.Namespace() != boshNamespace {
+		h.writeBody(w, terminateBody("bad-request"))
+		return
+	}
+	rid, err := strconv.ParseInt(body.Attribute("rid"), 10, 64)
+	if err != nil || rid <= 0 {
+		h.writeBody(w, terminateBody("bad-request"))
+		return
+	}
+	var sess *boshSession
+	if sid := body.Attribute("sid"); len(sid) > 0 {
+		if sess = h.session(sid); sess == nil {
+			h.writeBody(w, terminateBody("item-not-found"))
+			return
+		}
+	} else {
+		sess = h.createSession(body, rid, r)
+	}
+	h.writeBody(w, sess.handleRequest(rid, body))
+}
+
+func (h *boshHandler) writeBody(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(b)
+}
+
+func (h *boshHandler) createSession(body xml.Element, rid int64, r *http.Request) *boshSession {
+	cfg := h.srv.cfg.BOSH
+
+	sess := &boshSession{
+		h:          h,
+		sid:        uuid.New(),
+		domain:     body.To(),
+		wait:       cfg.Wait,
+		hold:       cfg.Hold,
+		inactivity: time.Second * time.Duration(cfg.Inactivity),
+		lastRID:    rid - 1,
+		responses:  make(map[int64][]byte),
+	}
+	if len(sess.domain) == 0 {
+		sess.domain = stream.C2S().DefaultDomain()
+	}
+	// negotiate client requested values
+	if wait, err := strconv.Atoi(body.Attribute("wait")); err == nil && wait >= 0 && wait < sess.wait {
+		sess.wait = wait
+	}
+	if hold, err := strconv.Atoi(body.Attribute("hold")); err == nil && hold >= 0 && hold < sess.hold {
+		sess.hold = hold
+	}
+	if r.TLS != nil {
+		sess.secured = true
+		sess.peerCerts = r.TLS.PeerCertificates
+	}
+	sess.cond = sync.NewCond(&sess.lock)
+	sess.inactivityTm = time.AfterFunc(sess.inactivity, sess.expire)
+	sess.inactivityTm.Stop()
+
+	h.lock.Lock()
+	h.sessions[sess.sid] = sess
+	h.lock.Unlock()
+
+	strm := newBOSHStream(h.srv.nextStreamID(), sess, h.srv.cfg)
+	stream.C2S().RegisterStream(strm)
+
+	log.Infof("bosh: created session... (sid: %s)", sess.sid)
+	return sess
+}
+
+func (h *boshHandler) session(sid string) *boshSession {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.sessions[sid]
+}
+
+func (h *boshHandler) unregisterSession(sess *boshSession) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.sessions[sess.sid]; ok {
+		delete(h.sessions, sess.sid)
+		log.Infof("bosh: terminated session... (sid: %s)", sess.sid)
+	}
+}
+
+// boshSession is the transport of a BOSH bound stream.
+// Request payloads are fed into the stream parser, while elements written
+// by the stream are delivered as the payload of pending requests.
+type boshSession struct {
+	h          *boshHandler
+	sid        string
+	domain     string
+	wait       int
+	hold       int
+	inactivity time.Duration
+	secured    bool
+	peerCerts  []*x509.Certificate
+
+	lock         sync.Mutex
+	cond         *sync.Cond
+	lastRID      int64
+	held         int
+	input        []byte
+	output       []byte
+	streamErr    bool
+	responses    map[int64][]byte
+	terminated   bool
+	closed       bool
+	inactivityTm *time.Timer
+}
+
+func (s *boshSession) Type() config.TransportType {
+	return config.BOSH
+}
+
+func (s *boshSession) Read(p []byte) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.input) == 0 {
+		if s.terminated || s.closed {
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+	n = copy(p, s.input)
+	s.input = s.input[n:]
+	return n, nil
+}
+
+func (s *boshSession) Write(p []byte) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, errBOSHSessionClosed
+	}
+	if bytes.HasPrefix(p, []byte("<stream:error")) {
+		s.streamErr = true
+	}
+	s.output = append(s.output, p...)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+func (s *boshSession) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *boshSession) StartTLS(cfg *tls.Config) {
+}
+
+func (s *boshSession) StartClientTLS(cfg *tls.Config) error {
+	return errBOSHClientTLS
+}
+
+func (s *boshSession) EnableCompression(level config.CompressionLevel) {
+}
+
+func (s *boshSession) ChannelBindingBytes(mechanism config.ChannelBindingMechanism) []byte {
+	// a session spans multiple HTTP connections
+	return nil
+}
+
+func (s *boshSession) PeerCertificates() []*x509.Certificate {
+	return s.peerCerts
+}
+
+func (s *boshSession) handleRequest(rid int64, body xml.Element) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.inactivityTm.Stop()
+	s.held++
+	defer func() {
+		if s.held--; s.held == 0 {
+			s.inactivityTm.Reset(s.inactivity)
+		}
+	}()
+
+	// retransmitted request
+	if rid <= s.lastRID {
+		if resp, ok := s.responses[rid]; ok {
+			return resp
+		}
+		return terminateBody("item-not-found")
+	}
+	if rid > s.lastRID+int64(s.hold)+1 {
+		s.terminate()
+		return terminateBody("item-not-found")
+	}
+	expired := false
+	tm := time.AfterFunc(time.Second*time.Duration(s.wait), func() {
+		s.lock.Lock()
+		expired = true
+		s.cond.Broadcast()
+		s.lock.Unlock()
+	})
+	defer tm.Stop()
+
+	// process requests in order
+	for rid != s.lastRID+1 && !s.closed && !expired {
+		s.cond.Wait()
+	}
+	if rid != s.lastRID+1 && !s.closed {
+		s.terminate()
+		return terminateBody("item-not-found")
+	}
+	isCreation := len(body.Attribute("sid")) == 0
+	if !s.closed {
+		s.lastRID = rid
+		if isCreation || body.Attribute("xmpp:restart") == "true" {
+			s.openStream()
+		}
+		buf := &bytes.Buffer{}
+		for _, e := range body.Elements() {
+			e.ToXML(buf, true)
+		}
+		s.input = append(s.input, buf.Bytes()...)
+		if body.Type() == "terminate" {
+			s.terminated = true
+		}
+		s.cond.Broadcast()
+	}
+	// wait for payloads to deliver
+	for len(s.output) == 0 && !s.closed && !expired && s.lastRID-rid < int64(s.hold) {
+		s.cond.Wait()
+	}
+	var resp []byte
+	switch {
+	case s.closed:
+		if s.streamErr {
+			resp = s.responseBody(isCreation, "terminate", "remote-stream-error")
+		} else {
+			resp = s.responseBody(isCreation, "terminate", "")
+		}
+		s.h.unregisterSession(s)
+	default:
+		resp = s.responseBody(isCreation, "", "")
+	}
+	s.output = nil
+
+	s.responses[rid] = resp
+	delete(s.responses, rid-int64(s.hold)-1)
+	return resp
+}
+
+// openStream feeds the stream parser with a stream opening element,
+// either on session creation or after a stream restart request.
+func (s *boshSession) openStream() {
+	ops := xml.NewElementName("stream:stream")
+	ops.SetAttribute("xmlns", jabberClientNamespace)
+	ops.SetAttribute("xmlns:stream", streamNamespace)
+	ops.SetAttribute("to", s.domain)
+	ops.SetAttribute("version", "1.0")
+
+	buf := &bytes.Buffer{}
+	ops.ToXML(buf, false)
+	s.input = append(s.input, buf.Bytes()...)
+}
+
+func (s *boshSession) responseBody(isCreation bool, typ, condition string) []byte {
+	body := xml.NewElementNamespace("body", boshNamespace)
+	if isCreation {
+		body.SetAttribute("xmlns:xmpp", xboshNamespace)
+		body.SetAttribute("xmlns:stream", streamNamespace)
+		body.SetAttribute("sid", s.sid)
+		body.SetAttribute("from", s.domain)
+		body.SetAttribute("wait", strconv.Itoa(s.wait))
+		body.SetAttribute("hold", strconv.Itoa(s.hold))
+		body.SetAttribute("requests", strconv.Itoa(s.hold+1))
+		body.SetAttribute("inactivity", strconv.Itoa(int(s.inactivity/time.Second)))
+		body.SetAttribute("ver", boshVersion)
+		body.SetAttribute("xmpp:version", "1.0")
+		body.SetAttribute("xmpp:restartlogic", "true")
+		if s.secured {
+			body.SetAttribute("secure", "true")
+		}
+	}
+	body.SetAttribute("type", typ)
+	body.SetAttribute("condition", condition)
+
+	buf := &bytes.Buffer{}
+	body.ToXML(buf, false)
+	buf.Write(s.output)
+	buf.WriteString("</body>")
+	return buf.Bytes()
+}
+
+// terminate stops feeding the stream, which will be disconnected
+// as soon as it processes all pending input.
+func (s *boshSession) terminate() {
+	s.terminated = true
+	s.cond.Broadcast()
+	s.h.unregisterSession(s)
+}
+
+func (s *boshSession) expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.held > 0 {
+		return
+	}
+	log.Infof("bosh: session inactivity timeout... (sid: %s)", s.sid)
+	s.terminate()
+}
+
+func terminateBody(condition string) []byte {
+	body := xml.NewElementNamespace("body", boshNamespace)
+	body.SetAttribute("type", "terminate")
+	body.SetAttribute("condition", condition)
+
+	buf := &bytes.Buffer{}
+	body.ToXML(buf, true)
+	return buf.Bytes()
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBOSHRequestOrdering(t *testing.T) {
+	sess := newTestBOSHSession(1, 2)
+
+	resp1 := make(chan []byte, 1)
+	resp2 := make(chan []byte, 1)
+	go func() {
+		resp2 <- sess.handleRequest(2, testBOSHBody(sess.sid, "", testBOSHMessage("second")))
+	}()
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, len(sessionInput(sess)), 0) // must wait for rid 1
+
+	go func() {
+		resp1 <- sess.handleRequest(1, testBOSHBody("", "", testBOSHMessage("1 < 2")))
+	}()
+	// rid 1 is released as soon as rid 2 gets held (hold = 1)
+	r1 := <-resp1
+	assert.True(t, bytes.Contains(r1, []byte(`sid="`+sess.sid+`"`)))
+
+	input := sessionInput(sess)
+	first := bytes.Index(input, []byte("<body>1 &lt; 2</body>"))
+	second := bytes.Index(input, []byte("<body>second</body>"))
+	assert.True(t, bytes.HasPrefix(input, []byte("<stream:stream")))
+	assert.True(t, first > 0)
+	assert.True(t, second > first)
+
+	sess.Write([]byte(`<message from="a@jackal.im"/>`))
+	r2 := <-resp2
+	assert.True(t, bytes.Contains(r2, []byte(`<message from="a@jackal.im"/>`)))
+
+	// retransmitted request
+	assert.Equal(t, sess.handleRequest(2, testBOSHBody(sess.sid, "")), r2)
+
+	// request out of window
+	r5 := sess.handleRequest(5, testBOSHBody(sess.sid, ""))
+	assert.True(t, bytes.Contains(r5, []byte(`condition="item-not-found"`)))
+	assert.Nil(t, sess.h.session(sess.sid))
+}
+
+func TestBOSHTerminate(t *testing.T) {
+	sess := newTestBOSHSession(1, 5)
+	sess.lastRID = 1
+
+	resp := make(chan []byte, 1)
+	go func() {
+		resp <- sess.handleRequest(2, testBOSHBody(sess.sid, "terminate", testBOSHMessage("bye")))
+	}()
+	// stream reads pending input up to the end of the session
+	b, err := ioutil.ReadAll(sess)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(b, []byte("<body>bye</body>")))
+
+	sess.Close()
+	r := <-resp
+	assert.True(t, bytes.Contains(r, []byte(`type="terminate"`)))
+	assert.Nil(t, sess.h.session(sess.sid))
+
+	n, err := sess.Read(make([]byte, 1))
+	assert.Equal(t, n, 0)
+	assert.Equal(t, err, io.EOF)
+}
+
+func newTestBOSHSession(hold, wait int) *boshSession {
+	h := &boshHandler{sessions: make(map[string]*boshSession)}
+	sess := &boshSession{
+		h:          h,
+		sid:        "c7a6a6e1",
+		domain:     "jackal.im",
+		wait:       wait,
+		hold:       hold,
+		inactivity: time.Minute,
+		responses:  make(map[int64][]byte),
+	}
+	sess.cond = sync.NewCond(&sess.lock)
+	sess.inactivityTm = time.AfterFunc(sess.inactivity, sess.expire)
+	sess.inactivityTm.Stop()
+	h.sessions[sess.sid] = sess
+	return sess
+}
+
+func testBOSHBody(sid, typ string, elements ...xml.Element) xml.Element {
+	body := xml.NewElementNamespace("body", boshNamespace)
+	body.SetAttribute("sid", sid)
+	body.SetType(typ)
+	body.AppendElements(elements)
+	return body
+}
+
+func testBOSHMessage(text string) xml.Element {
+	b := xml.NewElementName("body")
+	b.SetText(text)
+	m := xml.NewElementName("message")
+	m.AppendElement(b)
+	return m
+}
+
+func sessionInput(sess *boshSession) []byte {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return append([]byte(nil), sess.input...)
+}
@@ -0,0 +1,376 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const jabberComponentAcceptNamespace = "jabber:component:accept"
+
+var (
+	errComponentRemoteRouting = errors.New("component: routing to remote domains is not supported")
+	errComponentNotConnected  = errors.New("component: component not connected")
+)
+
+// componentStream is an incoming external component stream (XEP-0114).
+type componentStream struct {
+	cfg       *config.Server
+	id        string
+	connected uint32
+	tr        transport.Transport
+	parser    *xml.Parser
+	state     streamState
+	streamID  string
+	domain    string
+	secret    string
+
+	closeMu sync.RWMutex // guards 'closed'
+	closed  bool
+
+	writeCh chan xml.Element
+	readCh  chan xml.Element
+	discCh  chan error
+	doneCh  chan struct{}
+}
+
+func newComponentStream(id string, conn net.Conn, cfg *config.Server) *componentStream {
+	s := &componentStream{
+		cfg:     cfg,
+		id:      id,
+		state:   connecting,
+		writeCh: make(chan xml.Element, 256),
+		readCh:  make(chan xml.Element),
+		discCh:  make(chan error),
+		doneCh:  make(chan struct{}),
+	}
+	s.tr = transport.NewSocketTransport(conn, cfg.Transport.BufferSize, cfg.Transport.KeepAlive)
+	s.parser = newStreamParser(s.tr, s.cfg)
+
+	if cfg.Transport.ConnectTimeout > 0 {
+		s.startConnectTimeoutTimer(cfg.Transport.ConnectTimeout)
+	}
+	go s.loop()
+	return s
+}
+
+func (s *componentStream) ID() string {
+	return s.id
+}
+
+func (s *componentStream) Domain() string {
+	return s.domain
+}
+
+func (s *componentStream) SendElement(element xml.Element) bool {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.writeCh <- element:
+		return true
+	case <-s.doneCh:
+		return false
+	}
+}
+
+func (s *componentStream) Disconnect(err error) {
+	select {
+	case s.discCh <- err:
+	case <-s.doneCh:
+	}
+}
+
+func (s *componentStream) startConnectTimeoutTimer(timeoutInSeconds int) {
+	go func() {
+		tr := time.NewTimer(time.Second * time.Duration(timeoutInSeconds))
+		<-tr.C
+		if atomic.LoadUint32(&s.connected) == 0 {
+			// connection timeout...
+			select {
+			case s.discCh <- streamerror.ErrConnectionTimeout:
+			case <-s.doneCh:
+			}
+		}
+	}()
+}
+
+func (s *componentStream) handleElement(elem xml.Element) {
+	switch s.state {
+	case connecting:
+		s.handleConnecting(elem)
+	case authenticating:
+		s.handleAuthenticating(elem)
+	case authenticated:
+		s.handleAuthenticated(elem)
+	}
+}
+
+func (s *componentStream) handleConnecting(elem xml.Element) {
+	// activate 'connected' flag
+	atomic.StoreUint32(&s.connected, 1)
+
+	if elem.Name() != "stream:stream" {
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+		return
+	}
+	if elem.Namespace() != jabberComponentAcceptNamespace || elem.Attribute("xmlns:stream") != streamNamespace {
+		s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+		return
+	}
+	for _, c := range s.cfg.Components {
+		if c.Domain == elem.To() {
+			s.domain = c.Domain
+			s.secret = c.Secret
+			break
+		}
+	}
+	if len(s.domain) == 0 {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+	s.openStreamElement()
+	s.state = authenticating
+}
+
+func (s *componentStream) handleAuthenticating(elem xml.Element) {
+	if elem.Name() != "handshake" {
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	h := sha1.Sum([]byte(s.streamID + s.secret))
+	digest := hex.EncodeToString(h[:])
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(elem.Text())), []byte(digest)) != 1 {
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	if err := stream.Components().RegisterComponent(s); err != nil {
+		s.disconnectWithStreamError(streamerror.ErrConflict)
+		return
+	}
+	s.writeElement(xml.NewElementName("handshake"))
+	s.state = authenticated
+}
+
+func (s *componentStream) handleAuthenticated(elem xml.Element) {
+	switch elem.Name() {
+	case "iq", "presence", "message":
+		break
+	default:
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+		return
+	}
+	fromJID, err := xml.NewJIDString(elem.From(), false)
+	if err != nil || fromJID.Domain() != s.domain {
+		s.disconnectWithStreamError(streamerror.ErrInvalidFrom)
+		return
+	}
+	toJID, err := xml.NewJIDString(elem.To(), false)
+	if err != nil {
+		s.writeElement(xml.ToErrorElement(elem, xml.ErrJidMalformed.(*xml.StanzaError)))
+		return
+	}
+
+	var stanza xml.Element
+	switch elem.Name() {
+	case "iq":
+		stanza, err = xml.NewIQFromElement(elem, fromJID, toJID)
+	case "presence":
+		stanza, err = xml.NewPresenceFromElement(elem, fromJID, toJID)
+	case "message":
+		stanza, err = xml.NewMessageFromElement(elem, fromJID, toJID)
+	}
+	if err != nil {
+		log.Error(err)
+		s.writeElement(xml.ToErrorElement(elem, xml.ErrBadRequest.(*xml.StanzaError)))
+		return
+	}
+	s.routeStanza(stanza, toJID)
+}
+
+func (s *componentStream) routeStanza(stanza xml.Element, to *xml.JID) {
+	var err error
+	var carbons bool
+	switch {
+	case stream.C2S().IsLocalDomain(to.Domain()):
+		if len(to.Node()) == 0 {
+			err = errResourceNotFound
+			break
+		}
+		if message, ok := stanza.(*xml.Message); ok {
+			carbons = module.IsCarbonsEligible(message)
+			if cfg := localMAMConfig(to.Domain()); cfg != nil {
+				module.ArchiveIncomingMessage(cfg, message)
+			}
+		}
+		err = deliverLocal(stanza, to, carbons)
+	case stream.Components().IsComponentDomain(to.Domain()):
+		comp := stream.Components().Component(to.Domain())
+		if comp == nil || !comp.SendElement(stanza) {
+			err = errComponentNotConnected
+		}
+	default:
+		err = errComponentRemoteRouting
+	}
+	if err == nil || !expectsErrorReply(stanza) {
+		return
+	}
+	from := stanza.From()
+	resp := xml.ToErrorElement(stanza, xml.ErrServiceUnavailable.(*xml.StanzaError))
+	resp.SetFrom(to.String())
+	resp.SetTo(from)
+	s.writeElement(resp)
+}
+
+func (s *componentStream) loop() {
+	s.doRead() // start reading transport...
+	for {
+		// stop looping after disconnecting stream
+		if s.state == disconnected {
+			s.shutdown()
+			return
+		}
+		select {
+		case e := <-s.writeCh:
+			s.writeElement(e)
+
+		case e := <-s.readCh:
+			s.handleElement(e)
+			if s.state != disconnected {
+				s.doRead() // keep reading transport...
+			}
+
+		case err := <-s.discCh:
+			switch err {
+			case nil:
+				s.disconnect(false)
+			default:
+				if strmErr, ok := err.(*streamerror.Error); ok {
+					s.disconnectWithStreamError(strmErr)
+				} else {
+					log.Error(err)
+					s.disconnect(false)
+				}
+			}
+		}
+	}
+}
+
+func (s *componentStream) doRead() {
+	go func() {
+		if e, err := s.parser.ParseElement(); e != nil && err == nil {
+			log.Debugf("RECV: %v", e)
+			s.readCh <- e
+
+		} else if err != nil {
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+				s.discCh <- nil
+			default:
+				log.Error(err)
+				if _, ok := err.(*xml.LimitError); ok {
+					s.discCh <- streamerror.ErrPolicyViolation
+				} else {
+					s.discCh <- streamerror.ErrInvalidXML
+				}
+			}
+		}
+	}()
+}
+
+func (s *componentStream) openStreamElement() {
+	s.streamID = uuid.New()
+
+	ops := xml.NewElementName("stream:stream")
+	ops.SetAttribute("xmlns", jabberComponentAcceptNamespace)
+	ops.SetAttribute("xmlns:stream", streamNamespace)
+	ops.SetAttribute("id", s.streamID)
+	if len(s.domain) > 0 {
+		ops.SetAttribute("from", s.domain)
+	}
+	s.tr.Write([]byte(`<?xml version="1.0"?>`))
+	ops.ToXML(s.tr, false)
+}
+
+func (s *componentStream) writeElement(elem xml.Element) {
+	log.Debugf("SEND: %v", elem)
+	elem.ToXML(s.tr, true)
+}
+
+func (s *componentStream) disconnectWithStreamError(err *streamerror.Error) {
+	if s.state == connecting {
+		s.openStreamElement()
+	}
+	s.writeElement(err.Element())
+	s.disconnect(true)
+}
+
+func (s *componentStream) disconnect(closeStream bool) {
+	if closeStream {
+		s.tr.Write([]byte("</stream:stream>"))
+	}
+	s.tr.Close()
+
+	if s.state == authenticated {
+		stream.Components().UnregisterComponent(s)
+	}
+	s.state = disconnected
+}
+
+// shutdown releases a disconnected stream, bouncing
+// those stanzas that were still waiting to be sent.
+func (s *componentStream) shutdown() {
+	close(s.doneCh)
+
+	// wait for in-flight senders... no element gets queued from now on
+	s.closeMu.Lock()
+	s.closed = true
+	s.closeMu.Unlock()
+
+	stanzaErr := xml.ErrServiceUnavailable.(*xml.StanzaError)
+	for {
+		select {
+		case e := <-s.writeCh:
+			if expectsErrorReply(e) {
+				bounceElement(e, stanzaErr)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// expectsErrorReply returns whether or not an undeliverable
+// stanza must be replied back to its sender with an error.
+func expectsErrorReply(stanza xml.Element) bool {
+	if _, isPresence := stanza.(*xml.Presence); isPresence || stanza.Type() == "error" {
+		return false
+	}
+	if iq, ok := stanza.(*xml.IQ); ok && !iq.IsGet() && !iq.IsSet() {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComponentHandshake(t *testing.T) {
+	defer setupTestComponents()()
+
+	_, c := newTestComponentStream(t)
+	c.send(componentStreamHeader("unknown.jackal.im"))
+	c.receive()
+	assert.NotNil(t, c.receive().FindElement("host-unknown"))
+	assert.True(t, c.isClosed())
+
+	_, c = newTestComponentStream(t)
+	c.send(componentStreamHeader("upload.jackal.im"))
+	c.receive()
+	c.send(`<handshake>0123456789abcdef</handshake>`)
+	assert.NotNil(t, c.receive().FindElement("not-authorized"))
+	assert.True(t, c.isClosed())
+	assert.Nil(t, stream.Components().Component("upload.jackal.im"))
+
+	s, c := newTestComponentStream(t)
+	c.handshake("upload.jackal.im", "s3cr3t")
+	assert.Equal(t, stream.Components().Component("upload.jackal.im"), stream.ComponentStream(s))
+
+	// only one stream per component domain
+	_, c2 := newTestComponentStream(t)
+	c2.send(componentStreamHeader("upload.jackal.im"))
+	header := c2.receive()
+	c2.sendElement(handshakeElement(header.ID(), "s3cr3t"))
+	assert.NotNil(t, c2.receive().FindElement("conflict"))
+	assert.True(t, c2.isClosed())
+
+	c.close()
+	assert.Nil(t, stream.Components().Component("upload.jackal.im"))
+}
+
+func TestComponentRouting(t *testing.T) {
+	defer setupTestComponents("ortuman")()
+
+	_, cli := newTestStream(t, newTestStreamConfig())
+	cli.bind("ortuman", "balcony")
+
+	s, comp := newTestComponentStream(t)
+	comp.handshake("upload.jackal.im", "s3cr3t")
+
+	cli.send(`<message type="chat" id="m1" to="upload.jackal.im"><body>hi</body></message>`)
+	msg := comp.receive()
+	assert.Equal(t, msg.ID(), "m1")
+	assert.Equal(t, msg.From(), "ortuman@jackal.im/balcony")
+
+	comp.send(`<message type="chat" id="m2" from="upload.jackal.im" to="ortuman@jackal.im/balcony"><body>hi</body></message>`)
+	msg = cli.receive()
+	assert.Equal(t, msg.ID(), "m2")
+	assert.Equal(t, msg.From(), "upload.jackal.im")
+
+	// not connected components are reported as unavailable
+	comp.send(`<iq type="get" id="i1" from="upload.jackal.im" to="proxy.jackal.im"><query xmlns="http://jabber.org/protocol/disco#info"/></iq>`)
+	iq := comp.receive()
+	assert.Equal(t, iq.Type(), "error")
+	assert.NotNil(t, iq.FindElement("error").FindElement("service-unavailable"))
+
+	// spoofed sender
+	comp.send(`<message type="chat" id="m3" from="ortuman@jackal.im" to="ortuman@jackal.im/balcony"><body>hi</body></message>`)
+	assert.NotNil(t, comp.receive().FindElement("invalid-from"))
+	assert.True(t, comp.isClosed())
+
+	// disconnected stream doesn't accept any further element
+	<-s.doneCh
+	assert.False(t, s.SendElement(xml.NewElementName("message")))
+	s.Disconnect(nil) // must not block
+
+	cli.send(`<message type="chat" id="m4" to="upload.jackal.im"><body>hi</body></message>`)
+	msg = cli.receive()
+	assert.Equal(t, msg.Type(), "error")
+	assert.NotNil(t, msg.FindElement("error").FindElement("service-unavailable"))
+	cli.close()
+}
+
+// setupTestComponents configures 'upload.jackal.im' and 'proxy.jackal.im'
+// components along with test streams, returning a function that restores previous settings.
+func setupTestComponents(usernames ...string) func() {
+	restore := setupTestStreams(usernames...)
+	servers := config.DefaultConfig.Servers
+	config.DefaultConfig.Servers = []config.Server{*newTestComponentConfig()}
+
+	return func() {
+		config.DefaultConfig.Servers = servers
+		restore()
+	}
+}
+
+func newTestComponentConfig() *config.Server {
+	return &config.Server{
+		ID:   "comp",
+		Type: config.ComponentServerType,
+		Components: []config.Component{
+			{Domain: "upload.jackal.im", Secret: "s3cr3t"},
+			{Domain: "proxy.jackal.im", Secret: "s3cr3t"},
+		},
+		Transport: config.Transport{BufferSize: 4096, KeepAlive: 60},
+	}
+}
+
+func newTestComponentStream(t *testing.T) (*componentStream, *testStreamClient) {
+	srvConn, c := newTestConn(t)
+	return newComponentStream("comp:test", srvConn, newTestComponentConfig()), c
+}
+
+func (c *testStreamClient) handshake(domain, secret string) {
+	c.send(componentStreamHeader(domain))
+	header := c.receive()
+	c.sendElement(handshakeElement(header.ID(), secret))
+	if elem := c.receive(); elem.Name() != "handshake" {
+		c.t.Fatalf("component handshake failed: %v", elem)
+	}
+}
+
+func handshakeElement(streamID, secret string) xml.Element {
+	h := sha1.Sum([]byte(streamID + secret))
+	handshake := xml.NewElementName("handshake")
+	handshake.SetText(hex.EncodeToString(h[:]))
+	return handshake
+}
+
+func componentStreamHeader(domain string) string {
+	return fmt.Sprintf(`<?xml version="1.0"?><stream:stream xmlns="%s" xmlns:stream="%s" to="%s">`,
+		jabberComponentAcceptNamespace, streamNamespace, domain)
+}
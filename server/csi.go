@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+)
+
+const csiNamespace = "urn:xmpp:csi:0"
+
+const chatStatesNamespace = "http://jabber.org/protocol/chatstates"
+
+// maximum number of stanzas held back while client is inactive
+const csiMaxBuffered = 512
+
+// clientState holds the stanzas held back from an inactive
+// client (XEP-0352), keeping only the latest one per contact.
+type clientState struct {
+	inactive bool
+	keys     []string
+	buffered map[string]xml.Element
+}
+
+func (cs *clientState) hold(key string, stanza xml.Element) {
+	if cs.buffered == nil {
+		cs.buffered = make(map[string]xml.Element)
+	}
+	if _, ok := cs.buffered[key]; !ok {
+		cs.keys = append(cs.keys, key)
+	}
+	cs.buffered[key] = stanza
+}
+
+// release returns held back stanzas in arrival order, emptying the buffer.
+func (cs *clientState) release() []xml.Element {
+	stanzas := make([]xml.Element, 0, len(cs.keys))
+	for _, key := range cs.keys {
+		stanzas = append(stanzas, cs.buffered[key])
+	}
+	cs.keys = nil
+	cs.buffered = nil
+	return stanzas
+}
+
+func (cs *clientState) len() int {
+	return len(cs.keys)
+}
+
+func (s *serverStream) handleClientState(elem xml.Element) {
+	switch elem.Name() {
+	case "inactive":
+		s.csi.inactive = true
+		log.Infof("client inactive... id: %s", s.id)
+
+	case "active":
+		s.csi.inactive = false
+		s.flushClientState()
+		log.Infof("client active... id: %s", s.id)
+
+	default:
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+	}
+}
+
+// sendElement writes an element routed to the stream, holding it back
+// whenever it's not urgent and client has reported being inactive.
+func (s *serverStream) sendElement(elem xml.Element) {
+	if s.csi.inactive {
+		if key := csiBufferKey(elem); len(key) > 0 {
+			s.csi.hold(key, elem)
+			if s.csi.len() >= csiMaxBuffered {
+				s.flushClientState()
+			}
+			return
+		}
+		// an important stanza... deliver along with held back ones
+		s.flushClientState()
+	}
+	s.writeElement(elem)
+}
+
+func (s *serverStream) flushClientState() {
+	for _, stanza := range s.csi.release() {
+		s.writeElement(stanza)
+	}
+}
+
+// csiBufferKey returns the key under which a non urgent stanza
+// is collapsed, or an empty string if it should be delivered right away.
+func csiBufferKey(elem xml.Element) string {
+	switch stanza := elem.(type) {
+	case *xml.Presence:
+		if stanza.IsAvailable() || stanza.IsUnavailable() {
+			return "presence:" + stanza.From()
+		}
+	case *xml.Message:
+		if isChatStateOnly(stanza) {
+			return "chatstate:" + stanza.From()
+		}
+	}
+	return ""
+}
+
+func isChatStateOnly(message *xml.Message) bool {
+	if message.IsError() {
+		return false
+	}
+	var hasChatState bool
+	for _, elem := range message.Elements() {
+		switch {
+		case elem.Namespace() == chatStatesNamespace:
+			hasChatState = true
+		case elem.Name() == "thread":
+			break
+		default:
+			return false
+		}
+	}
+	return hasChatState
+}
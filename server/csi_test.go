@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientStateBuffering(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	to, _ := xml.NewJID("romeo", "jackal.im", "orchard", true)
+
+	p1 := xml.NewPresence(j1, to, xml.AvailableType)
+	p2 := xml.NewPresence(j2, to, xml.AvailableType)
+	p3 := xml.NewPresence(j1, to, xml.UnavailableType)
+
+	assert.Equal(t, csiBufferKey(p1), "presence:"+j1.String())
+	assert.Equal(t, csiBufferKey(xml.NewPresence(j1, to, xml.SubscribeType)), "")
+
+	cs := &clientState{}
+	cs.hold(csiBufferKey(p1), p1)
+	cs.hold(csiBufferKey(p2), p2)
+	cs.hold(csiBufferKey(p3), p3)
+	assert.Equal(t, cs.len(), 2)
+
+	stanzas := cs.release()
+	assert.Equal(t, stanzas, []xml.Element{p3, p2})
+	assert.Equal(t, cs.len(), 0)
+}
+
+func TestChatStateOnlyMessage(t *testing.T) {
+	from, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	to, _ := xml.NewJID("romeo", "jackal.im", "orchard", true)
+
+	elem := xml.NewElementName("message")
+	elem.SetType(xml.ChatType)
+	elem.AppendElement(xml.NewElementNamespace("composing", chatStatesNamespace))
+	msg, _ := xml.NewMessageFromElement(elem, from, to)
+	assert.True(t, isChatStateOnly(msg))
+	assert.Equal(t, csiBufferKey(msg), "chatstate:"+from.String())
+
+	body := xml.NewElementName("body")
+	body.SetText("hi!")
+	elem.AppendElement(body)
+	msg, _ = xml.NewMessageFromElement(elem, from, to)
+	assert.False(t, isChatStateOnly(msg))
+	assert.Equal(t, csiBufferKey(msg), "")
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	dialbackNamespace        = "jabber:server:dialback"
+	dialbackFeatureNamespace = "urn:xmpp:features:dialback"
+)
+
+const defaultS2SPort = 5269
+
+// dialbackSecret is used to generate and verify XEP-0185 dialback keys.
+var dialbackSecret string
+
+func initializeDialbackSecret(cfg *config.S2S) {
+	if len(cfg.DialbackSecret) > 0 {
+		dialbackSecret = cfg.DialbackSecret
+		return
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	dialbackSecret = hex.EncodeToString(b)
+}
+
+// dialbackKey generates a dialback key as described in XEP-0185.
+func dialbackKey(receiving, originating, streamID string) string {
+	h := sha256.Sum256([]byte(dialbackSecret))
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(h[:])))
+	mac.Write([]byte(receiving + " " + originating + " " + streamID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// s2sConn is an outgoing server-to-server connection
+// that already went through stream negotiation.
+type s2sConn struct {
+	cfg          *config.Server
+	localDomain  string
+	remoteDomain string
+	tr           transport.Transport
+	parser       *xml.Parser
+	streamID     string
+	secured      bool
+	features     xml.Element
+}
+
+func dialS2S(cfg *config.Server, localDomain, remoteDomain string) (*s2sConn, error) {
+	addrs := resolveS2SAddrs(cfg.S2S, remoteDomain)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("s2s: %s doesn't offer server-to-server service", remoteDomain)
+	}
+	var conn net.Conn
+	var err error
+	for _, addr := range addrs {
+		conn, err = net.DialTimeout("tcp", addr, time.Duration(cfg.S2S.DialTimeout)*time.Second)
+		if err == nil {
+			break
+		}
+		log.Debugf("s2s: couldn't connect to %s at %s: %v", remoteDomain, addr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &s2sConn{
+		cfg:          cfg,
+		localDomain:  localDomain,
+		remoteDomain: remoteDomain,
+		tr:           transport.NewSocketTransport(conn, cfg.Transport.BufferSize, cfg.Transport.KeepAlive),
+	}
+	if err := c.open(); err != nil {
+		c.tr.Close()
+		return nil, err
+	}
+	if c.features.FindElementNamespace("starttls", tlsNamespace) != nil {
+		if err := c.startTLS(); err != nil {
+			c.tr.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *s2sConn) open() error {
+	c.parser = newStreamParser(c.tr, c.cfg)
+
+	ops := xml.NewElementName("stream:stream")
+	ops.SetAttribute("xmlns", jabberServerNamespace)
+	ops.SetAttribute("xmlns:stream", streamNamespace)
+	ops.SetAttribute("xmlns:db", dialbackNamespace)
+	ops.SetAttribute("from", c.localDomain)
+	ops.SetAttribute("to", c.remoteDomain)
+	ops.SetAttribute("version", "1.0")
+	c.tr.Write([]byte(`<?xml version="1.0"?>`))
+	ops.ToXML(c.tr, false)
+
+	elem, err := c.readElement()
+	if err != nil {
+		return err
+	}
+	if elem.Name() != "stream:stream" || elem.Namespace() != jabberServerNamespace {
+		return fmt.Errorf("s2s: unexpected stream element from %s: %v", c.remoteDomain, elem)
+	}
+	c.streamID = elem.ID()
+
+	features, err := c.readElement()
+	if err != nil {
+		return err
+	}
+	if features.Name() != "stream:features" {
+		return fmt.Errorf("s2s: expected stream features from %s: %v", c.remoteDomain, features)
+	}
+	c.features = features
+	return nil
+}
+
+func (c *s2sConn) startTLS() error {
+	c.writeElement(xml.NewElementNamespace("starttls", tlsNamespace))
+	elem, err := c.readElement()
+	if err != nil {
+		return err
+	}
+	if elem.Name() != "proceed" {
+		return fmt.Errorf("s2s: %s refused to start TLS", c.remoteDomain)
+	}
+	// dialback only authenticates local domain to the remote server,
+	// hence its identity must be verified by means of its certificate
+	cfg, err := tlsClientConfig(c.cfg.TLS, c.remoteDomain)
+	if err != nil {
+		return err
+	}
+	// present our own certificate to allow SASL EXTERNAL authentication
+	if c.cfg.TLS != nil {
+		cer, err := tlsCertificate(c.cfg.TLS, c.localDomain)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{*cer}
+	}
+	if err := c.tr.StartClientTLS(cfg); err != nil {
+		return err
+	}
+	c.secured = true
+	return c.open()
+}
+
+// authenticateExternal authenticates against remote server
+// using SASL EXTERNAL mechanism whenever it's being offered.
+func (c *s2sConn) authenticateExternal() (bool, error) {
+	if !c.secured {
+		return false, nil
+	}
+	mechanisms := c.features.FindElementNamespace("mechanisms", saslNamespace)
+	if mechanisms == nil {
+		return false, nil
+	}
+	offered := false
+	for _, m := range mechanisms.FindElements("mechanism") {
+		if m.Text() == "EXTERNAL" {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		return false, nil
+	}
+	auth := xml.NewElementNamespace("auth", saslNamespace)
+	auth.SetAttribute("mechanism", "EXTERNAL")
+	auth.SetText(base64.StdEncoding.EncodeToString([]byte(c.localDomain)))
+	c.writeElement(auth)
+
+	elem, err := c.readElement()
+	if err != nil {
+		return false, err
+	}
+	if elem.Name() != "success" {
+		log.Warnf("s2s: SASL EXTERNAL authentication against %s failed: %v", c.remoteDomain, elem)
+		return false, nil
+	}
+	return true, c.open()
+}
+
+func (c *s2sConn) readElement() (xml.Element, error) {
+	elem, err := c.parser.ParseElement()
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("RECV: %v", elem)
+	if elem.Name() == "stream:error" {
+		return nil, fmt.Errorf("s2s: stream error from %s: %v", c.remoteDomain, elem)
+	}
+	return elem, nil
+}
+
+func (c *s2sConn) writeElement(elem xml.Element) {
+	log.Debugf("SEND: %v", elem)
+	elem.ToXML(c.tr, true)
+}
+
+func (c *s2sConn) close() {
+	c.tr.Write([]byte("</stream:stream>"))
+	c.tr.Close()
+}
+
+// verifyDialbackKey asks remoteDomain authoritative server
+// whether or not key was generated by itself for streamID.
+func verifyDialbackKey(cfg *config.Server, localDomain, remoteDomain, streamID, key string) (bool, error) {
+	c, err := dialS2S(cfg, localDomain, remoteDomain)
+	if err != nil {
+		return false, err
+	}
+	defer c.close()
+
+	verify := xml.NewElementName("db:verify")
+	verify.SetFrom(localDomain)
+	verify.SetTo(remoteDomain)
+	verify.SetID(streamID)
+	verify.SetText(key)
+	c.writeElement(verify)
+
+	for {
+		elem, err := c.readElement()
+		if err != nil {
+			return false, err
+		}
+		if elem.Name() == "db:verify" && elem.ID() == streamID {
+			return elem.Type() == "valid", nil
+		}
+	}
+}
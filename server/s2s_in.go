@@ -0,0 +1,580 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+type dialbackResult struct {
+	remoteDomain string
+	valid        bool
+}
+
+// s2sInStream is an incoming server-to-server stream.
+// Remote domains are authenticated by means of XEP-0220 Server Dialback.
+type s2sInStream struct {
+	cfg           *config.Server
+	id            string
+	connected     uint32
+	tr            transport.Transport
+	parser        *xml.Parser
+	state         streamState
+	streamID      string
+	localDomain   string
+	remoteDomain  string
+	secured       bool
+	saslAuthed    bool
+	remoteDomains map[string]struct{}
+
+	roster     *module.ModRoster
+	offline    *module.ModOffline
+	iqHandlers []module.IQHandler
+
+	readCh     chan xml.Element
+	discCh     chan error
+	dialbackCh chan dialbackResult
+	doneCh     chan struct{}
+}
+
+func newS2SInStream(id string, conn net.Conn, cfg *config.Server) *s2sInStream {
+	s := &s2sInStream{
+		cfg:           cfg,
+		id:            id,
+		state:         connecting,
+		remoteDomains: make(map[string]struct{}),
+		readCh:        make(chan xml.Element),
+		discCh:        make(chan error),
+		dialbackCh:    make(chan dialbackResult),
+		doneCh:        make(chan struct{}),
+	}
+	s.tr = transport.NewSocketTransport(conn, cfg.Transport.BufferSize, cfg.Transport.KeepAlive)
+	s.parser = newStreamParser(s.tr, s.cfg)
+
+	// direct TLS connection (XEP-0368)
+	_, s.secured = conn.(*tls.Conn)
+
+	if cfg.Transport.ConnectTimeout > 0 {
+		s.startConnectTimeoutTimer(cfg.Transport.ConnectTimeout)
+	}
+	go s.loop()
+	return s
+}
+
+func (s *s2sInStream) startConnectTimeoutTimer(timeoutInSeconds int) {
+	go func() {
+		tr := time.NewTimer(time.Second * time.Duration(timeoutInSeconds))
+		<-tr.C
+		if atomic.LoadUint32(&s.connected) == 0 {
+			// connection timeout...
+			select {
+			case s.discCh <- streamerror.ErrConnectionTimeout:
+			case <-s.doneCh:
+			}
+		}
+	}()
+}
+
+func (s *s2sInStream) handleElement(elem xml.Element) {
+	switch s.state {
+	case connecting:
+		s.handleConnecting(elem)
+	case connected:
+		s.handleConnected(elem)
+	}
+}
+
+func (s *s2sInStream) handleConnecting(elem xml.Element) {
+	// activate 'connected' flag
+	atomic.StoreUint32(&s.connected, 1)
+
+	if err := s.validateStreamElement(elem); err != nil {
+		s.disconnectWithStreamError(err)
+		return
+	}
+	s.localDomain = elem.To()
+	s.remoteDomain = elem.From()
+	s.openStreamElement(elem.From())
+
+	features := xml.NewElementName("stream:features")
+	features.SetAttribute("xmlns:stream", streamNamespace)
+	features.SetAttribute("version", "1.0")
+
+	if !s.secured && s.cfg.TLS != nil {
+		startTLS := xml.NewElementNamespace("starttls", tlsNamespace)
+		if s.cfg.TLS.Required {
+			startTLS.AppendElement(xml.NewElementName("required"))
+		}
+		features.AppendElement(startTLS)
+	}
+	// offer SASL EXTERNAL to peers presenting a valid certificate (XEP-0178)
+	if s.secured && !s.saslAuthed && len(s.tr.PeerCertificates()) > 0 {
+		mechanisms := xml.NewElementNamespace("mechanisms", saslNamespace)
+		mechanism := xml.NewElementName("mechanism")
+		mechanism.SetText("EXTERNAL")
+		mechanisms.AppendElement(mechanism)
+		features.AppendElement(mechanisms)
+	}
+	if s.secured || s.cfg.TLS == nil || !s.cfg.TLS.Required {
+		dialback := xml.NewElementNamespace("dialback", dialbackFeatureNamespace)
+		dialback.AppendElement(xml.NewElementName("errors"))
+		features.AppendElement(dialback)
+	}
+	s.state = connected
+	s.writeElement(features)
+}
+
+func (s *s2sInStream) handleConnected(elem xml.Element) {
+	switch elem.Name() {
+	case "starttls":
+		if len(elem.Namespace()) > 0 && elem.Namespace() != tlsNamespace {
+			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+			return
+		}
+		s.proceedStartTLS()
+
+	case "auth":
+		if elem.Namespace() != saslNamespace {
+			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+			return
+		}
+		s.authenticateExternal(elem)
+
+	case "db:result":
+		if s.cfg.TLS != nil && s.cfg.TLS.Required && !s.secured {
+			s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+			return
+		}
+		s.authenticateRemoteDomain(elem)
+
+	case "db:verify":
+		s.verifyDialbackKey(elem)
+
+	case "iq", "presence", "message":
+		s.processStanza(elem)
+
+	default:
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+	}
+}
+
+func (s *s2sInStream) proceedStartTLS() {
+	if s.secured {
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	cfg, err := tlsServerConfig(s.cfg.TLS, s.localDomain)
+	if err != nil {
+		log.Error(err)
+		s.writeElement(xml.NewElementNamespace("failure", tlsNamespace))
+		s.disconnect(true)
+		return
+	}
+	s.writeElement(xml.NewElementNamespace("proceed", tlsNamespace))
+
+	s.tr.StartTLS(cfg)
+	s.secured = true
+
+	log.Infof("secured s2s stream... id: %s", s.id)
+
+	s.restart()
+}
+
+func (s *s2sInStream) authenticateExternal(elem xml.Element) {
+	if elem.Attribute("mechanism") != "EXTERNAL" || s.saslAuthed {
+		s.failAuthentication(xml.NewElementName("invalid-mechanism"))
+		return
+	}
+	authzID, err := decodeAuthzID(elem)
+	if err != nil {
+		s.failAuthentication(err.(saslError).Element())
+		return
+	}
+	remoteDomain := s.remoteDomain
+	if len(authzID) > 0 {
+		remoteDomain = authzID
+	}
+	certs := s.tr.PeerCertificates()
+	if len(remoteDomain) == 0 || len(certs) == 0 || !certificateMatchesDomain(certs[0], remoteDomain) {
+		s.failAuthentication(errSASLNotAuthorized.(saslError).Element())
+		return
+	}
+	s.writeElement(xml.NewElementNamespace("success", saslNamespace))
+	s.remoteDomains[remoteDomain] = struct{}{}
+	s.saslAuthed = true
+
+	log.Infof("s2s: authenticated in stream via SASL EXTERNAL... (%s -> %s)", remoteDomain, s.localDomain)
+
+	s.restart()
+}
+
+func (s *s2sInStream) failAuthentication(elem xml.Element) {
+	failure := xml.NewElementNamespace("failure", saslNamespace)
+	failure.AppendElement(elem)
+	s.writeElement(failure)
+}
+
+func (s *s2sInStream) authenticateRemoteDomain(elem xml.Element) {
+	localDomain := elem.To()
+	remoteDomain := elem.From()
+	if localDomain != s.localDomain {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+	if len(remoteDomain) == 0 {
+		s.disconnectWithStreamError(streamerror.ErrInvalidFrom)
+		return
+	}
+	// ask remote authoritative server for key validity
+	streamID := s.streamID
+	key := elem.Text()
+	go func() {
+		valid, err := verifyDialbackKey(s.cfg, localDomain, remoteDomain, streamID, key)
+		if err != nil {
+			log.Errorf("s2s: couldn't verify dialback key from %s: %v", remoteDomain, err)
+		}
+		select {
+		case s.dialbackCh <- dialbackResult{remoteDomain: remoteDomain, valid: valid}:
+		case <-s.doneCh:
+			// stream disconnected while verifying
+		}
+	}()
+}
+
+func (s *s2sInStream) finishAuthentication(res dialbackResult) {
+	result := xml.NewElementName("db:result")
+	result.SetFrom(s.localDomain)
+	result.SetTo(res.remoteDomain)
+	if !res.valid {
+		result.SetType("invalid")
+		s.writeElement(result)
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	result.SetType("valid")
+	s.writeElement(result)
+	s.remoteDomains[res.remoteDomain] = struct{}{}
+
+	log.Infof("s2s: authenticated in stream... (%s -> %s)", res.remoteDomain, s.localDomain)
+}
+
+func (s *s2sInStream) verifyDialbackKey(elem xml.Element) {
+	receiving := elem.From()
+	originating := elem.To()
+	if !stream.C2S().IsLocalDomain(originating) {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+	verify := xml.NewElementName("db:verify")
+	verify.SetFrom(originating)
+	verify.SetTo(receiving)
+	verify.SetID(elem.ID())
+	if elem.Text() == dialbackKey(receiving, originating, elem.ID()) {
+		verify.SetType("valid")
+	} else {
+		verify.SetType("invalid")
+	}
+	s.writeElement(verify)
+}
+
+func (s *s2sInStream) processStanza(elem xml.Element) {
+	fromJID, err := xml.NewJIDString(elem.From(), false)
+	if err != nil {
+		s.disconnectWithStreamError(streamerror.ErrInvalidFrom)
+		return
+	}
+	if _, ok := s.remoteDomains[fromJID.Domain()]; !ok {
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	toJID, err := xml.NewJIDString(elem.To(), false)
+	if err != nil {
+		s.replyError(elem, xml.ErrJidMalformed)
+		return
+	}
+	if toJID.Domain() != s.localDomain {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+
+	var stanza xml.Element
+	switch elem.Name() {
+	case "iq":
+		stanza, err = xml.NewIQFromElement(elem, fromJID, toJID)
+	case "presence":
+		stanza, err = xml.NewPresenceFromElement(elem, fromJID, toJID)
+	case "message":
+		stanza, err = xml.NewMessageFromElement(elem, fromJID, toJID)
+	}
+	if err != nil {
+		log.Error(err)
+		s.replyError(elem, xml.ErrBadRequest)
+		return
+	}
+
+	if s.roster == nil {
+		s.initializeModules()
+	}
+	switch stanza := stanza.(type) {
+	case *xml.IQ:
+		s.processIQ(stanza)
+	case *xml.Presence:
+		s.processPresence(stanza)
+	case *xml.Message:
+		s.processMessage(stanza)
+	}
+}
+
+// initializeModules sets up the modules handling stanzas sent
+// by remote entities, as enabled for the local domain.
+func (s *s2sInStream) initializeModules() {
+	strm := &remoteStream{id: s.id, localDomain: s.localDomain}
+
+	// Roster (https://xmpp.org/rfcs/rfc3921.html#roster)
+	s.roster = module.NewRoster(strm)
+
+	// XEP-0030: Service Discovery (https://xmpp.org/extensions/xep-0030.html)
+	discoInfo := module.NewXEPDiscoInfo(strm)
+	s.iqHandlers = append(s.iqHandlers, discoInfo)
+
+	cfg := localServerConfig(s.localDomain)
+	if cfg == nil {
+		return
+	}
+	// XEP-0054: vcard-temp (https://xmpp.org/extensions/xep-0054.html)
+	if _, ok := cfg.Modules["vcard"]; ok {
+		s.iqHandlers = append(s.iqHandlers, module.NewXEPVCard(strm))
+	}
+
+	// XEP-0092: Software Version (https://xmpp.org/extensions/xep-0092.html)
+	if _, ok := cfg.Modules["version"]; ok {
+		s.iqHandlers = append(s.iqHandlers, module.NewXEPVersion(&cfg.ModVersion, strm))
+	}
+
+	// XEP-0199: XMPP Ping (https://xmpp.org/extensions/xep-0199.html)
+	if _, ok := cfg.Modules["ping"]; ok {
+		s.iqHandlers = append(s.iqHandlers, module.NewXEPPing(&cfg.ModPing, strm))
+	}
+
+	// register server disco info identities
+	identities := []module.DiscoIdentity{{
+		Category: "server",
+		Type:     "im",
+		Name:     cfg.ID,
+	}}
+	discoInfo.SetIdentities(identities)
+
+	// register disco info features
+	var features []string
+	for _, iqHandler := range s.iqHandlers {
+		features = append(features, iqHandler.AssociatedNamespaces()...)
+	}
+
+	// XEP-0160: Offline message storage (https://xmpp.org/extensions/xep-0160.html)
+	if _, ok := cfg.Modules["offline"]; ok {
+		s.offline = module.NewOffline(&cfg.ModOffline, strm)
+		features = append(features, s.offline.AssociatedNamespaces()...)
+	}
+	discoInfo.SetFeatures(features)
+}
+
+func (s *s2sInStream) processIQ(iq *xml.IQ) {
+	toJID := iq.ToJID()
+	if toJID.IsFull() {
+		if deliverLocal(iq, toJID, false) == nil {
+			return
+		}
+	} else if iq.IsGet() {
+		// remote entities are only allowed to query local ones
+		for _, handler := range s.iqHandlers {
+			if !handler.MatchesIQ(iq) {
+				continue
+			}
+			handler.ProcessIQ(iq)
+			return
+		}
+	}
+	if iq.IsGet() || iq.IsSet() {
+		s.replyError(iq, xml.ErrServiceUnavailable)
+	}
+}
+
+func (s *s2sInStream) processPresence(presence *xml.Presence) {
+	switch presence.Type() {
+	case xml.SubscribeType, xml.SubscribedType, xml.UnsubscribeType, xml.UnsubscribedType, xml.ProbeType:
+		s.roster.ProcessRemotePresence(presence)
+	default:
+		deliverLocal(presence, presence.ToJID(), false)
+	}
+}
+
+func (s *s2sInStream) processMessage(message *xml.Message) {
+	if cfg := localMAMConfig(message.ToJID().Domain()); cfg != nil {
+		module.ArchiveIncomingMessage(cfg, message)
+	}
+	err := deliverLocal(message, message.ToJID(), module.IsCarbonsEligible(message))
+	switch {
+	case err == nil:
+		break
+	case err == errNotAuthenticated && s.offline != nil:
+		s.offline.ArchiveMessage(message)
+	default:
+		s.replyError(message, xml.ErrServiceUnavailable)
+	}
+}
+
+// replyError sends back a stanza error through the corresponding outgoing stream.
+func (s *s2sInStream) replyError(elem xml.Element, err error) {
+	if elem.Type() == "error" {
+		return
+	}
+	from := elem.From()
+	to := elem.To()
+	fromJID, jidErr := xml.NewJIDString(from, true)
+	if jidErr != nil {
+		return
+	}
+	resp := xml.ToErrorElement(elem, err.(*xml.StanzaError))
+	resp.SetFrom(to)
+	resp.SetTo(from)
+	stream.S2S().Route(resp, s.localDomain, fromJID.Domain())
+}
+
+func (s *s2sInStream) restart() {
+	s.state = connecting
+	s.parser = newStreamParser(s.tr, s.cfg)
+}
+
+func (s *s2sInStream) loop() {
+	defer close(s.doneCh)
+
+	s.doRead() // start reading transport...
+	for {
+		// stop looping after disconnecting stream
+		if s.state == disconnected {
+			return
+		}
+		select {
+		case e := <-s.readCh:
+			s.handleElement(e)
+			if s.state != disconnected {
+				s.doRead() // keep reading transport...
+			}
+
+		case res := <-s.dialbackCh:
+			s.finishAuthentication(res)
+
+		case err := <-s.discCh:
+			switch err {
+			case nil:
+				s.disconnect(false)
+			default:
+				if strmErr, ok := err.(*streamerror.Error); ok {
+					s.disconnectWithStreamError(strmErr)
+				} else {
+					log.Error(err)
+					s.disconnect(false)
+				}
+			}
+		}
+	}
+}
+
+func (s *s2sInStream) doRead() {
+	go func() {
+		if e, err := s.parser.ParseElement(); e != nil && err == nil {
+			log.Debugf("RECV: %v", e)
+			s.readCh <- e
+
+		} else if err != nil {
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+				s.discCh <- nil
+			default:
+				log.Error(err)
+				if _, ok := err.(*xml.LimitError); ok {
+					s.discCh <- streamerror.ErrPolicyViolation
+				} else {
+					s.discCh <- streamerror.ErrInvalidXML
+				}
+			}
+		}
+	}()
+}
+
+func (s *s2sInStream) validateStreamElement(elem xml.Element) *streamerror.Error {
+	if elem.Name() != "stream:stream" {
+		return streamerror.ErrUnsupportedStanzaType
+	}
+	if !stream.C2S().IsLocalDomain(elem.To()) {
+		return streamerror.ErrHostUnknown
+	}
+	if elem.Namespace() != jabberServerNamespace || elem.Attribute("xmlns:stream") != streamNamespace {
+		return streamerror.ErrInvalidNamespace
+	}
+	if elem.Attribute("xmlns:db") != dialbackNamespace {
+		return streamerror.ErrInvalidNamespace
+	}
+	if elem.Version() != "1.0" {
+		return streamerror.ErrUnsupportedVersion
+	}
+	return nil
+}
+
+func (s *s2sInStream) openStreamElement(to string) {
+	s.streamID = uuid.New()
+
+	ops := xml.NewElementName("stream:stream")
+	ops.SetAttribute("xmlns", jabberServerNamespace)
+	ops.SetAttribute("xmlns:stream", streamNamespace)
+	ops.SetAttribute("xmlns:db", dialbackNamespace)
+	ops.SetAttribute("id", s.streamID)
+	ops.SetAttribute("from", s.localDomain)
+	if len(to) > 0 {
+		ops.SetAttribute("to", to)
+	}
+	ops.SetAttribute("version", "1.0")
+
+	s.tr.Write([]byte(`<?xml version="1.0"?>`))
+	ops.ToXML(s.tr, false)
+}
+
+func (s *s2sInStream) writeElement(elem xml.Element) {
+	log.Debugf("SEND: %v", elem)
+	elem.ToXML(s.tr, true)
+}
+
+func (s *s2sInStream) disconnectWithStreamError(err *streamerror.Error) {
+	if s.state == connecting {
+		if len(s.localDomain) == 0 {
+			s.localDomain = stream.C2S().DefaultDomain()
+		}
+		s.openStreamElement("")
+	}
+	s.writeElement(err.Element())
+	s.disconnect(true)
+}
+
+func (s *s2sInStream) disconnect(closeStream bool) {
+	if closeStream {
+		s.tr.Write([]byte("</stream:stream>"))
+	}
+	s.tr.Close()
+	s.state = disconnected
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const maxS2SConnectBackoff = time.Minute
+
+// s2sOutStream is an outgoing server-to-server stream.
+// Stanzas sent before dialback authentication completes
+// are queued and delivered right after.
+type s2sOutStream struct {
+	cfg          *config.Server
+	id           string
+	localDomain  string
+	remoteDomain string
+	conn         *s2sConn
+	pending      []xml.Element
+	state        streamState
+
+	closeMu sync.RWMutex // guards 'closed'
+	closed  bool
+
+	writeCh   chan xml.Element
+	readCh    chan xml.Element
+	discCh    chan error
+	connectCh chan s2sConnectResult
+	doneCh    chan struct{}
+}
+
+type s2sConnectResult struct {
+	conn *s2sConn
+	err  error
+}
+
+func newS2SOutStream(cfg *config.Server, localDomain, remoteDomain string) *s2sOutStream {
+	s := &s2sOutStream{
+		cfg:          cfg,
+		id:           fmt.Sprintf("%s:out:%s", cfg.ID, uuid.New()),
+		localDomain:  localDomain,
+		remoteDomain: remoteDomain,
+		state:        connecting,
+		writeCh:      make(chan xml.Element, 256),
+		readCh:       make(chan xml.Element),
+		discCh:       make(chan error),
+		connectCh:    make(chan s2sConnectResult),
+		doneCh:       make(chan struct{}),
+	}
+	go s.connect()
+	go s.loop()
+	return s
+}
+
+func (s *s2sOutStream) ID() string {
+	return s.id
+}
+
+func (s *s2sOutStream) LocalDomain() string {
+	return s.localDomain
+}
+
+func (s *s2sOutStream) RemoteDomain() string {
+	return s.remoteDomain
+}
+
+func (s *s2sOutStream) SendElement(element xml.Element) bool {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.writeCh <- element:
+		return true
+	case <-s.doneCh:
+		return false
+	}
+}
+
+func (s *s2sOutStream) Disconnect(err error) {
+	select {
+	case s.discCh <- err:
+	case <-s.doneCh:
+	}
+}
+
+func (s *s2sOutStream) connect() {
+	backoff := time.Duration(s.cfg.S2S.ConnectBackoff) * time.Second
+	for i := 0; ; i++ {
+		c, err := s.dial()
+		if err == nil || i == s.cfg.S2S.ConnectRetries {
+			select {
+			case s.connectCh <- s2sConnectResult{conn: c, err: err}:
+			case <-s.doneCh:
+				// stream went away while connecting
+				if c != nil {
+					c.close()
+				}
+			}
+			return
+		}
+		log.Warnf("s2s: couldn't connect to %s (retrying in %v): %v", s.remoteDomain, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-s.doneCh:
+			return
+		}
+		if backoff *= 2; backoff > maxS2SConnectBackoff {
+			backoff = maxS2SConnectBackoff
+		}
+	}
+}
+
+func (s *s2sOutStream) dial() (*s2sConn, error) {
+	c, err := dialS2S(s.cfg, s.localDomain, s.remoteDomain)
+	if err != nil {
+		return nil, err
+	}
+	authed, err := c.authenticateExternal()
+	if err != nil {
+		c.tr.Close()
+		return nil, err
+	}
+	if authed {
+		return c, nil
+	}
+
+	// fall back to dialback authentication
+	result := xml.NewElementName("db:result")
+	result.SetFrom(s.localDomain)
+	result.SetTo(s.remoteDomain)
+	result.SetText(dialbackKey(s.remoteDomain, s.localDomain, c.streamID))
+	c.writeElement(result)
+
+	for {
+		elem, err := c.readElement()
+		if err != nil {
+			c.tr.Close()
+			return nil, err
+		}
+		if elem.Name() != "db:result" || elem.From() != s.remoteDomain || elem.To() != s.localDomain {
+			continue
+		}
+		if elem.Type() != "valid" {
+			c.close()
+			return nil, fmt.Errorf("s2s: %s rejected dialback authentication", s.remoteDomain)
+		}
+		return c, nil
+	}
+}
+
+func (s *s2sOutStream) loop() {
+	defer s.shutdown()
+	for {
+		if s.state == disconnected {
+			return
+		}
+		select {
+		case e := <-s.writeCh:
+			if s.state == connecting {
+				s.pending = append(s.pending, e)
+			} else {
+				s.conn.writeElement(e)
+			}
+
+		case res := <-s.connectCh:
+			if res.err != nil {
+				log.Errorf("s2s: couldn't connect to %s: %v", s.remoteDomain, res.err)
+				s.bounce(res.err)
+				continue
+			}
+			s.conn = res.conn
+			log.Infof("s2s: authenticated out stream... (%s -> %s)", s.localDomain, s.remoteDomain)
+			s.state = sessionStarted
+			for _, e := range s.pending {
+				s.conn.writeElement(e)
+			}
+			s.pending = nil
+			s.doRead()
+
+		case e := <-s.readCh:
+			// outgoing streams are unidirectional... just ignore incoming elements
+			log.Debugf("s2s: ignoring element on out stream: %v", e)
+			s.doRead()
+
+		case err := <-s.discCh:
+			if s.state == connecting {
+				s.bounce(err)
+				continue
+			}
+			if strmErr, ok := err.(*streamerror.Error); ok {
+				s.conn.writeElement(strmErr.Element())
+			} else if err != nil {
+				log.Error(err)
+			}
+			s.disconnect()
+		}
+	}
+}
+
+func (s *s2sOutStream) doRead() {
+	go func() {
+		e, err := s.conn.parser.ParseElement()
+		switch err {
+		case nil:
+			select {
+			case s.readCh <- e:
+			case <-s.doneCh:
+			}
+		case io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+			s.Disconnect(nil)
+		default:
+			s.Disconnect(err)
+		}
+	}()
+}
+
+// bounce replies queued stanzas with a remote server error and
+// unregisters the stream, so that a new connection gets established
+// on next routed stanza.
+func (s *s2sOutStream) bounce(err error) {
+	stanzaErr := xml.ErrRemoteServerNotFound.(*xml.StanzaError)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		stanzaErr = xml.ErrRemoteServerTimeout.(*xml.StanzaError)
+	}
+	for _, e := range s.pending {
+		bounceElement(e, stanzaErr)
+	}
+	s.pending = nil
+	s.state = disconnected
+	stream.S2S().UnregisterOutStream(s)
+}
+
+func (s *s2sOutStream) disconnect() {
+	s.conn.close()
+	s.state = disconnected
+	stream.S2S().UnregisterOutStream(s)
+}
+
+// shutdown releases a disconnected stream, bouncing
+// those stanzas that were still waiting to be sent.
+func (s *s2sOutStream) shutdown() {
+	close(s.doneCh)
+
+	// wait for in-flight senders... no element gets queued from now on
+	s.closeMu.Lock()
+	s.closed = true
+	s.closeMu.Unlock()
+
+	stanzaErr := xml.ErrRemoteServerNotFound.(*xml.StanzaError)
+	for {
+		select {
+		case e := <-s.writeCh:
+			bounceElement(e, stanzaErr)
+		default:
+			return
+		}
+	}
+}
+
+// bounceElement replies a stanza back to its local sender with a stanza error.
+func bounceElement(elem xml.Element, stanzaErr *xml.StanzaError) {
+	if elem.Type() == "error" {
+		return
+	}
+	from := elem.From()
+	to := elem.To()
+	fromJID, err := xml.NewJIDString(from, false)
+	if err != nil || !stream.C2S().IsLocalDomain(fromJID.Domain()) {
+		return
+	}
+	resp := xml.ToErrorElement(elem, stanzaErr)
+	resp.SetFrom(to)
+	resp.SetTo(from)
+	deliverLocal(resp, fromJID, false)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS2SOutStreamShutdown(t *testing.T) {
+	// remote server closing every accepted connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	cfg := &config.Server{
+		ID:        "s2s",
+		Transport: config.Transport{BufferSize: 4096},
+		S2S: &config.S2S{
+			DialTimeout:    1,
+			ConnectBackoff: 1,
+			Hosts:          map[string]string{"jackal.im": ln.Addr().String()},
+		},
+	}
+	var dialed []*s2sOutStream
+	stream.S2S().SetDialer(func(localDomain, remoteDomain string) stream.S2SOutStream {
+		s := newS2SOutStream(cfg, localDomain, remoteDomain)
+		dialed = append(dialed, s)
+		return s
+	})
+	defer stream.S2S().SetDialer(nil)
+
+	msg := xml.NewElementName("message")
+	assert.Nil(t, stream.S2S().Route(msg, "localhost", "jackal.im"))
+	assert.Equal(t, len(dialed), 1)
+
+	select {
+	case <-dialed[0].doneCh:
+		break
+	case <-time.After(time.Second * 5):
+		t.Fatal("outgoing stream didn't shut down")
+	}
+	assert.False(t, dialed[0].SendElement(msg))
+	dialed[0].Disconnect(nil) // must not block
+
+	// a new stream replaces the disconnected one
+	assert.Nil(t, stream.S2S().Route(msg, "localhost", "jackal.im"))
+	assert.Equal(t, len(dialed), 2)
+
+	// don't let it outlive the test
+	select {
+	case <-dialed[1].doneCh:
+		break
+	case <-time.After(time.Second * 5):
+		t.Fatal("outgoing stream didn't shut down")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+)
+
+// remoteStream exposes an incoming server-to-server stream to the modules
+// processing stanzas sent by remote entities. Not being bound to any local
+// account it has no username, its JID is the one of the local domain, and
+// every element sent through it gets routed back to its remote recipient.
+type remoteStream struct {
+	id          string
+	localDomain string
+}
+
+func (s *remoteStream) ID() string {
+	return s.id
+}
+
+func (s *remoteStream) Username() string {
+	return ""
+}
+
+func (s *remoteStream) Domain() string {
+	return s.localDomain
+}
+
+func (s *remoteStream) Resource() string {
+	return ""
+}
+
+func (s *remoteStream) JID() *xml.JID {
+	j, _ := xml.NewJID("", s.localDomain, "", true)
+	return j
+}
+
+func (s *remoteStream) Priority() int8 {
+	return 0
+}
+
+func (s *remoteStream) SendElement(element xml.Element) {
+	toJID, err := xml.NewJIDString(element.To(), true)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := stream.S2S().Route(element, s.localDomain, toJID.Domain()); err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *remoteStream) Disconnect(err error) {
+}
+
+func (s *remoteStream) IsSecured() bool {
+	return false
+}
+
+func (s *remoteStream) IsAuthenticated() bool {
+	return true
+}
+
+func (s *remoteStream) IsCompressed() bool {
+	return false
+}
+
+func (s *remoteStream) PresenceElements() []xml.Element {
+	return nil
+}
+
+func (s *remoteStream) IsRosterRequested() bool {
+	return false
+}
+
+func (s *remoteStream) IsCarbonsEnabled() bool {
+	return false
+}
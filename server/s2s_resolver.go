@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+)
+
+// srvResolver looks up DNS SRV records.
+// net.DefaultResolver satisfies this interface.
+type srvResolver interface {
+	LookupSRV(service, proto, name string) (string, []*net.SRV, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	return net.LookupSRV(service, proto, name)
+}
+
+// s2sResolver is used to resolve remote server addresses,
+// and can be replaced to stub out DNS resolution.
+var s2sResolver srvResolver = netResolver{}
+
+// resolveS2SAddrs returns remote domain candidate addresses ordered by preference,
+// as described in https://xmpp.org/rfcs/rfc6120.html#tcp-resolution
+func resolveS2SAddrs(cfg *config.S2S, remoteDomain string) []string {
+	if addr, ok := cfg.Hosts[remoteDomain]; ok {
+		return []string{addr}
+	}
+	fallback := []string{net.JoinHostPort(remoteDomain, strconv.Itoa(defaultS2SPort))}
+
+	_, srvs, err := s2sResolver.LookupSRV("xmpp-server", "tcp", remoteDomain)
+	if err != nil || len(srvs) == 0 {
+		if err != nil {
+			log.Debugf("s2s: SRV lookup failed for %s: %v", remoteDomain, err)
+		}
+		return fallback
+	}
+	// a single '.' target means service is decidedly not available
+	if len(srvs) == 1 && srvs[0].Target == "." {
+		return nil
+	}
+	var addrs []string
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+	}
+	return addrs
+}
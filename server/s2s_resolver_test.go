@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubResolver struct {
+	srvs map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	if srvs, ok := r.srvs[name]; ok {
+		return "", srvs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+func TestResolveS2SAddrs(t *testing.T) {
+	defer func(r srvResolver) { s2sResolver = r }(s2sResolver)
+	s2sResolver = &stubResolver{srvs: map[string][]*net.SRV{
+		"jackal.im": {
+			{Target: "xmpp1.jackal.im.", Port: 5269},
+			{Target: "xmpp2.jackal.im.", Port: 5270},
+		},
+		"noxmpp.im": {{Target: "."}},
+	}}
+	cfg := &config.S2S{Hosts: map[string]string{"local.im": "127.0.0.1:5270"}}
+
+	assert.Equal(t, resolveS2SAddrs(cfg, "jackal.im"), []string{"xmpp1.jackal.im:5269", "xmpp2.jackal.im:5270"})
+	assert.Equal(t, resolveS2SAddrs(cfg, "example.org"), []string{"example.org:5269"})
+	assert.Equal(t, resolveS2SAddrs(cfg, "local.im"), []string{"127.0.0.1:5270"})
+	assert.Equal(t, len(resolveS2SAddrs(cfg, "noxmpp.im")), 0)
+}
@@ -6,41 +6,127 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	// pprof
 	_ "net/http/pprof"
 
+	"github.com/gorilla/websocket"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module"
+	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+)
+
+const webSocketSubprotocol = "xmpp"
+
+// received stanzas resource limits, in addition to transport's max_stanza_size
+const (
+	maxStanzaDepth      = 64
+	maxStanzaAttributes = 64
 )
 
 type server struct {
 	cfg         *config.Server
 	strmCounter int32
+	upgrader    *websocket.Upgrader
+
+	lock         sync.Mutex
+	ln           net.Listener
+	httpSrv      *http.Server
+	shuttingDown bool
 }
 
 func Initialize() {
 	// initialize debug
 	if config.DefaultConfig.Debug != nil {
+		http.HandleFunc("/healthz", handleHealthCheck)
 		go func() {
 			http.ListenAndServe(fmt.Sprintf(":%d", config.DefaultConfig.Debug.Port), nil)
 		}()
 	}
 
+	// enable federation
+	for i := range config.DefaultConfig.Servers {
+		if cfg := &config.DefaultConfig.Servers[i]; cfg.Type == config.S2SServerType {
+			initializeS2S(cfg)
+			break
+		}
+	}
+
+	// purge expired offline messages
+	if maxAge, ok := offlinePurgeAge(); ok {
+		module.StartOfflinePurge(maxAge)
+	}
+
 	for i := 1; i < len(config.DefaultConfig.Servers); i++ {
 		go initializeServer(&config.DefaultConfig.Servers[i])
 	}
 	initializeServer(&config.DefaultConfig.Servers[0])
 }
 
+func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if !storage.IsHealthy() {
+		http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func initializeS2S(serverConfig *config.Server) {
+	initializeDialbackSecret(serverConfig.S2S)
+	stream.S2S().SetDialer(func(localDomain, remoteDomain string) stream.S2SOutStream {
+		return newS2SOutStream(serverConfig, localDomain, remoteDomain)
+	})
+}
+
+// offlinePurgeAge returns the age after which stored offline messages
+// can be purged, being the longest 'expire_after' setting among every domain
+// enabling offline storage. Returns false if no domain enables it.
+func offlinePurgeAge() (time.Duration, bool) {
+	var maxAge time.Duration
+	enabled := false
+	for i := range config.DefaultConfig.Servers {
+		cfg := &config.DefaultConfig.Servers[i]
+		if cfg.Type != config.C2SServerType {
+			continue
+		}
+		for _, domain := range config.DefaultConfig.C2S.Domains {
+			hc := hostConfig(cfg, domain)
+			if _, ok := hc.Modules["offline"]; !ok {
+				continue
+			}
+			age := time.Duration(hc.ModOffline.ExpireAfter) * time.Second
+			switch {
+			case !enabled:
+				maxAge = age
+			case age == 0 || maxAge == 0:
+				// messages don't expire by age on this domain
+				maxAge = 0
+			case age > maxAge:
+				maxAge = age
+			}
+			enabled = true
+		}
+	}
+	return maxAge, enabled
+}
+
 func initializeServer(serverConfig *config.Server) {
 	srv := newServerWithConfig(serverConfig)
+	registerServer(srv)
 	srv.start()
 }
 
@@ -58,14 +144,40 @@ func (s *server) start() {
 
 	log.Infof("%s: listening at %s [transport: %v]", s.cfg.ID, address, s.cfg.Transport.Type)
 
+	switch s.cfg.Transport.Type {
+	case config.WebSocket:
+		s.listenWebSocketConn(address)
+	case config.BOSH:
+		s.listenBOSHConn(address)
+	default:
+		s.listenSocketConn(address)
+	}
+}
+
+func (s *server) listenSocketConn(address string) {
 	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("%v", err)
 		return
 	}
+	if s.cfg.Transport.DirectTLS {
+		tlsCfg, err := tlsServerConfig(s.cfg.TLS, "")
+		if err != nil {
+			log.Fatalf("%v", err)
+			return
+		}
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	if !s.setListener(ln) {
+		ln.Close()
+		return
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return
+			}
 			log.Errorf("%v", err)
 			continue
 		}
@@ -73,8 +185,104 @@ func (s *server) start() {
 	}
 }
 
-func (s *server) handleConnection(conn net.Conn) {
-	id := fmt.Sprintf("%s:%d", s.cfg.ID, atomic.AddInt32(&s.strmCounter, 1))
-	strm := newSocketStream(id, conn, s.cfg)
+func (s *server) listenWebSocketConn(address string) {
+	s.upgrader = &websocket.Upgrader{
+		ReadBufferSize:  s.cfg.Transport.BufferSize,
+		WriteBufferSize: s.cfg.Transport.BufferSize,
+		Subprotocols:    []string{webSocketSubprotocol},
+		CheckOrigin:     s.checkOrigin,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.cfg.Transport.URLPath, s.handleWebSocket)
+	s.listenHTTP(address, mux)
+}
+
+func (s *server) listenBOSHConn(address string) {
+	mux := http.NewServeMux()
+	mux.Handle(s.cfg.Transport.URLPath, newBOSHHandler(s))
+	s.listenHTTP(address, mux)
+}
+
+// listenHTTP serves HTTP based transports, over TLS whenever configured.
+func (s *server) listenHTTP(address string, handler http.Handler) {
+	srv := &http.Server{Addr: address, Handler: handler}
+	if !s.setHTTPServer(srv) {
+		return
+	}
+
+	var err error
+	if s.cfg.TLS != nil {
+		srv.TLSConfig, err = tlsServerConfig(s.cfg.TLS, "")
+		if err == nil {
+			err = srv.ListenAndServeTLS("", "")
+		}
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return
+	}
+	log.Fatalf("%v", err)
+}
+
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if conn.Subprotocol() != webSocketSubprotocol {
+		log.Errorf("%s: websocket connection without '%s' subprotocol", s.cfg.ID, webSocketSubprotocol)
+		conn.Close()
+		return
+	}
+	strm := newWebSocketStream(s.nextStreamID(), conn, s.cfg)
 	stream.C2S().RegisterStream(strm)
 }
+
+// checkOrigin returns whether or not a WebSocket request origin
+// is allowed to connect. Requests without origin don't come from
+// a browser and are always allowed.
+func (s *server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if len(s.cfg.Transport.Origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range s.cfg.Transport.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) handleConnection(conn net.Conn) {
+	id := s.nextStreamID()
+	switch s.cfg.Type {
+	case config.S2SServerType:
+		newS2SInStream(id, conn, s.cfg)
+	case config.ComponentServerType:
+		newComponentStream(id, conn, s.cfg)
+	default:
+		strm := newSocketStream(id, conn, s.cfg)
+		stream.C2S().RegisterStream(strm)
+	}
+}
+
+func (s *server) nextStreamID() string {
+	return fmt.Sprintf("%s:%d", s.cfg.ID, atomic.AddInt32(&s.strmCounter, 1))
+}
+
+// newStreamParser returns a parser bounding the resources consumed by every received element.
+func newStreamParser(r io.Reader, cfg *config.Server) *xml.Parser {
+	return xml.NewLimitedParser(r, xml.ParserLimits{
+		MaxElementSize: cfg.Transport.MaxStanzaSize,
+		MaxDepth:       maxStanzaDepth,
+		MaxAttributes:  maxStanzaAttributes,
+		MaxTextLength:  cfg.Transport.MaxStanzaSize,
+	})
+}
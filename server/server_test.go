@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketCheckOrigin(t *testing.T) {
+	srv := newServerWithConfig(&config.Server{Transport: config.Transport{Type: config.WebSocket}})
+
+	r := httptest.NewRequest("GET", "http://jackal.im/xmpp/ws", nil)
+	assert.True(t, srv.checkOrigin(r))
+
+	r.Header.Set("Origin", "https://jackal.im")
+	assert.True(t, srv.checkOrigin(r))
+
+	r.Header.Set("Origin", "https://evil.im")
+	assert.False(t, srv.checkOrigin(r))
+
+	srv.cfg.Transport.Origins = []string{"https://evil.im"}
+	assert.True(t, srv.checkOrigin(r))
+
+	r.Header.Set("Origin", "https://jackal.im")
+	assert.False(t, srv.checkOrigin(r))
+
+	srv.cfg.Transport.Origins = []string{"*"}
+	assert.True(t, srv.checkOrigin(r))
+}
+
+func TestOfflinePurgeAge(t *testing.T) {
+	defer func(c config.C2S, servers []config.Server) {
+		config.DefaultConfig.C2S = c
+		config.DefaultConfig.Servers = servers
+	}(config.DefaultConfig.C2S, config.DefaultConfig.Servers)
+
+	config.DefaultConfig.C2S = config.C2S{Domains: []string{"localhost"}}
+	config.DefaultConfig.Servers = []config.Server{
+		{Type: config.C2SServerType, Modules: map[string]struct{}{"offline": {}}, ModOffline: config.ModOffline{ExpireAfter: 60}},
+		{Type: config.C2SServerType, Modules: map[string]struct{}{"offline": {}}, ModOffline: config.ModOffline{ExpireAfter: 3600}},
+		{Type: config.S2SServerType},
+	}
+	maxAge, ok := offlinePurgeAge()
+	assert.True(t, ok)
+	assert.Equal(t, maxAge, time.Hour)
+
+	// messages never expiring by age on any domain can't be purged
+	config.DefaultConfig.Servers[0].ModOffline.ExpireAfter = 0
+	maxAge, ok = offlinePurgeAge()
+	assert.True(t, ok)
+	assert.Equal(t, maxAge, time.Duration(0))
+
+	config.DefaultConfig.Servers = config.DefaultConfig.Servers[2:]
+	_, ok = offlinePurgeAge()
+	assert.False(t, ok)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/stream/errors"
+)
+
+const shutdownPollInterval = time.Millisecond * 50
+
+var (
+	serversMu sync.Mutex
+	servers   []*server
+)
+
+func registerServer(srv *server) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	servers = append(servers, srv)
+}
+
+// Shutdown stops accepting new connections and disconnects every
+// c2s stream with a 'system-shutdown' stream error, waiting at most
+// timeout for them to be closed.
+func Shutdown(timeout time.Duration) {
+	serversMu.Lock()
+	for _, srv := range servers {
+		srv.shutdown(timeout)
+	}
+	serversMu.Unlock()
+
+	strms := stream.C2S().Streams()
+	log.Infof("shutting down... (%d c2s streams)", len(strms))
+
+	deadline := time.Now().Add(timeout)
+	for _, strm := range strms {
+		// disconnection requests may block on already closing streams
+		go strm.Disconnect(streamerror.ErrSystemShutdown)
+	}
+	// wait until every stream has been unregistered
+	for len(stream.C2S().Streams()) > 0 {
+		if time.Now().After(deadline) {
+			log.Warnf("shutdown timeout expired while disconnecting c2s streams")
+			return
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+}
+
+func (s *server) shutdown(timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.shuttingDown = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.httpSrv != nil {
+		// let pending requests be answered once their streams get disconnected
+		go func(srv *http.Server) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			srv.Shutdown(ctx)
+		}(s.httpSrv)
+	}
+}
+
+// setListener binds ln to the server, returning false if the server
+// is already shutting down.
+func (s *server) setListener(ln net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.ln = ln
+	return true
+}
+
+// setHTTPServer binds srv to the server, returning false if the server
+// is already shutting down.
+func (s *server) setHTTPServer(srv *http.Server) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.httpSrv = srv
+	return true
+}
+
+func (s *server) isShuttingDown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shuttingDown
+}
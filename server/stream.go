@@ -6,6 +6,7 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/module"
@@ -42,6 +44,7 @@ const (
 
 const (
 	streamNamespace           = "http://etherx.jabber.org/streams"
+	framedStreamNamespace     = "urn:ietf:params:xml:ns:xmpp-framing"
 	tlsNamespace              = "urn:ietf:params:xml:ns:xmpp-tls"
 	compressProtocolNamespace = "http://jabber.org/protocol/compress"
 	bindNamespace             = "urn:ietf:params:xml:ns:xmpp-bind"
@@ -51,10 +54,12 @@ const (
 var (
 	errResourceNotFound = errors.New("resource not found")
 	errNotAuthenticated = errors.New("user not authenticated")
+	errConnectionLost   = errors.New("connection lost")
 )
 
 type serverStream struct {
 	lock          sync.RWMutex
+	srvCfg        *config.Server
 	cfg           *config.Server
 	connected     uint32
 	tr            transport.Transport
@@ -82,38 +87,61 @@ type serverStream struct {
 
 	register *module.XEPRegister
 	ping     *module.XEPPing
+	carbons  *module.XEPCarbons
+	mam      *module.XEPMessageArchive
 
 	offline     *module.ModOffline
 	offlineOnce sync.Once
 
-	writeCh chan xml.Element
-	readCh  chan xml.Element
-	discCh  chan error
+	sm   *streamMgmt
+	smID string
+
+	csi clientState
+
+	writeCh  chan xml.Element
+	readCh   chan xml.Element
+	discCh   chan error
+	resumeCh chan *streamResumption
 }
 
 func newSocketStream(id string, conn net.Conn, config *config.Server) *serverStream {
+	tr := transport.NewSocketTransport(conn, config.Transport.BufferSize, config.Transport.KeepAlive)
+
+	// direct TLS connection (XEP-0368)
+	_, secured := conn.(*tls.Conn)
+	return newStream(id, tr, secured, config)
+}
+
+func newWebSocketStream(id string, conn *websocket.Conn, config *config.Server) *serverStream {
+	tr := transport.NewWebSocketTransport(conn, config.Transport.KeepAlive)
+
+	// TLS is negotiated by the HTTP listener
+	_, secured := conn.UnderlyingConn().(*tls.Conn)
+	return newStream(id, tr, secured, config)
+}
+
+func newBOSHStream(id string, sess *boshSession, config *config.Server) *serverStream {
+	return newStream(id, sess, sess.secured, config)
+}
+
+func newStream(id string, tr transport.Transport, secured bool, config *config.Server) *serverStream {
 	s := &serverStream{
-		cfg:     config,
-		id:      id,
-		state:   connecting,
-		writeCh: make(chan xml.Element, 256),
-		readCh:  make(chan xml.Element),
-		discCh:  make(chan error),
+		srvCfg:   config,
+		cfg:      config,
+		id:       id,
+		tr:       tr,
+		secured:  secured,
+		state:    connecting,
+		writeCh:  make(chan xml.Element, 256),
+		readCh:   make(chan xml.Element),
+		discCh:   make(chan error),
+		resumeCh: make(chan *streamResumption),
 	}
 	// assign default domain
 	s.domain = stream.C2S().DefaultDomain()
 	s.jid, _ = xml.NewJID("", s.domain, "", true)
 
-	bufferSize := config.Transport.BufferSize
-	keepAlive := config.Transport.KeepAlive
-	s.tr = transport.NewSocketTransport(conn, bufferSize, keepAlive)
-	s.parser = xml.NewParser(s.tr)
-
-	// initialize authenticators
-	s.initializeAuthenticators()
-
-	// initialize XEPs
-	s.initializeXEPs()
+	s.parser = newStreamParser(s.tr, s.cfg)
 
 	if config.Transport.ConnectTimeout > 0 {
 		s.startConnectTimeoutTimer(config.Transport.ConnectTimeout)
@@ -183,6 +211,13 @@ func (s *serverStream) IsCompressed() bool {
 	return s.compressed
 }
 
+func (s *serverStream) IsCarbonsEnabled() bool {
+	if s.carbons != nil {
+		return s.carbons.IsEnabled()
+	}
+	return false
+}
+
 func (s *serverStream) IsRosterRequested() bool {
 	if s.roster != nil {
 		return s.roster.IsRequested()
@@ -197,6 +232,8 @@ func (s *serverStream) PresenceElements() []xml.Element {
 }
 
 func (s *serverStream) initializeAuthenticators() {
+	s.authrs = nil
+	s.activeAuthr = nil
 	for _, a := range s.cfg.SASL {
 		switch a {
 		case "plain":
@@ -210,11 +247,21 @@ func (s *serverStream) initializeAuthenticators() {
 		case "scram_sha_256":
 			s.authrs = append(s.authrs, newScram(s, s.tr, sha256ScramType, false))
 			s.authrs = append(s.authrs, newScram(s, s.tr, sha256ScramType, true))
+
+		case "external":
+			s.authrs = append(s.authrs, newExternalAuthenticator(s))
 		}
 	}
 }
 
 func (s *serverStream) initializeXEPs() {
+	s.iqHandlers = nil
+	s.register = nil
+	s.ping = nil
+	s.carbons = nil
+	s.mam = nil
+	s.offline = nil
+
 	// Roster (https://xmpp.org/rfcs/rfc3921.html#roster)
 	s.roster = module.NewRoster(s)
 	s.iqHandlers = append(s.iqHandlers, s.roster)
@@ -250,6 +297,18 @@ func (s *serverStream) initializeXEPs() {
 		s.iqHandlers = append(s.iqHandlers, s.ping)
 	}
 
+	// XEP-0280: Message Carbons (https://xmpp.org/extensions/xep-0280.html)
+	if _, ok := s.cfg.Modules["carbons"]; ok {
+		s.carbons = module.NewXEPCarbons(s)
+		s.iqHandlers = append(s.iqHandlers, s.carbons)
+	}
+
+	// XEP-0313: Message Archive Management (https://xmpp.org/extensions/xep-0313.html)
+	if _, ok := s.cfg.Modules["mam"]; ok {
+		s.mam = module.NewXEPMessageArchive(&s.cfg.ModMAM, s)
+		s.iqHandlers = append(s.iqHandlers, s.mam)
+	}
+
 	// register server disco info identities
 	identities := []module.DiscoIdentity{{
 		Category: "server",
@@ -284,6 +343,18 @@ func (s *serverStream) startConnectTimeoutTimer(timeoutInSeconds int) {
 }
 
 func (s *serverStream) handleElement(elem xml.Element) {
+	if s.tr.Type() == config.WebSocket && elem.Name() == "close" && elem.Namespace() == framedStreamNamespace {
+		s.disconnect(true)
+		return
+	}
+	// XEP-0198: Stream Management (https://xmpp.org/extensions/xep-0198.html)
+	if elem.Namespace() == streamMgmtNamespace && (s.state == authenticated || s.state == sessionStarted) && s.isStreamMgmtEnabled() {
+		s.handleStreamMgmt(elem)
+		return
+	}
+	if s.sm != nil && isStanza(elem) {
+		s.sm.inH++
+	}
 	switch s.state {
 	case connecting:
 		s.handleConnecting(elem)
@@ -309,10 +380,27 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 		s.disconnectWithStreamError(err)
 		return
 	}
-	// assign stream domain
-	s.lock.Lock()
-	s.domain = elem.To()
-	s.lock.Unlock()
+	if s.IsAuthenticated() {
+		// stream domain was bound on authentication
+		if to := elem.To(); len(to) > 0 && to != s.Domain() {
+			s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+			return
+		}
+	} else {
+		// assign stream domain
+		s.lock.Lock()
+		s.domain = elem.To()
+		s.lock.Unlock()
+
+		// apply stream domain settings
+		s.cfg = hostConfig(s.srvCfg, s.Domain())
+
+		// initialize authenticators
+		s.initializeAuthenticators()
+
+		// initialize XEPs
+		s.initializeXEPs()
+	}
 
 	// open stream
 	s.openStreamElement()
@@ -346,6 +434,10 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 				if athr.UsesChannelBinding() && !s.IsSecured() {
 					continue
 				}
+				// offer EXTERNAL mechanism only to clients presenting a valid certificate
+				if athr.Mechanism() == "EXTERNAL" && len(s.tr.PeerCertificates()) == 0 {
+					continue
+				}
 				mechanism := xml.NewElementName("mechanism")
 				mechanism.SetText(athr.Mechanism())
 				mechanisms.AppendElement(mechanism)
@@ -364,7 +456,7 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 
 	} else {
 		// attach compression feature
-		if !s.IsCompressed() && s.cfg.Compression != nil {
+		if !s.IsCompressed() && s.cfg.Compression != nil && !s.isFramedStream() {
 			compression := xml.NewElementNamespace("compression", "http://jabber.org/features/compress")
 			method := xml.NewElementName("method")
 			method.SetText("zlib")
@@ -377,6 +469,11 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 		bind := xml.NewElementNamespace("bind", "urn:ietf:params:xml:ns:xmpp-bind")
 		features.AppendElement(bind)
 
+		if s.isStreamMgmtEnabled() {
+			features.AppendElement(xml.NewElementNamespace("sm", streamMgmtNamespace))
+		}
+		features.AppendElement(xml.NewElementNamespace("csi", csiNamespace))
+
 		s.state = authenticated
 	}
 	s.writeElement(features)
@@ -470,14 +567,18 @@ func (s *serverStream) handleSessionStarted(elem xml.Element) {
 	if s.ping != nil {
 		s.ping.ResetDeadline()
 	}
-
+	// XEP-0352: Client State Indication (https://xmpp.org/extensions/xep-0352.html)
+	if elem.Namespace() == csiNamespace {
+		s.handleClientState(elem)
+		return
+	}
 	stanza, toJID, err := s.buildStanza(elem)
 	if err != nil {
 		s.handleElementError(elem, err)
 		return
 	}
 	if s.isComponentDomain(toJID.Domain()) {
-		s.processComponentStanza(stanza)
+		s.processComponentStanza(stanza, toJID)
 	} else {
 		s.processStanza(stanza)
 	}
@@ -488,7 +589,7 @@ func (s *serverStream) proceedStartTLS() {
 		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
 		return
 	}
-	cer, err := tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.PrivKeyFile)
+	cfg, err := tlsServerConfig(s.cfg.TLS, s.Domain())
 	if err != nil {
 		log.Error(err)
 		s.writeElement(xml.NewElementNamespace("failure", tlsNamespace))
@@ -497,10 +598,6 @@ func (s *serverStream) proceedStartTLS() {
 	}
 	s.writeElement(xml.NewElementNamespace("proceed", tlsNamespace))
 
-	cfg := &tls.Config{
-		ServerName:   s.Domain(),
-		Certificates: []tls.Certificate{cer},
-	}
 	s.tr.StartTLS(cfg)
 
 	s.lock.Lock()
@@ -513,7 +610,7 @@ func (s *serverStream) proceedStartTLS() {
 }
 
 func (s *serverStream) compress(elem xml.Element) {
-	if s.IsCompressed() {
+	if s.IsCompressed() || s.isFramedStream() {
 		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
 		return
 	}
@@ -670,18 +767,28 @@ func (s *serverStream) processStanza(element xml.Element) {
 	}
 }
 
-func (s *serverStream) processComponentStanza(element xml.Element) {
+func (s *serverStream) processComponentStanza(stanza xml.Element, to *xml.JID) {
+	if comp := stream.Components().Component(to.Domain()); comp != nil && comp.SendElement(stanza) {
+		return
+	}
+	// component is not connected at the moment
+	if expectsErrorReply(stanza) {
+		resp := xml.ToErrorElement(stanza, xml.ErrServiceUnavailable.(*xml.StanzaError))
+		resp.SetFrom(to.String())
+		resp.SetTo(s.JID().String())
+		s.writeElement(resp)
+	}
 }
 
 func (s *serverStream) processIQ(iq *xml.IQ) {
 	if !stream.C2S().IsLocalDomain(iq.ToJID().Domain()) {
-		// TODO(ortuman): Implement XMPP federation
+		s.routeRemote(iq, iq.ToJID())
 		return
 	}
 
 	toJid := iq.ToJID()
 	if toJid.IsFull() {
-		if err := s.sendElement(iq, toJid); err == errResourceNotFound {
+		if err := deliverLocal(iq, toJid, false); err == errResourceNotFound {
 			resp := iq.Copy()
 			resp.SetFrom(toJid.String())
 			resp.SetTo(s.JID().String())
@@ -705,8 +812,15 @@ func (s *serverStream) processIQ(iq *xml.IQ) {
 }
 
 func (s *serverStream) processPresence(presence *xml.Presence) {
+	if presence.Type() == xml.ProbeType {
+		return // presence probes are only generated by servers
+	}
 	if !stream.C2S().IsLocalDomain(presence.ToJID().Domain()) {
-		// TODO(ortuman): Implement XMPP federation
+		if presence.ToJID().IsBare() && s.roster != nil {
+			s.roster.ProcessPresence(presence)
+		} else {
+			s.routeRemote(presence, presence.ToJID())
+		}
 		return
 	}
 	toJid := presence.ToJID()
@@ -717,7 +831,7 @@ func (s *serverStream) processPresence(presence *xml.Presence) {
 		return
 	}
 	if toJid.IsFull() {
-		s.sendElement(presence, toJid)
+		deliverLocal(presence, toJid, false)
 		return
 	}
 
@@ -752,12 +866,27 @@ func (s *serverStream) processPresence(presence *xml.Presence) {
 }
 
 func (s *serverStream) processMessage(message *xml.Message) {
+	// XEP-0280: Message Carbons (https://xmpp.org/extensions/xep-0280.html)
+	// eligibility must be decided before stripping 'private' element
+	carbons := module.IsCarbonsEligible(message)
+	if carbons {
+		module.SendCarbons(message, s.JID(), true, s)
+	}
+	module.StripCarbonsPrivate(message)
+
+	// XEP-0313: Message Archive Management (https://xmpp.org/extensions/xep-0313.html)
+	if s.mam != nil {
+		module.ArchiveOutgoingMessage(&s.cfg.ModMAM, message)
+	}
 	if !stream.C2S().IsLocalDomain(message.ToJID().Domain()) {
-		// TODO(ortuman): Implement XMPP federation
+		s.routeRemote(message, message.ToJID())
 		return
 	}
+	if cfg := mamConfig(hostConfig(s.srvCfg, message.ToJID().Domain())); cfg != nil {
+		module.ArchiveIncomingMessage(cfg, message)
+	}
 
-	err := s.sendElement(message, message.ToJID())
+	err := deliverLocal(message, message.ToJID(), carbons)
 	switch err {
 	case errNotAuthenticated:
 		if s.offline != nil {
@@ -771,9 +900,21 @@ func (s *serverStream) processMessage(message *xml.Message) {
 	}
 }
 
+func (s *serverStream) routeRemote(stanza xml.Element, to *xml.JID) {
+	if err := stream.S2S().Route(stanza, s.Domain(), to.Domain()); err != nil {
+		log.Error(err)
+		if stanza.Type() != "error" {
+			resp := xml.ToErrorElement(stanza, xml.ErrRemoteServerNotFound.(*xml.StanzaError))
+			resp.SetFrom(to.String())
+			resp.SetTo(s.JID().String())
+			s.writeElement(resp)
+		}
+	}
+}
+
 func (s *serverStream) restart() {
 	s.state = connecting
-	s.parser = xml.NewParser(s.tr)
+	s.parser = newStreamParser(s.tr, s.cfg)
 }
 
 func (s *serverStream) loop() {
@@ -786,7 +927,7 @@ func (s *serverStream) loop() {
 
 		select {
 		case e := <-s.writeCh:
-			s.writeElement(e)
+			s.sendElement(e)
 
 		case e := <-s.readCh:
 			s.handleElement(e)
@@ -794,11 +935,28 @@ func (s *serverStream) loop() {
 				s.doRead() // keep reading transport...
 			}
 
+		case req := <-s.resumeCh:
+			s.handleResumption(req)
+
+		case <-s.resumeTimeoutCh():
+			log.Infof("stream resumption timeout... id: %s", s.id)
+			s.disconnect(false)
+
 		case err := <-s.discCh:
 			switch err {
 			case nil:
 				s.disconnect(false)
+			case errConnectionLost:
+				if s.isResumable() {
+					s.hibernate()
+				} else {
+					s.disconnect(false)
+				}
 			default:
+				if s.isHibernated() && err == streamerror.ErrConnectionTimeout {
+					// connection is already gone... keep waiting for resumption
+					break
+				}
 				if strmErr, ok := err.(*streamerror.Error); ok {
 					s.disconnectWithStreamError(strmErr)
 				} else {
@@ -820,24 +978,48 @@ func (s *serverStream) doRead() {
 			switch err {
 			case nil:
 				break
-			case io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+			case xml.ErrStreamClosedByPeer:
 				s.discCh <- nil
+			case io.EOF, io.ErrUnexpectedEOF:
+				s.discCh <- errConnectionLost
 			default:
+				if _, ok := err.(net.Error); ok {
+					log.Debugf("%v", err)
+					s.discCh <- errConnectionLost
+					return
+				}
 				log.Error(err)
-				s.discCh <- streamerror.ErrInvalidXML
+				if _, ok := err.(*xml.LimitError); ok {
+					s.discCh <- streamerror.ErrPolicyViolation
+				} else {
+					s.discCh <- streamerror.ErrInvalidXML
+				}
 			}
 		}
 	}()
 }
 
 func (s *serverStream) openStreamElement() {
-	ops := xml.NewElementName("stream:stream")
-	ops.SetAttribute("xmlns", s.streamDefaultNamespace())
-	ops.SetAttribute("xmlns:stream", streamNamespace)
+	var ops *xml.XElement
+	switch s.tr.Type() {
+	case config.BOSH:
+		// stream attributes are carried by BOSH session creation response
+		return
+	case config.WebSocket:
+		ops = xml.NewElementNamespace("open", framedStreamNamespace)
+	default:
+		ops = xml.NewElementName("stream:stream")
+		ops.SetAttribute("xmlns", s.streamDefaultNamespace())
+		ops.SetAttribute("xmlns:stream", streamNamespace)
+	}
 	ops.SetAttribute("id", uuid.New())
 	ops.SetAttribute("from", s.Domain())
 	ops.SetAttribute("version", "1.0")
 
+	if s.isFramedStream() {
+		s.writeElement(ops)
+		return
+	}
 	s.tr.Write([]byte(`<?xml version="1.0"?>`))
 	ops.ToXML(s.tr, false)
 }
@@ -889,14 +1071,22 @@ func (s *serverStream) handleElementError(elem xml.Element, err error) {
 }
 
 func (s *serverStream) validateStreamElement(elem xml.Element) *streamerror.Error {
-	if elem.Name() != "stream:stream" {
+	if s.tr.Type() == config.WebSocket {
+		if elem.Name() != "open" {
+			return streamerror.ErrUnsupportedStanzaType
+		}
+	} else if elem.Name() != "stream:stream" {
 		return streamerror.ErrUnsupportedStanzaType
 	}
 	to := elem.To()
 	if len(to) > 0 && !stream.C2S().IsLocalDomain(to) {
 		return streamerror.ErrHostUnknown
 	}
-	if elem.Namespace() != s.streamDefaultNamespace() || elem.Attribute("xmlns:stream") != streamNamespace {
+	if s.tr.Type() == config.WebSocket {
+		if elem.Namespace() != framedStreamNamespace {
+			return streamerror.ErrInvalidNamespace
+		}
+	} else if elem.Namespace() != s.streamDefaultNamespace() || elem.Attribute("xmlns:stream") != streamNamespace {
 		return streamerror.ErrInvalidNamespace
 	}
 	if elem.Version() != "1.0" {
@@ -952,7 +1142,7 @@ func (s *serverStream) isValidFrom(from string) bool {
 }
 
 func (s *serverStream) isComponentDomain(domain string) bool {
-	return false
+	return stream.Components().IsComponentDomain(domain)
 }
 
 func (s *serverStream) streamDefaultNamespace() string {
@@ -966,9 +1156,48 @@ func (s *serverStream) streamDefaultNamespace() string {
 	return ""
 }
 
+// isFramedStream returns whether or not each stream element
+// is sent as a standalone XML document (RFC 7395, XEP-0206).
+func (s *serverStream) isFramedStream() bool {
+	switch s.tr.Type() {
+	case config.WebSocket, config.BOSH:
+		return true
+	}
+	return false
+}
+
 func (s *serverStream) writeElement(elem xml.Element) {
+	if s.sm != nil {
+		if isStanza(elem) {
+			s.sm.enqueue(elem)
+			if len(s.sm.unacked) > streamMgmtMaxUnacked {
+				s.disconnectWithStreamError(streamerror.ErrResourceConstraint)
+				return
+			}
+		}
+		if s.sm.hibernated {
+			return // sent once resumed
+		}
+	}
+	s.doWrite(elem)
+
+	if s.sm != nil && s.sm.shouldRequestAck() {
+		s.sm.ackRequested = true
+		s.doWrite(xml.NewElementNamespace("r", streamMgmtNamespace))
+	}
+}
+
+func (s *serverStream) doWrite(elem xml.Element) {
+	if s.isFramedStream() {
+		elem = framedElement(elem)
+	}
 	log.Debugf("SEND: %v", elem)
-	elem.ToXML(s.tr, true)
+
+	// serialize whole element before writing it, so that
+	// framed transports can send it as a single message
+	buf := &bytes.Buffer{}
+	elem.ToXML(buf, true)
+	s.tr.Write(buf.Bytes())
 }
 
 func (s *serverStream) disconnectWithStreamError(err *streamerror.Error) {
@@ -987,18 +1216,28 @@ func (s *serverStream) disconnect(closeStream bool) {
 	if available && s.roster != nil {
 		s.roster.BroadcastPresence(xml.NewPresence(s.JID(), s.JID(), xml.UnavailableType))
 	}
-	if closeStream {
-		s.tr.Write([]byte("</stream:stream>"))
+	if closeStream && !s.isHibernated() {
+		switch s.tr.Type() {
+		case config.BOSH:
+			// session termination is notified on transport close
+			break
+		case config.WebSocket:
+			s.writeElement(xml.NewElementNamespace("close", framedStreamNamespace))
+		default:
+			s.tr.Write([]byte("</stream:stream>"))
+		}
 	}
 	s.tr.Close()
 
 	s.state = disconnected
 
 	stream.C2S().UnregisterStream(s)
+
+	s.releaseStreamMgmt()
 }
 
 func (s *serverStream) isResourceAvailable(resource string) bool {
-	strms := stream.C2S().AvailableStreams(s.Username())
+	strms := stream.C2S().AvailableStreams(s.JID())
 	for _, strm := range strms {
 		if strm.Resource() == resource {
 			return false
@@ -1007,8 +1246,33 @@ func (s *serverStream) isResourceAvailable(resource string) bool {
 	return true
 }
 
-func (s *serverStream) sendElement(serializable xml.Element, to *xml.JID) error {
-	recipients := stream.C2S().AvailableStreams(to.Node())
+// framedElement qualifies a stream level element so that
+// it can be parsed as a standalone XML document.
+func framedElement(elem xml.Element) xml.Element {
+	var label, namespace string
+	switch elem.Name() {
+	case "iq", "presence", "message":
+		label, namespace = "xmlns", jabberClientNamespace
+	case "stream:features", "stream:error":
+		label, namespace = "xmlns:stream", streamNamespace
+	default:
+		return elem
+	}
+	if len(elem.Attribute(label)) > 0 {
+		return elem
+	}
+	attrs := append([]xml.Attribute{{Label: label, Value: namespace}}, elem.Attributes()...)
+	ret := xml.NewElementAttributes(elem.Name(), attrs)
+	ret.SetText(elem.Text())
+	ret.AppendElements(elem.Elements())
+	return ret
+}
+
+// deliverLocal sends a stanza to the local streams bound to 'to' JID.
+// If carbons is set, a 'received' carbon copy of the delivered message
+// is sent to the rest of recipient user resources.
+func deliverLocal(serializable xml.Element, to *xml.JID, carbons bool) error {
+	recipients := stream.C2S().AvailableStreams(to)
 	if len(recipients) == 0 {
 		return errNotAuthenticated
 	}
@@ -1016,6 +1280,9 @@ func (s *serverStream) sendElement(serializable xml.Element, to *xml.JID) error
 		for _, strm := range recipients {
 			if strm.Resource() == to.Resource() {
 				strm.SendElement(serializable)
+				if carbons {
+					sendReceivedCarbons(serializable, strm)
+				}
 				return nil
 			}
 		}
@@ -1033,6 +1300,9 @@ func (s *serverStream) sendElement(serializable xml.Element, to *xml.JID) error
 				}
 			}
 			strm.SendElement(serializable)
+			if carbons {
+				sendReceivedCarbons(serializable, strm)
+			}
 
 		default:
 			// broadcast to all streams
@@ -1043,3 +1313,11 @@ func (s *serverStream) sendElement(serializable xml.Element, to *xml.JID) error
 	}
 	return nil
 }
+
+// sendReceivedCarbons delivers a 'received' carbon copy of a message
+// to the rest of recipient user resources.
+func sendReceivedCarbons(stanza xml.Element, recipient stream.C2SStream) {
+	if message, ok := stanza.(*xml.Message); ok {
+		module.SendCarbons(message, recipient.JID(), false, recipient)
+	}
+}
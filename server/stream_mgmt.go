@@ -0,0 +1,332 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const streamMgmtNamespace = "urn:xmpp:sm:3"
+
+const stanzasNamespace = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+const (
+	// number of unacknowledged stanzas after which an acknowledgement is requested
+	streamMgmtAckRequestThreshold = 5
+
+	// maximum number of stanzas pending to be acknowledged by the client
+	streamMgmtMaxUnacked = 1000
+)
+
+// streamMgmt holds the XEP-0198 Stream Management state of a stream.
+type streamMgmt struct {
+	resumable    bool
+	inH          uint32 // stanzas handled from the client
+	outH         uint32 // stanzas sent to the client
+	unacked      []xml.Element
+	ackRequested bool
+
+	// a hibernated stream lost its connection, waiting to be resumed
+	hibernated bool
+	resumeTm   *time.Timer
+
+	pendingResumption *streamResumption
+}
+
+// streamResumption hands over a newly established connection
+// to the stream being resumed.
+type streamResumption struct {
+	tr         transport.Transport
+	parser     *xml.Parser
+	secured    bool
+	compressed bool
+	h          uint32
+	resultCh   chan bool
+}
+
+func (sm *streamMgmt) enqueue(stanza xml.Element) {
+	sm.outH++
+	sm.unacked = append(sm.unacked, stanza)
+}
+
+// ack removes stanzas acknowledged by the client,
+// returning false if h exceeds the number of sent stanzas.
+func (sm *streamMgmt) ack(h uint32) bool {
+	if !sm.isValidAck(h) {
+		return false
+	}
+	sm.unacked = sm.unacked[sm.acked(h):]
+	sm.ackRequested = false
+	return true
+}
+
+func (sm *streamMgmt) isValidAck(h uint32) bool {
+	return sm.acked(h) <= uint32(len(sm.unacked))
+}
+
+// acked returns the number of pending stanzas acknowledged by h.
+func (sm *streamMgmt) acked(h uint32) uint32 {
+	return h - (sm.outH - uint32(len(sm.unacked)))
+}
+
+func (sm *streamMgmt) shouldRequestAck() bool {
+	return !sm.hibernated && !sm.ackRequested && len(sm.unacked) >= streamMgmtAckRequestThreshold
+}
+
+func (s *serverStream) isStreamMgmtEnabled() bool {
+	_, ok := s.cfg.Modules["stream_mgmt"]
+	return ok && s.tr.Type() != config.BOSH
+}
+
+func (s *serverStream) isResumable() bool {
+	return s.sm != nil && s.sm.resumable
+}
+
+func (s *serverStream) isHibernated() bool {
+	return s.sm != nil && s.sm.hibernated
+}
+
+func (s *serverStream) resumptionID() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.smID
+}
+
+func (s *serverStream) resumeTimeoutCh() <-chan time.Time {
+	if s.sm == nil || s.sm.resumeTm == nil {
+		return nil
+	}
+	return s.sm.resumeTm.C
+}
+
+func (s *serverStream) handleStreamMgmt(elem xml.Element) {
+	switch elem.Name() {
+	case "enable":
+		s.enableStreamMgmt(elem)
+
+	case "resume":
+		s.resumeStream(elem)
+
+	case "r":
+		if s.sm == nil {
+			s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+			return
+		}
+		a := xml.NewElementNamespace("a", streamMgmtNamespace)
+		a.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inH), 10))
+		s.doWrite(a)
+
+	case "a":
+		if s.sm == nil {
+			s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+			return
+		}
+		h, err := strconv.ParseUint(elem.Attribute("h"), 10, 32)
+		if err != nil || !s.sm.ack(uint32(h)) {
+			s.disconnectWithStreamError(streamerror.ErrUndefinedCondition)
+		}
+
+	default:
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+	}
+}
+
+func (s *serverStream) enableStreamMgmt(elem xml.Element) {
+	if s.sm != nil || len(s.Resource()) == 0 {
+		s.failStreamMgmt("unexpected-request")
+		return
+	}
+	s.sm = &streamMgmt{}
+
+	enabled := xml.NewElementNamespace("enabled", streamMgmtNamespace)
+	resume := elem.Attribute("resume")
+	if timeout := s.cfg.ModStreamMgmt.ResumeTimeout; (resume == "true" || resume == "1") && timeout > 0 {
+		s.sm.resumable = true
+
+		s.lock.Lock()
+		s.smID = uuid.New()
+		s.lock.Unlock()
+
+		enabled.SetAttribute("id", s.resumptionID())
+		enabled.SetAttribute("resume", "true")
+		enabled.SetAttribute("max", strconv.Itoa(timeout))
+	}
+	s.doWrite(enabled)
+
+	log.Infof("enabled stream management... id: %s", s.id)
+}
+
+// resumeStream hands over current connection to the previous
+// session identified by 'previd', whenever it can be resumed.
+func (s *serverStream) resumeStream(elem xml.Element) {
+	if s.sm != nil || len(s.Resource()) > 0 {
+		s.failStreamMgmt("unexpected-request")
+		return
+	}
+	h, err := strconv.ParseUint(elem.Attribute("h"), 10, 32)
+	if err != nil {
+		s.failStreamMgmt("bad-request")
+		return
+	}
+	strm := s.resumableStream(elem.Attribute("previd"))
+	if strm == nil {
+		s.failStreamMgmt("item-not-found")
+		return
+	}
+	req := &streamResumption{
+		tr:         s.tr,
+		parser:     s.parser,
+		secured:    s.IsSecured(),
+		compressed: s.IsCompressed(),
+		h:          uint32(h),
+		resultCh:   make(chan bool, 1),
+	}
+	select {
+	case strm.resumeCh <- req:
+		// every resumption request is eventually answered
+		if <-req.resultCh {
+			// connection belongs to resumed stream from now on
+			s.state = disconnected
+			stream.C2S().UnregisterStream(s)
+			return
+		}
+	case <-time.After(time.Second):
+		break
+	}
+	s.failStreamMgmt("item-not-found")
+}
+
+func (s *serverStream) resumableStream(id string) *serverStream {
+	if len(id) == 0 {
+		return nil
+	}
+	for _, strm := range stream.C2S().AvailableStreams(s.JID()) {
+		if ss, ok := strm.(*serverStream); ok && ss != s && ss.resumptionID() == id {
+			return ss
+		}
+	}
+	return nil
+}
+
+// handleResumption attaches a resumption request connection to the stream.
+// If the stream connection has not been released yet, the request
+// is held until the connection gets closed.
+func (s *serverStream) handleResumption(req *streamResumption) {
+	if !s.isResumable() || !s.sm.isValidAck(req.h) {
+		req.resultCh <- false
+		return
+	}
+	if !s.sm.hibernated {
+		if pending := s.sm.pendingResumption; pending != nil {
+			pending.resultCh <- false
+		}
+		s.sm.pendingResumption = req
+		s.tr.Close()
+		return
+	}
+	s.resume(req)
+}
+
+func (s *serverStream) resume(req *streamResumption) {
+	if s.sm.resumeTm != nil {
+		s.sm.resumeTm.Stop()
+		s.sm.resumeTm = nil
+	}
+	s.tr = req.tr
+	s.parser = req.parser
+
+	s.lock.Lock()
+	s.secured = req.secured
+	s.compressed = req.compressed
+	s.lock.Unlock()
+
+	s.sm.hibernated = false
+	s.sm.ack(req.h)
+
+	resumed := xml.NewElementNamespace("resumed", streamMgmtNamespace)
+	resumed.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inH), 10))
+	resumed.SetAttribute("previd", s.resumptionID())
+	s.doWrite(resumed)
+
+	// retransmit stanzas not handled by the client
+	for _, stanza := range s.sm.unacked {
+		s.doWrite(stanza)
+	}
+	req.resultCh <- true
+
+	log.Infof("resumed stream... id: %s", s.id)
+
+	s.doRead() // start reading new transport...
+}
+
+// hibernate keeps the session of a stream whose connection has been lost,
+// so that it can be resumed before resumption timeout expires.
+func (s *serverStream) hibernate() {
+	s.tr.Close()
+	s.sm.hibernated = true
+
+	if req := s.sm.pendingResumption; req != nil {
+		s.sm.pendingResumption = nil
+		s.resume(req)
+		return
+	}
+	s.sm.resumeTm = time.NewTimer(time.Second * time.Duration(s.cfg.ModStreamMgmt.ResumeTimeout))
+
+	log.Infof("hibernated stream... id: %s", s.id)
+}
+
+// releaseStreamMgmt redelivers unacknowledged messages of a terminated stream
+// to another available resource, storing them offline otherwise.
+func (s *serverStream) releaseStreamMgmt() {
+	if s.sm == nil {
+		return
+	}
+	if req := s.sm.pendingResumption; req != nil {
+		s.sm.pendingResumption = nil
+		req.resultCh <- false
+	}
+	if s.sm.resumeTm != nil {
+		s.sm.resumeTm.Stop()
+		s.sm.resumeTm = nil
+	}
+	unacked := s.sm.unacked
+	s.sm.unacked = nil
+
+	// carbon copies were already sent on first delivery
+	bareJID := s.JID().ToBareJID()
+	for _, elem := range unacked {
+		message, ok := elem.(*xml.Message)
+		if !ok {
+			continue
+		}
+		if err := deliverLocal(message, bareJID, false); err == errNotAuthenticated && s.offline != nil {
+			s.offline.ArchiveMessage(message)
+		}
+	}
+}
+
+func (s *serverStream) failStreamMgmt(condition string) {
+	failed := xml.NewElementNamespace("failed", streamMgmtNamespace)
+	failed.AppendElement(xml.NewElementNamespace(condition, stanzasNamespace))
+	s.doWrite(failed)
+}
+
+func isStanza(elem xml.Element) bool {
+	switch elem.Name() {
+	case "iq", "presence", "message":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamMgmtAck(t *testing.T) {
+	sm := &streamMgmt{}
+	for i := 0; i < streamMgmtAckRequestThreshold; i++ {
+		assert.False(t, sm.shouldRequestAck())
+		sm.enqueue(xml.NewElementName("message"))
+	}
+	assert.True(t, sm.shouldRequestAck())
+	sm.ackRequested = true
+	assert.False(t, sm.shouldRequestAck())
+
+	assert.True(t, sm.ack(2))
+	assert.Equal(t, len(sm.unacked), 3)
+	assert.False(t, sm.ackRequested)
+
+	// already acknowledged stanzas
+	assert.False(t, sm.isValidAck(1))
+
+	// acknowledging unsent stanzas
+	assert.False(t, sm.ack(6))
+	assert.Equal(t, len(sm.unacked), 3)
+
+	assert.True(t, sm.ack(5))
+	assert.Equal(t, len(sm.unacked), 0)
+	assert.Equal(t, sm.outH, uint32(5))
+}
+
+func TestStreamMgmtResume(t *testing.T) {
+	defer setupTestStreams("romeo")()
+
+	cfg := newTestStreamConfig()
+	cfg.Modules["stream_mgmt"] = struct{}{}
+	cfg.ModStreamMgmt.ResumeTimeout = 60
+
+	s1, c1 := newTestStream(t, cfg)
+	c1.bind("romeo", "orchard")
+	previd := enableTestStreamMgmt(c1)
+
+	to := s1.JID()
+	deliverLocal(newTestStreamMessage(to, "m1"), to, false)
+	assert.Equal(t, c1.receive().Name(), "message")
+
+	// connection lost... stream gets hibernated
+	c1.conn.Close()
+	deliverLocal(newTestStreamMessage(to, "m2"), to, false)
+	assert.Equal(t, stream.C2S().AvailableStreams(to), []stream.C2SStream{s1})
+
+	_, c2 := newTestStream(t, cfg)
+	c2.openStream("jackal.im")
+	c2.authenticate("romeo", "1234")
+	c2.openStream("jackal.im")
+	c2.send(`<resume xmlns="urn:xmpp:sm:3" h="1" previd="` + previd + `"/>`)
+
+	resumed := c2.receive()
+	assert.Equal(t, resumed.Name(), "resumed")
+	assert.Equal(t, resumed.Attribute("previd"), previd)
+	assert.Equal(t, resumed.Attribute("h"), "0")
+
+	// stanzas not acknowledged before losing connection get retransmitted
+	m := c2.receive()
+	assert.Equal(t, m.Name(), "message")
+	assert.Equal(t, m.FindElement("body").Text(), "m2")
+
+	// connection now belongs to resumed stream
+	c2.send(`<r xmlns="urn:xmpp:sm:3"/>`)
+	a := c2.receive()
+	assert.Equal(t, a.Name(), "a")
+	assert.Equal(t, a.Attribute("h"), "0")
+
+	// unknown resumption id
+	_, c3 := newTestStream(t, cfg)
+	c3.openStream("jackal.im")
+	c3.authenticate("romeo", "1234")
+	c3.openStream("jackal.im")
+	c3.send(`<resume xmlns="urn:xmpp:sm:3" h="0" previd="8d2e1b43"/>`)
+	failed := c3.receive()
+	assert.Equal(t, failed.Name(), "failed")
+	assert.NotNil(t, failed.FindElement("item-not-found"))
+
+	c2.close()
+	c3.close()
+}
+
+func TestStreamMgmtPendingResumption(t *testing.T) {
+	defer setupTestStreams("juliet")()
+
+	cfg := newTestStreamConfig()
+	cfg.Modules["stream_mgmt"] = struct{}{}
+	cfg.ModStreamMgmt.ResumeTimeout = 60
+
+	s1, c1 := newTestStream(t, cfg)
+	c1.bind("juliet", "balcony")
+	previd := enableTestStreamMgmt(c1)
+
+	to := s1.JID()
+	deliverLocal(newTestStreamMessage(to, "m1"), to, false)
+	assert.Equal(t, c1.receive().Name(), "message")
+
+	// stream is resumed before its connection is known to be lost
+	_, c2 := newTestStream(t, cfg)
+	c2.openStream("jackal.im")
+	c2.authenticate("juliet", "1234")
+	c2.openStream("jackal.im")
+	c2.send(`<resume xmlns="urn:xmpp:sm:3" h="0" previd="` + previd + `"/>`)
+
+	resumed := c2.receive()
+	assert.Equal(t, resumed.Name(), "resumed")
+	assert.Equal(t, resumed.Attribute("previd"), previd)
+
+	m := c2.receive()
+	assert.Equal(t, m.Name(), "message")
+	assert.Equal(t, m.FindElement("body").Text(), "m1")
+
+	// previous connection is released
+	assert.True(t, c1.isClosed())
+	c2.close()
+}
+
+func TestStreamMgmtRelease(t *testing.T) {
+	defer setupTestStreams("mercutio")()
+
+	cfg := newTestStreamConfig()
+	cfg.Modules["stream_mgmt"] = struct{}{}
+	cfg.Modules["offline"] = struct{}{}
+	cfg.ModStreamMgmt.ResumeTimeout = 1
+	cfg.ModOffline.QueueSize = 10
+
+	s1, c1 := newTestStream(t, cfg)
+	c1.bind("mercutio", "street")
+	enableTestStreamMgmt(c1)
+
+	to := s1.JID()
+	deliverLocal(newTestStreamMessage(to, "m1"), to, false)
+	deliverLocal(newTestStreamMessage(to, "m2"), to, false)
+	assert.Equal(t, c1.receive().Name(), "message")
+	assert.Equal(t, c1.receive().Name(), "message")
+
+	c1.send(`<a xmlns="urn:xmpp:sm:3" h="1"/>`)
+	c1.conn.Close()
+
+	// unacknowledged messages are stored offline once resumption times out
+	var msgs []storage.OfflineMessage
+	for i := 0; i < 50 && len(msgs) == 0; i++ {
+		time.Sleep(time.Millisecond * 100)
+		msgs, _ = storage.Instance().FetchOfflineMessages("mercutio")
+	}
+	assert.Equal(t, len(msgs), 1)
+	if len(msgs) == 1 {
+		assert.Equal(t, msgs[0].Message.FindElement("body").Text(), "m2")
+	}
+	assert.Equal(t, len(stream.C2S().AvailableStreams(to)), 0)
+}
+
+func enableTestStreamMgmt(c *testStreamClient) (resumptionID string) {
+	c.send(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`)
+	enabled := c.receive()
+	if enabled.Name() != "enabled" {
+		c.t.Fatalf("stream management not enabled: %v", enabled)
+	}
+	return enabled.Attribute("id")
+}
+
+func newTestStreamMessage(to *xml.JID, text string) *xml.Message {
+	from, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	body := xml.NewElementName("body")
+	body.SetText(text)
+	elem := xml.NewElementName("message")
+	elem.SetType(xml.ChatType)
+	elem.AppendElement(body)
+	m, _ := xml.NewMessageFromElement(elem, from, to)
+	return m
+}
@@ -0,0 +1,329 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/concurrent"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamRestartDomain(t *testing.T) {
+	defer setupTestStreams("ortuman")()
+
+	_, c := newTestStream(t, newTestStreamConfig())
+	c.openStream("jackal.im")
+	c.authenticate("ortuman", "1234")
+
+	// authenticated stream restarted against another local domain
+	c.send(streamHeader("jackal.net"))
+	header := c.receive()
+	assert.Equal(t, header.Name(), "stream:stream")
+	assert.Equal(t, header.From(), "jackal.im")
+
+	streamErr := c.receive()
+	assert.Equal(t, streamErr.Name(), "stream:error")
+	assert.NotNil(t, streamErr.FindElement("host-unknown"))
+
+	_, c = newTestStream(t, newTestStreamConfig())
+	c.openStream("jackal.im")
+	c.authenticate("ortuman", "1234")
+
+	c.send(streamHeader("jackal.im"))
+	header = c.receive()
+	assert.Equal(t, header.From(), "jackal.im")
+	assert.NotNil(t, c.receive().FindElement("bind"))
+	c.close()
+}
+
+func TestStreamDomainIsolation(t *testing.T) {
+	defer setupTestStreams("noelia")()
+
+	s1, c1 := newTestStream(t, newTestStreamConfig())
+	c1.openStream("jackal.im")
+	c1.authenticate("noelia", "1234")
+
+	s2, c2 := newTestStream(t, newTestStreamConfig())
+	c2.openStream("jackal.net")
+	c2.authenticate("noelia", "1234")
+
+	j1, _ := xml.NewJID("noelia", "jackal.im", "", true)
+	j2, _ := xml.NewJID("noelia", "jackal.net", "balcony", true)
+	assert.Equal(t, stream.C2S().AvailableStreams(j1), []stream.C2SStream{s1})
+	assert.Equal(t, stream.C2S().AvailableStreams(j2), []stream.C2SStream{s2})
+
+	stream.C2S().UnregisterStream(s1)
+	assert.Equal(t, len(stream.C2S().AvailableStreams(j1)), 0)
+	assert.Equal(t, stream.C2S().AvailableStreams(j2), []stream.C2SStream{s2})
+	stream.C2S().UnregisterStream(s2)
+}
+
+func TestStreamCarbonsPrivate(t *testing.T) {
+	defer setupTestStreams("romeo", "juliet")()
+
+	cfg := newTestStreamConfig()
+	cfg.Modules["carbons"] = struct{}{}
+
+	_, from := newTestStream(t, cfg)
+	from.bind("romeo", "orchard")
+
+	_, to := newTestStream(t, cfg)
+	to.bind("juliet", "balcony")
+
+	_, cc := newTestStream(t, cfg)
+	cc.bind("juliet", "garden")
+	cc.send(`<iq type="set" id="cc_1" to="jackal.im"><enable xmlns="urn:xmpp:carbons:2"/></iq>`)
+	assert.Equal(t, cc.receive().Type(), xml.ResultType)
+
+	from.send(`<message type="chat" to="juliet@jackal.im/balcony"><body>m1</body><private xmlns="urn:xmpp:carbons:2"/></message>`)
+	from.send(`<message type="chat" to="juliet@jackal.im/balcony"><body>m2</body></message>`)
+
+	m1 := to.receive()
+	assert.Equal(t, m1.FindElement("body").Text(), "m1")
+	assert.Nil(t, m1.FindElementNamespace("private", "urn:xmpp:carbons:2"))
+	assert.Equal(t, to.receive().FindElement("body").Text(), "m2")
+
+	// private message is not copied to the rest of recipient resources
+	received := cc.receive().FindElementNamespace("received", "urn:xmpp:carbons:2")
+	assert.NotNil(t, received)
+	if received != nil {
+		m := received.FindElement("forwarded").FindElement("message")
+		assert.Equal(t, m.FindElement("body").Text(), "m2")
+	}
+	from.close()
+	to.close()
+	cc.close()
+}
+
+func TestStreamMessageArchive(t *testing.T) {
+	defer setupTestStreams("romeo", "juliet")()
+
+	cfg := newTestStreamConfig()
+	cfg.Modules["mam"] = struct{}{}
+	cfg.ModMAM.Default = "always"
+
+	_, from := newTestStream(t, cfg)
+	from.bind("romeo", "orchard")
+
+	_, to := newTestStream(t, cfg)
+	to.bind("juliet", "balcony")
+
+	from.send(`<message type="chat" to="juliet@jackal.im/balcony"><body>hi</body></message>`)
+	stanzaID := to.receive().FindElementNamespace("stanza-id", "urn:xmpp:sid:0")
+	assert.NotNil(t, stanzaID)
+
+	assert.True(t, concurrent.WaitPendingOperations(time.Second*5))
+	msgs, _, _ := storage.Instance().FetchArchivedMessages("juliet", &storage.ArchiveQuery{})
+	assert.Equal(t, len(msgs), 1)
+	if len(msgs) == 1 && stanzaID != nil {
+		assert.Equal(t, msgs[0].ID, stanzaID.Attribute("id"))
+		assert.Equal(t, msgs[0].Peer, "romeo@jackal.im/orchard")
+	}
+	msgs, _, _ = storage.Instance().FetchArchivedMessages("romeo", &storage.ArchiveQuery{})
+	assert.Equal(t, len(msgs), 1)
+
+	from.close()
+	to.close()
+}
+
+func TestStreamMessageNotArchived(t *testing.T) {
+	defer setupTestStreams("tybalt", "mercutio")()
+
+	cfg := newTestStreamConfig()
+	cfg.Modules["mam"] = struct{}{}
+	cfg.ModMAM.Default = "always"
+	storage.Instance().InsertOrUpdateArchivePrefs(&storage.ArchivePrefs{Username: "mercutio", Default: "never"})
+
+	_, from := newTestStream(t, cfg)
+	from.bind("tybalt", "street")
+
+	_, to := newTestStream(t, cfg)
+	to.bind("mercutio", "street")
+
+	// messages not archived by recipient carry no archive identifier
+	from.send(`<message type="chat" to="mercutio@jackal.im/street"><body>hi</body></message>`)
+	assert.Nil(t, to.receive().FindElementNamespace("stanza-id", "urn:xmpp:sid:0"))
+
+	assert.True(t, concurrent.WaitPendingOperations(time.Second*5))
+	msgs, _, _ := storage.Instance().FetchArchivedMessages("mercutio", &storage.ArchiveQuery{})
+	assert.Equal(t, len(msgs), 0)
+	msgs, _, _ = storage.Instance().FetchArchivedMessages("tybalt", &storage.ArchiveQuery{})
+	assert.Equal(t, len(msgs), 1)
+
+	from.close()
+	to.close()
+}
+
+// setupTestStreams configures local domains and an in-memory storage
+// holding the test users, returning a function that restores previous settings.
+func setupTestStreams(usernames ...string) func() {
+	c2s := config.DefaultConfig.C2S
+	config.DefaultConfig.C2S = config.C2S{Domains: []string{"jackal.im", "jackal.net"}}
+
+	s := storage.NewMemoryStorage()
+	for _, username := range usernames {
+		s.InsertOrUpdateUser(&storage.User{Username: username, Password: "1234"})
+	}
+	storage.Set(s)
+
+	return func() {
+		config.DefaultConfig.C2S = c2s
+	}
+}
+
+func newTestStreamConfig() *config.Server {
+	return &config.Server{
+		ID:        "c2s",
+		Type:      config.C2SServerType,
+		SASL:      []string{"plain"},
+		Modules:   map[string]struct{}{},
+		Transport: config.Transport{BufferSize: 4096, KeepAlive: 60},
+	}
+}
+
+// testStreamClient is the client side of a stream served over a loopback connection.
+type testStreamClient struct {
+	t      *testing.T
+	conn   net.Conn
+	recvCh chan xml.Element
+}
+
+func newTestStream(t *testing.T, cfg *config.Server) (*serverStream, *testStreamClient) {
+	srvConn, c := newTestConn(t)
+	return newSocketStream("c2s:test", srvConn, cfg), c
+}
+
+// newTestConn returns the server side of a loopback connection, along with its client.
+func newTestConn(t *testing.T) (net.Conn, *testStreamClient) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cliConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testStreamClient{t: t, conn: cliConn, recvCh: make(chan xml.Element, 256)}
+
+	// keep reading so that the stream never blocks writing
+	go func() {
+		defer close(c.recvCh)
+		p := xml.NewParser(cliConn)
+		for {
+			elem, err := p.ParseElement()
+			if err != nil {
+				return
+			}
+			c.recvCh <- elem
+		}
+	}()
+	return srvConn, c
+}
+
+func (c *testStreamClient) send(s string) {
+	c.conn.Write([]byte(s))
+}
+
+func (c *testStreamClient) sendElement(elem xml.Element) {
+	c.send(elem.String())
+}
+
+func (c *testStreamClient) receive() xml.Element {
+	select {
+	case elem, ok := <-c.recvCh:
+		if !ok {
+			c.t.Fatal("stream connection closed")
+		}
+		return elem
+	case <-time.After(time.Second * 5):
+		c.t.Fatal("timed out waiting for stream element")
+	}
+	return nil
+}
+
+// isClosed reports whether the stream connection gets closed,
+// discarding any other element sent through it.
+func (c *testStreamClient) isClosed() bool {
+	for {
+		select {
+		case _, ok := <-c.recvCh:
+			if !ok {
+				return true
+			}
+		case <-time.After(time.Second * 5):
+			return false
+		}
+	}
+}
+
+// close gracefully closes the stream, waiting for its connection to be released.
+func (c *testStreamClient) close() {
+	c.send("</stream:stream>")
+	if !c.isClosed() {
+		c.t.Fatal("stream connection not closed")
+	}
+}
+
+func (c *testStreamClient) openStream(domain string) (features xml.Element) {
+	c.send(streamHeader(domain))
+	for {
+		elem := c.receive()
+		if elem.Name() == "stream:features" {
+			return elem
+		}
+	}
+}
+
+func (c *testStreamClient) authenticate(username, password string) {
+	auth := xml.NewElementNamespace("auth", saslNamespace)
+	auth.SetAttribute("mechanism", "PLAIN")
+	auth.SetText(base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password)))
+	c.sendElement(auth)
+	if elem := c.receive(); elem.Name() != "success" {
+		c.t.Fatalf("authentication failed: %v", elem)
+	}
+}
+
+// bind authenticates and binds a resource, leaving stream session started.
+func (c *testStreamClient) bind(username, resource string) {
+	c.openStream("jackal.im")
+	c.authenticate(username, "1234")
+	c.openStream("jackal.im")
+
+	res := xml.NewElementName("resource")
+	res.SetText(resource)
+	bind := xml.NewElementNamespace("bind", bindNamespace)
+	bind.AppendElement(res)
+	iq := xml.NewIQType("bind_1", xml.SetType)
+	iq.AppendElement(bind)
+	c.sendElement(iq)
+	if elem := c.receive(); elem.Type() != xml.ResultType {
+		c.t.Fatalf("resource binding failed: %v", elem)
+	}
+	c.send(`<iq type="set" id="sess_1"><session xmlns="urn:ietf:params:xml:ns:xmpp-session"/></iq>`)
+	if elem := c.receive(); elem.Type() != xml.ResultType {
+		c.t.Fatalf("session not started: %v", elem)
+	}
+}
+
+func streamHeader(domain string) string {
+	return fmt.Sprintf(`<?xml version="1.0"?><stream:stream xmlns="%s" xmlns:stream="%s" to="%s" version="1.0">`,
+		jabberClientNamespace, streamNamespace, domain)
+}
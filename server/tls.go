@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+)
+
+var errNoCertificate = errors.New("tls: no certificate configured")
+
+// tlsServerConfig returns the TLS configuration used to secure incoming streams.
+// Client certificates are requested and verified against configured CA bundles.
+// serverName certificate is served to clients not making use of SNI.
+func tlsServerConfig(cfg *config.TLS, serverName string) (*tls.Config, error) {
+	certs, err := certificateStoreFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		ServerName: serverName,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if len(hello.ServerName) > 0 {
+				return certs.certificate(hello.ServerName)
+			}
+			return certs.certificate(serverName)
+		},
+	}
+	if len(cfg.CAFiles) > 0 {
+		pool, err := loadCertPool(cfg.CAFiles)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsCfg, nil
+}
+
+// tlsClientConfig returns the TLS configuration used to secure outgoing streams,
+// verifying that the remote server certificate identifies serverName.
+// Peer certificates are checked against system CAs, along with configured CA bundles.
+func tlsClientConfig(cfg *config.TLS, serverName string) (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if cfg != nil {
+		if err := appendCertPool(roots, cfg.CAFiles); err != nil {
+			return nil, err
+		}
+	}
+	tlsCfg := &tls.Config{
+		ServerName: serverName,
+		// standard verification doesn't take XmppAddr identifiers
+		// into account... certificate chain is verified below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyServerCertificate(rawCerts, roots, serverName)
+		},
+	}
+	return tlsCfg, nil
+}
+
+// verifyServerCertificate checks that a certificate chain
+// is trusted by roots and that it identifies domain.
+func verifyServerCertificate(rawCerts [][]byte, roots *x509.CertPool, domain string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("tls: no server certificate presented")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+	if !certificateMatchesDomain(certs[0], domain) {
+		return fmt.Errorf("tls: server certificate doesn't identify %s", domain)
+	}
+	return nil
+}
+
+// tlsCertificate returns the certificate identifying domain.
+func tlsCertificate(cfg *config.TLS, domain string) (*tls.Certificate, error) {
+	certs, err := certificateStoreFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return certs.certificate(domain)
+}
+
+func loadCertPool(caFiles []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := appendCertPool(pool, caFiles); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func appendCertPool(pool *x509.CertPool, caFiles []string) error {
+	for _, caFile := range caFiles {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in CA bundle: %s", caFile)
+		}
+	}
+	return nil
+}
+
+var (
+	certStoresMu sync.Mutex
+	certStores   = make(map[*config.TLS]*certificateStore)
+)
+
+// certificateStore holds the certificates of every configured domain,
+// so that they are loaded only once and shared among all streams.
+type certificateStore struct {
+	defaultCert *certificateFile
+	domainCerts map[string]*certificateFile
+}
+
+func certificateStoreFor(cfg *config.TLS) (*certificateStore, error) {
+	certStoresMu.Lock()
+	defer certStoresMu.Unlock()
+	if s := certStores[cfg]; s != nil {
+		return s, nil
+	}
+	s := &certificateStore{domainCerts: make(map[string]*certificateFile)}
+	if len(cfg.CertFile) > 0 {
+		s.defaultCert = &certificateFile{certFile: cfg.CertFile, keyFile: cfg.PrivKeyFile}
+		if _, err := s.defaultCert.certificate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range cfg.Certificates {
+		cf := &certificateFile{certFile: c.CertFile, keyFile: c.PrivKeyFile}
+		if _, err := cf.certificate(); err != nil {
+			return nil, err
+		}
+		s.domainCerts[strings.ToLower(c.Domain)] = cf
+	}
+	certStores[cfg] = s
+	return s, nil
+}
+
+// certificate returns domain certificate, or the default one
+// if no specific certificate has been configured for it.
+func (s *certificateStore) certificate(domain string) (*tls.Certificate, error) {
+	if cf, ok := s.domainCerts[strings.ToLower(domain)]; ok {
+		return cf.certificate()
+	}
+	if s.defaultCert == nil {
+		return nil, errNoCertificate
+	}
+	return s.defaultCert.certificate()
+}
+
+// certificateFile is a certificate and private key pair,
+// reloaded from disk whenever any of its files is modified.
+type certificateFile struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certificateFile) certificate() (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	modTime, err := c.lastModified()
+	if err != nil {
+		if c.cert != nil {
+			log.Error(err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cer, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// keep serving previous certificate while files are being replaced
+			log.Error(err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		log.Infof("tls: reloaded certificate %s", c.certFile)
+	}
+	c.cert = &cer
+	c.modTime = modTime
+	return c.cert, nil
+}
+
+// lastModified returns the latest modification time among certificate files.
+func (c *certificateFile) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSCertificateSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defaultCert, defaultKey := writeTestCertificate(t, dir, "localhost")
+	jackalCert, jackalKey := writeTestCertificate(t, dir, "jackal.im")
+
+	cfg := &config.TLS{
+		CertFile:    defaultCert,
+		PrivKeyFile: defaultKey,
+		Certificates: []config.TLSCertificate{
+			{Domain: "jackal.im", CertFile: jackalCert, PrivKeyFile: jackalKey},
+		},
+	}
+	tlsCfg, err := tlsServerConfig(cfg, "")
+	assert.Nil(t, err)
+
+	assert.Equal(t, certificateCommonName(t, tlsCfg, "jackal.im"), "jackal.im")
+	assert.Equal(t, certificateCommonName(t, tlsCfg, "JACKAL.IM"), "jackal.im")
+	assert.Equal(t, certificateCommonName(t, tlsCfg, "example.org"), "localhost")
+	assert.Equal(t, certificateCommonName(t, tlsCfg, ""), "localhost")
+
+	// renewed certificate
+	writeTestCertificateFiles(t, jackalCert, jackalKey, "renewed.jackal.im")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(jackalCert, future, future)
+	assert.Equal(t, certificateCommonName(t, tlsCfg, "jackal.im"), "renewed.jackal.im")
+
+	// keep serving last valid certificate
+	ioutil.WriteFile(jackalCert, []byte("invalid"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(jackalCert, future, future)
+	assert.Equal(t, certificateCommonName(t, tlsCfg, "jackal.im"), "renewed.jackal.im")
+}
+
+func TestVerifyServerCertificate(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jackal.im"},
+		DNSNames:              []string{"jackal.im"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	assert.Nil(t, verifyServerCertificate([][]byte{der}, roots, "jackal.im"))
+	assert.NotNil(t, verifyServerCertificate([][]byte{der}, roots, "example.org"))
+	assert.NotNil(t, verifyServerCertificate([][]byte{der}, x509.NewCertPool(), "jackal.im"))
+	assert.NotNil(t, verifyServerCertificate(nil, roots, "jackal.im"))
+}
+
+func TestTLSClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "jackal.im"},
+		DNSNames:     []string{"jackal.im"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	assert.Nil(t, err)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	// configured CA bundles are trusted along with system ones
+	tlsCfg, err := tlsClientConfig(&config.TLS{CAFiles: []string{caFile}}, "jackal.im")
+	assert.Nil(t, err)
+	assert.Nil(t, tlsCfg.VerifyPeerCertificate([][]byte{der}, nil))
+
+	tlsCfg, err = tlsClientConfig(nil, "jackal.im")
+	assert.Nil(t, err)
+	assert.NotNil(t, tlsCfg.VerifyPeerCertificate([][]byte{der}, nil))
+
+	_, err = tlsClientConfig(&config.TLS{CAFiles: []string{filepath.Join(dir, "missing.pem")}}, "jackal.im")
+	assert.NotNil(t, err)
+}
+
+func certificateCommonName(t *testing.T, cfg *tls.Config, serverName string) string {
+	cer, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cer.Certificate[0])
+	assert.Nil(t, err)
+	return leaf.Subject.CommonName
+}
+
+func writeTestCertificate(t *testing.T, dir, commonName string) (string, string) {
+	certFile := filepath.Join(dir, commonName+".pem")
+	keyFile := filepath.Join(dir, commonName+".key")
+	writeTestCertificateFiles(t, certFile, keyFile, commonName)
+	return certFile, keyFile
+}
+
+func writeTestCertificateFiles(t *testing.T, certFile, keyFile, commonName string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	assert.Nil(t, err)
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
@@ -8,6 +8,7 @@ package transport
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"time"
@@ -38,6 +39,10 @@ func NewSocketTransport(conn net.Conn, bufferSize, keepAlive int) Transport {
 	return s
 }
 
+func (s *socketTransport) Type() config.TransportType {
+	return config.Socket
+}
+
 func (s *socketTransport) Write(p []byte) (n int, err error) {
 	defer s.bw.Flush()
 	return s.w.Write(p)
@@ -60,6 +65,20 @@ func (s *socketTransport) StartTLS(cfg *tls.Config) {
 	}
 }
 
+func (s *socketTransport) StartClientTLS(cfg *tls.Config) error {
+	if _, ok := s.conn.(*tls.Conn); ok {
+		return nil
+	}
+	tlsConn := tls.Client(s.conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	s.conn = tlsConn
+	s.bw.Reset(s.conn)
+	s.br.Reset(s.conn)
+	return nil
+}
+
 func (s *socketTransport) EnableCompression(level config.CompressionLevel) {
 	if !s.compressionEnabled {
 		zwr := compress.NewZlibCompressor(s.br, s.bw, level)
@@ -81,3 +100,11 @@ func (s *socketTransport) ChannelBindingBytes(mechanism config.ChannelBindingMec
 	}
 	return nil
 }
+
+func (s *socketTransport) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		st := tlsConn.ConnectionState()
+		return st.PeerCertificates
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ package transport
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 
 	"github.com/ortuman/jackal/config"
@@ -15,7 +16,10 @@ import (
 type Transport interface {
 	io.ReadWriteCloser
 
+	Type() config.TransportType
 	StartTLS(*tls.Config)
+	StartClientTLS(*tls.Config) error
 	EnableCompression(config.CompressionLevel)
 	ChannelBindingBytes(config.ChannelBindingMechanism) []byte
+	PeerCertificates() []*x509.Certificate
 }
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ortuman/jackal/config"
+)
+
+var errWebSocketMessageType = errors.New("transport: unsupported websocket message type")
+
+var errWebSocketClientTLS = errors.New("transport: TLS negotiation not supported over websocket")
+
+// webSocketTransport carries an XMPP stream over a WebSocket connection,
+// in which every message contains exactly one XML element (RFC 7395).
+// TLS is negotiated by the HTTP listener, so StartTLS and EnableCompression are no-ops.
+type webSocketTransport struct {
+	conn         *websocket.Conn
+	r            io.Reader
+	readDeadline time.Duration
+}
+
+func NewWebSocketTransport(conn *websocket.Conn, keepAlive int) Transport {
+	return &webSocketTransport{
+		conn:         conn,
+		readDeadline: time.Second * time.Duration(keepAlive),
+	}
+}
+
+func (w *webSocketTransport) Type() config.TransportType {
+	return config.WebSocket
+}
+
+func (w *webSocketTransport) Write(p []byte) (n int, err error) {
+	if err := w.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *webSocketTransport) Read(p []byte) (n int, err error) {
+	w.conn.SetReadDeadline(time.Now().Add(w.readDeadline))
+	for {
+		if w.r == nil {
+			mt, r, err := w.conn.NextReader()
+			if err != nil {
+				if _, ok := err.(*websocket.CloseError); ok {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if mt != websocket.TextMessage {
+				return 0, errWebSocketMessageType
+			}
+			w.r = r
+		}
+		n, err = w.r.Read(p)
+		if err == io.EOF {
+			// continue reading from next message
+			w.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (w *webSocketTransport) Close() error {
+	return w.conn.Close()
+}
+
+func (w *webSocketTransport) StartTLS(cfg *tls.Config) {
+}
+
+func (w *webSocketTransport) StartClientTLS(cfg *tls.Config) error {
+	return errWebSocketClientTLS
+}
+
+func (w *webSocketTransport) EnableCompression(level config.CompressionLevel) {
+}
+
+func (w *webSocketTransport) ChannelBindingBytes(mechanism config.ChannelBindingMechanism) []byte {
+	if tlsConn, ok := w.conn.UnderlyingConn().(*tls.Conn); ok {
+		switch mechanism {
+		case config.TLSUnique:
+			st := tlsConn.ConnectionState()
+			return st.TLSUnique
+		default:
+			break
+		}
+	}
+	return nil
+}
+
+func (w *webSocketTransport) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := w.conn.UnderlyingConn().(*tls.Conn); ok {
+		st := tlsConn.ConnectionState()
+		return st.PeerCertificates
+	}
+	return nil
+}
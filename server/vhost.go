@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"sync"
+
+	"github.com/ortuman/jackal/config"
+)
+
+type hostConfigKey struct {
+	cfg    *config.Server
+	domain string
+}
+
+var (
+	hostConfigsMu sync.Mutex
+	hostConfigs   = make(map[hostConfigKey]*config.Server)
+)
+
+// hostConfig returns the configuration applying to a domain stream,
+// that is, server configuration overridden by domain virtual host settings.
+func hostConfig(cfg *config.Server, domain string) *config.Server {
+	vh := config.DefaultConfig.C2S.VirtualHosts[domain]
+	if vh == nil {
+		return cfg
+	}
+	hostConfigsMu.Lock()
+	defer hostConfigsMu.Unlock()
+
+	// keep returning the same instance, as modules are bound to its settings
+	key := hostConfigKey{cfg: cfg, domain: domain}
+	if hc := hostConfigs[key]; hc != nil {
+		return hc
+	}
+	hc := *cfg
+	if vh.Modules != nil {
+		hc.Modules = vh.Modules
+	}
+	if vh.SASL != nil {
+		hc.SASL = vh.SASL
+	}
+	if vh.TLSRequired != nil && cfg.TLS != nil {
+		tls := *cfg.TLS
+		tls.Required = *vh.TLSRequired
+		hc.TLS = &tls
+	}
+	if vh.ModRegistration != nil {
+		hc.ModRegistration = *vh.ModRegistration
+	}
+	if vh.OfflineQueueSize > 0 {
+		hc.ModOffline.QueueSize = vh.OfflineQueueSize
+	}
+	hostConfigs[key] = &hc
+	return &hc
+}
+
+// mamConfig returns message archiving settings (XEP-0313),
+// or nil if archiving is not enabled by cfg.
+func mamConfig(cfg *config.Server) *config.ModMAM {
+	if _, ok := cfg.Modules["mam"]; !ok {
+		return nil
+	}
+	return &cfg.ModMAM
+}
+
+// localServerConfig returns the settings of a local domain
+// as configured by the first c2s server, if any.
+func localServerConfig(domain string) *config.Server {
+	for i := range config.DefaultConfig.Servers {
+		cfg := &config.DefaultConfig.Servers[i]
+		if cfg.Type == config.C2SServerType {
+			return hostConfig(cfg, domain)
+		}
+	}
+	return nil
+}
+
+// localMAMConfig returns message archiving settings of a local domain,
+// as configured by the first c2s server enabling it.
+func localMAMConfig(domain string) *config.ModMAM {
+	for i := range config.DefaultConfig.Servers {
+		cfg := &config.DefaultConfig.Servers[i]
+		if cfg.Type != config.C2SServerType {
+			continue
+		}
+		if mamCfg := mamConfig(hostConfig(cfg, domain)); mamCfg != nil {
+			return mamCfg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostConfig(t *testing.T) {
+	defer func(c config.C2S) { config.DefaultConfig.C2S = c }(config.DefaultConfig.C2S)
+
+	tlsRequired := true
+	config.DefaultConfig.C2S = config.C2S{
+		Domains: []string{"localhost", "jackal.im"},
+		VirtualHosts: map[string]*config.VirtualHost{
+			"jackal.im": {
+				Modules:          map[string]struct{}{"roster": {}},
+				SASL:             []string{"scram_sha_256"},
+				TLSRequired:      &tlsRequired,
+				ModRegistration:  &config.ModRegistration{AllowCancel: true},
+				OfflineQueueSize: 10,
+			},
+		},
+	}
+	cfg := &config.Server{
+		Modules:    map[string]struct{}{"roster": {}, "vcard": {}, "offline": {}},
+		SASL:       []string{"plain"},
+		TLS:        &config.TLS{},
+		ModOffline: config.ModOffline{QueueSize: 100, ExpireAfter: 60},
+	}
+	assert.Equal(t, hostConfig(cfg, "localhost"), cfg)
+
+	hc := hostConfig(cfg, "jackal.im")
+	assert.Equal(t, len(hc.Modules), 1)
+	assert.Equal(t, hc.SASL, []string{"scram_sha_256"})
+	assert.True(t, hc.TLS.Required)
+	assert.True(t, hc.ModRegistration.AllowCancel)
+	assert.Equal(t, hc.ModOffline.QueueSize, 10)
+	assert.Equal(t, hc.ModOffline.ExpireAfter, 60)
+	assert.Equal(t, hostConfig(cfg, "jackal.im"), hc)
+
+	// server configuration remains untouched
+	assert.Equal(t, len(cfg.Modules), 3)
+	assert.False(t, cfg.TLS.Required)
+	assert.Equal(t, cfg.ModOffline.QueueSize, 100)
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrArchiveItemNotFound is returned when paging an archive
+// by an identifier not belonging to it.
+var ErrArchiveItemNotFound = errors.New("storage: archive item not found")
+
+// archive preferences JID lists separator
+const archivePrefsSeparator = "\n"
+
+type sqlQueryFunc func(query string, args ...interface{}) (*sql.Rows, error)
+
+// fetchArchivedMessages runs an archive query on any of the supported SQL dialects.
+func fetchArchivedMessages(query sqlQueryFunc, d sqlDialect, username string, q *ArchiveQuery) ([]ArchivedMessage, bool, error) {
+	var conds []string
+	var args []interface{}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, placeholder(d, len(args))))
+	}
+	where("username = %s", username)
+	if q.With != nil {
+		if q.With.IsFull() {
+			where("peer = %s", q.With.String())
+		} else {
+			where("bare_peer = %s", q.With.String())
+		}
+	}
+	if !q.Start.IsZero() {
+		where("created_at >= %s", q.Start.UTC())
+	}
+	if !q.End.IsZero() {
+		where("created_at <= %s", q.End.UTC())
+	}
+	if len(q.AfterID) > 0 {
+		seq, err := archiveSeq(query, d, username, q.AfterID)
+		if err != nil {
+			return nil, false, err
+		}
+		where("seq > %s", seq)
+	}
+	if len(q.BeforeID) > 0 {
+		seq, err := archiveSeq(query, d, username, q.BeforeID)
+		if err != nil {
+			return nil, false, err
+		}
+		where("seq < %s", seq)
+	}
+	backwards := len(q.BeforeID) > 0 || q.LastPage
+
+	stmt := "SELECT id, peer, data, created_at FROM archive_messages WHERE " + strings.Join(conds, " AND ")
+	if backwards {
+		stmt += " ORDER BY seq DESC"
+	} else {
+		stmt += " ORDER BY seq"
+	}
+	if q.Max > 0 {
+		// fetch an extra row to know whether there are more pages
+		stmt += fmt.Sprintf(" LIMIT %d", q.Max+1)
+	}
+	rows, err := query(stmt, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages, complete, err := archivedMessagesFromRows(rows, q.Max)
+	if err != nil {
+		return nil, false, err
+	}
+	if backwards {
+		reverseArchivedMessages(messages)
+	}
+	return messages, complete, nil
+}
+
+func archiveSeq(query sqlQueryFunc, d sqlDialect, username, id string) (int64, error) {
+	stmt := fmt.Sprintf("SELECT seq FROM archive_messages WHERE username = %s AND id = %s", placeholder(d, 1), placeholder(d, 2))
+	rows, err := query(stmt, username, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, ErrArchiveItemNotFound
+	}
+	var seq int64
+	err = rows.Scan(&seq)
+	return seq, err
+}
+
+// archivedMessagesFromRows scans up to max archived messages (all of them if zero),
+// reporting whether there were no rows left. Messages whose stored data can't be
+// parsed are skipped so that a single row doesn't break the whole page.
+func archivedMessagesFromRows(rows *sql.Rows, max int) ([]ArchivedMessage, bool, error) {
+	var ret []ArchivedMessage
+	var scanned int
+	for rows.Next() {
+		if max > 0 && scanned == max {
+			return ret, false, nil
+		}
+		scanned++
+
+		var m ArchivedMessage
+		var data string
+		if err := rows.Scan(&m.ID, &m.Peer, &data, &m.CreatedAt); err != nil {
+			return nil, false, err
+		}
+		elem, err := xml.NewParser(strings.NewReader(data)).ParseElement()
+		if err != nil || elem == nil {
+			log.Warnf("storage: skipping unparsable archived message %s: %v", m.ID, err)
+			continue
+		}
+		m.Message = elem
+		ret = append(ret, m)
+	}
+	return ret, true, rows.Err()
+}
+
+func reverseArchivedMessages(messages []ArchivedMessage) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+func archivePrefsFromRow(row *sql.Row, username string) (*ArchivePrefs, error) {
+	var always, never string
+	prefs := &ArchivePrefs{Username: username}
+	err := row.Scan(&prefs.Default, &always, &never)
+	switch err {
+	case nil:
+		prefs.Always = splitArchivePrefsJIDs(always)
+		prefs.Never = splitArchivePrefsJIDs(never)
+		return prefs, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func splitArchivePrefsJIDs(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, archivePrefsSeparator)
+}
+
+// placeholder returns the n-th (starting at 1) statement argument placeholder of a SQL dialect.
+func placeholder(d sqlDialect, n int) string {
+	if d == postgreSQLDialect {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
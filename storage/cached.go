@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import "time"
+
+const (
+	userCacheKeyPrefix          = "u:"
+	rosterItemCacheKeyPrefix    = "ri:"
+	rosterUserCacheKeyPrefix    = "ru:"
+	rosterContactCacheKeyPrefix = "rc:"
+)
+
+// cachedStorage decorates a storage caching user and roster item lookups.
+// Any other method is forwarded to the underlying storage.
+type cachedStorage struct {
+	storage
+	cache *lruCache
+}
+
+func newCachedStorage(s storage, size int, ttl time.Duration) storage {
+	return &cachedStorage{
+		storage: s,
+		cache:   newLRUCache(size, ttl),
+	}
+}
+
+func (c *cachedStorage) FetchUser(username string) (*User, error) {
+	key := userCacheKeyPrefix + username
+	if v, ok := c.cache.get(key); ok {
+		return copyUser(v.(*User)), nil
+	}
+	gen := c.cache.currentGeneration()
+	u, err := c.storage.FetchUser(username)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, copyUser(u), gen)
+	return u, nil
+}
+
+func (c *cachedStorage) InsertOrUpdateUser(user *User) error {
+	defer c.cache.delete(userCacheKeyPrefix + user.Username)
+	return c.storage.InsertOrUpdateUser(user)
+}
+
+func (c *cachedStorage) DeleteUser(username string) error {
+	defer func() {
+		c.cache.delete(userCacheKeyPrefix+username, rosterUserCacheKeyPrefix+username)
+
+		// user's items may be cached under any of its contacts
+		c.cache.deletePrefix(rosterItemCacheKeyPrefix + username + "/")
+		c.cache.deletePrefix(rosterContactCacheKeyPrefix)
+	}()
+	return c.storage.DeleteUser(username)
+}
+
+func (c *cachedStorage) UserExists(username string) (bool, error) {
+	u, err := c.FetchUser(username)
+	if err != nil {
+		return false, err
+	}
+	return u != nil, nil
+}
+
+func (c *cachedStorage) InsertOrUpdateRosterItem(ri *RosterItem) error {
+	defer c.invalidateRosterItem(ri.User, ri.Contact)
+	return c.storage.InsertOrUpdateRosterItem(ri)
+}
+
+func (c *cachedStorage) DeleteRosterItem(user, contact string) error {
+	defer c.invalidateRosterItem(user, contact)
+	return c.storage.DeleteRosterItem(user, contact)
+}
+
+func (c *cachedStorage) FetchRosterItem(user, contact string) (*RosterItem, error) {
+	key := rosterItemCacheKeyPrefix + user + "/" + contact
+	if v, ok := c.cache.get(key); ok {
+		return copyRosterItem(v.(*RosterItem)), nil
+	}
+	gen := c.cache.currentGeneration()
+	ri, err := c.storage.FetchRosterItem(user, contact)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, copyRosterItem(ri), gen)
+	return ri, nil
+}
+
+func (c *cachedStorage) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
+	return c.fetchRosterItems(rosterUserCacheKeyPrefix+user, func() ([]RosterItem, error) {
+		return c.storage.FetchRosterItemsAsUser(user)
+	})
+}
+
+func (c *cachedStorage) FetchRosterItemsAsContact(contact string) ([]RosterItem, error) {
+	return c.fetchRosterItems(rosterContactCacheKeyPrefix+contact, func() ([]RosterItem, error) {
+		return c.storage.FetchRosterItemsAsContact(contact)
+	})
+}
+
+func (c *cachedStorage) fetchRosterItems(key string, fetch func() ([]RosterItem, error)) ([]RosterItem, error) {
+	if v, ok := c.cache.get(key); ok {
+		return copyRosterItems(v.([]RosterItem)), nil
+	}
+	gen := c.cache.currentGeneration()
+	items, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, copyRosterItems(items), gen)
+	return items, nil
+}
+
+func (c *cachedStorage) invalidateRosterItem(user, contact string) {
+	c.cache.delete(
+		rosterItemCacheKeyPrefix+user+"/"+contact,
+		rosterUserCacheKeyPrefix+user,
+		rosterContactCacheKeyPrefix+contact,
+	)
+}
+
+func copyUser(u *User) *User {
+	if u == nil {
+		return nil
+	}
+	cp := *u
+	return &cp
+}
+
+func copyRosterItem(ri *RosterItem) *RosterItem {
+	if ri == nil {
+		return nil
+	}
+	cp := *ri
+	cp.Groups = append([]string(nil), ri.Groups...)
+	return &cp
+}
+
+func copyRosterItems(items []RosterItem) []RosterItem {
+	if items == nil {
+		return nil
+	}
+	cp := make([]RosterItem, len(items))
+	for i := range items {
+		cp[i] = *copyRosterItem(&items[i])
+	}
+	return cp
+}
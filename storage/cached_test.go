@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingStorage struct {
+	storage
+	userFetches   int
+	rosterFetches int
+}
+
+func (s *countingStorage) FetchUser(username string) (*User, error) {
+	s.userFetches++
+	return s.storage.FetchUser(username)
+}
+
+func (s *countingStorage) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
+	s.rosterFetches++
+	return s.storage.FetchRosterItemsAsUser(user)
+}
+
+func TestCachedUsers(t *testing.T) {
+	s := &countingStorage{storage: NewMemoryStorage()}
+	c := newCachedStorage(s, 16, time.Minute)
+
+	assert.Nil(t, c.InsertOrUpdateUser(&User{Username: "ortuman", Password: "1234"}))
+	u, _ := c.FetchUser("ortuman")
+	assert.Equal(t, u.Password, "1234")
+	u.Password = "modified"
+	u, _ = c.FetchUser("ortuman")
+	assert.Equal(t, u.Password, "1234")
+	assert.Equal(t, s.userFetches, 1)
+
+	assert.Nil(t, c.InsertOrUpdateUser(&User{Username: "ortuman", Password: "5678"}))
+	u, _ = c.FetchUser("ortuman")
+	assert.Equal(t, u.Password, "5678")
+	assert.Equal(t, s.userFetches, 2)
+
+	assert.Nil(t, c.DeleteUser("ortuman"))
+	exists, _ := c.UserExists("ortuman")
+	assert.False(t, exists)
+}
+
+func TestCachedRosterItems(t *testing.T) {
+	s := &countingStorage{storage: NewMemoryStorage()}
+	c := newCachedStorage(s, 16, time.Minute)
+
+	assert.Nil(t, c.InsertOrUpdateRosterItem(&RosterItem{User: "ortuman", Contact: "noelia", Subscription: "none"}))
+	items, _ := c.FetchRosterItemsAsUser("ortuman")
+	assert.Equal(t, len(items), 1)
+	c.FetchRosterItemsAsUser("ortuman")
+	assert.Equal(t, s.rosterFetches, 1)
+
+	assert.Nil(t, c.InsertOrUpdateRosterItem(&RosterItem{User: "ortuman", Contact: "noelia", Subscription: "both"}))
+	items, _ = c.FetchRosterItemsAsUser("ortuman")
+	assert.Equal(t, items[0].Subscription, "both")
+	assert.Equal(t, s.rosterFetches, 2)
+
+	assert.Nil(t, c.DeleteRosterItem("ortuman", "noelia"))
+	items, _ = c.FetchRosterItemsAsUser("ortuman")
+	assert.Equal(t, len(items), 0)
+
+	assert.Nil(t, c.InsertOrUpdateRosterItem(&RosterItem{User: "ortuman", Contact: "romeo"}))
+	items, _ = c.FetchRosterItemsAsContact("romeo")
+	assert.Equal(t, len(items), 1)
+	assert.Nil(t, c.DeleteUser("ortuman"))
+	items, _ = c.FetchRosterItemsAsContact("romeo")
+	assert.Equal(t, len(items), 0)
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache(2, time.Minute)
+	c.set("a", 1, c.currentGeneration())
+	c.set("b", 2, c.currentGeneration())
+	c.get("a")
+	c.set("c", 3, c.currentGeneration())
+	_, ok := c.get("b")
+	assert.False(t, ok)
+	assert.Equal(t, c.len(), 2)
+
+	// stale generation values are discarded
+	gen := c.currentGeneration()
+	c.delete("a")
+	c.set("a", 4, gen)
+	_, ok = c.get("a")
+	assert.False(t, ok)
+
+	c = newLRUCache(2, time.Millisecond)
+	c.set("a", 1, c.currentGeneration())
+	time.Sleep(5 * time.Millisecond)
+	_, ok = c.get("a")
+	assert.False(t, ok)
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/ortuman/jackal/config"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ScramIterations represents the iteration count used to derive new SCRAM credentials.
+const ScramIterations = 4096
+
+const scramSaltSize = 32
+
+const (
+	scramSHA1Prefix   = "SCRAM-SHA-1"
+	scramSHA256Prefix = "SCRAM-SHA-256"
+)
+
+var errMalformedScramCredentials = errors.New("storage: malformed SCRAM credentials")
+
+// ScramCredentials represents SCRAM salted credentials (RFC 5802),
+// from which a password can be verified without storing it in plaintext.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives SCRAM credentials from a plaintext password.
+func NewScramCredentials(h func() hash.Hash, password string, salt []byte, iterations int) *ScramCredentials {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	clientKey := scramHMAC(h, saltedPassword, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHMAC(h, saltedPassword, []byte("Server Key")),
+	}
+}
+
+// VerifyPassword reports whether password matches these credentials.
+func (c *ScramCredentials) VerifyPassword(h func() hash.Hash, password string) bool {
+	cred := NewScramCredentials(h, password, c.Salt, c.Iterations)
+	return subtle.ConstantTimeCompare(cred.StoredKey, c.StoredKey) == 1
+}
+
+// SetPassword replaces user credentials with the hashed form of password.
+// Plaintext password is cleared.
+func (u *User) SetPassword(password string) error {
+	sha1Salt, err := randomSalt()
+	if err != nil {
+		return err
+	}
+	sha256Salt, err := randomSalt()
+	if err != nil {
+		return err
+	}
+	u.ScramSHA1 = NewScramCredentials(sha1.New, password, sha1Salt, ScramIterations)
+	u.ScramSHA256 = NewScramCredentials(sha256.New, password, sha256Salt, ScramIterations)
+
+	u.PasswordHash = ""
+	switch config.DefaultConfig.Storage.PasswordHash {
+	case config.BCryptPasswordHash:
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = string(h)
+	}
+	u.Password = ""
+	return nil
+}
+
+// VerifyPassword reports whether password matches user stored credentials.
+func (u *User) VerifyPassword(password string) bool {
+	switch {
+	case len(u.PasswordHash) > 0:
+		return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+	case u.ScramSHA256 != nil:
+		return u.ScramSHA256.VerifyPassword(sha256.New, password)
+	case u.ScramSHA1 != nil:
+		return u.ScramSHA1.VerifyPassword(sha1.New, password)
+	default:
+		return len(u.Password) > 0 && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+	}
+}
+
+// HasPlaintextPassword reports whether user credentials are still stored
+// in legacy plaintext form.
+func (u *User) HasPlaintextPassword() bool {
+	return len(u.Password) > 0
+}
+
+// encodeScramCredentials serializes SCRAM credentials using RFC 5803 format.
+// An empty string is returned when no credentials are present.
+func encodeScramCredentials(prefix string, c *ScramCredentials) string {
+	if c == nil {
+		return ""
+	}
+	enc := base64.StdEncoding
+	return fmt.Sprintf("%s$%d:%s$%s:%s", prefix, c.Iterations,
+		enc.EncodeToString(c.Salt), enc.EncodeToString(c.StoredKey), enc.EncodeToString(c.ServerKey))
+}
+
+func decodeScramCredentials(prefix string, s string) (*ScramCredentials, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != prefix {
+		return nil, errMalformedScramCredentials
+	}
+	iterAndSalt := strings.Split(parts[1], ":")
+	keys := strings.Split(parts[2], ":")
+	if len(iterAndSalt) != 2 || len(keys) != 2 {
+		return nil, errMalformedScramCredentials
+	}
+	iterations, err := strconv.Atoi(iterAndSalt[0])
+	if err != nil || iterations <= 0 {
+		return nil, errMalformedScramCredentials
+	}
+	enc := base64.StdEncoding
+	salt, err := enc.DecodeString(iterAndSalt[1])
+	if err != nil {
+		return nil, errMalformedScramCredentials
+	}
+	storedKey, err := enc.DecodeString(keys[0])
+	if err != nil {
+		return nil, errMalformedScramCredentials
+	}
+	serverKey, err := enc.DecodeString(keys[1])
+	if err != nil {
+		return nil, errMalformedScramCredentials
+	}
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	}, nil
+}
+
+// encodeUserCredentials returns SCRAM-SHA-1 and SCRAM-SHA-256 serialized user credentials.
+func encodeUserCredentials(u *User) (scramSHA1, scramSHA256 string) {
+	return encodeScramCredentials(scramSHA1Prefix, u.ScramSHA1), encodeScramCredentials(scramSHA256Prefix, u.ScramSHA256)
+}
+
+func decodeUserCredentials(u *User, scramSHA1, scramSHA256 string) error {
+	var err error
+	if u.ScramSHA1, err = decodeScramCredentials(scramSHA1Prefix, scramSHA1); err != nil {
+		return err
+	}
+	if u.ScramSHA256, err = decodeScramCredentials(scramSHA256Prefix, scramSHA256); err != nil {
+		return err
+	}
+	return nil
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, b []byte) []byte {
+	m := hmac.New(h, key)
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, scramSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScramCredentialsRFC5802(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("QSXCR+Q6sek8bf92")
+	creds := NewScramCredentials(sha1.New, "pencil", salt, 4096)
+
+	authMessage := "n=user,r=fyko+d2lbbFgONRv9qkxdawL," +
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096," +
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j"
+	m := hmac.New(sha1.New, creds.ServerKey)
+	m.Write([]byte(authMessage))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(m.Sum(nil)), "rmF9pqV8S7suAoZWja4dJRkFsKQ=")
+
+	assert.True(t, creds.VerifyPassword(sha1.New, "pencil"))
+	assert.False(t, creds.VerifyPassword(sha1.New, "pencil2"))
+}
+
+func TestUserSetPassword(t *testing.T) {
+	u := User{Username: "ortuman", Password: "1234"}
+	assert.True(t, u.HasPlaintextPassword())
+	assert.True(t, u.VerifyPassword("1234"))
+
+	assert.Nil(t, u.SetPassword("5678"))
+	assert.False(t, u.HasPlaintextPassword())
+	assert.NotNil(t, u.ScramSHA1)
+	assert.NotNil(t, u.ScramSHA256)
+	assert.True(t, u.VerifyPassword("5678"))
+	assert.False(t, u.VerifyPassword("1234"))
+}
+
+func TestEncodeScramCredentials(t *testing.T) {
+	u := User{Username: "ortuman"}
+	assert.Nil(t, u.SetPassword("1234"))
+
+	scramSHA1, scramSHA256 := encodeUserCredentials(&u)
+	assert.Equal(t, scramSHA1[:len(scramSHA1Prefix)+1], scramSHA1Prefix+"$")
+
+	var u2 User
+	assert.Nil(t, decodeUserCredentials(&u2, scramSHA1, scramSHA256))
+	assert.Equal(t, u2.ScramSHA1, u.ScramSHA1)
+	assert.Equal(t, u2.ScramSHA256, u.ScramSHA256)
+
+	_, err := decodeScramCredentials(scramSHA256Prefix, scramSHA1)
+	assert.NotNil(t, err)
+
+	creds, err := decodeScramCredentials(scramSHA1Prefix, "")
+	assert.Nil(t, err)
+	assert.Nil(t, creds)
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+const maxConnectBackoff = 30 * time.Second
+
+const healthCheckInterval = 5 * time.Second
+
+// ErrUnavailable is returned by storage operations
+// while the underlying database can't be reached.
+var ErrUnavailable = errors.New("storage: database unavailable")
+
+// healthy is set to 1 while storage database is reachable.
+var healthy int32 = 1
+
+// IsHealthy returns whether or not storage database is currently reachable.
+func IsHealthy() bool {
+	return atomic.LoadInt32(&healthy) == 1
+}
+
+// pinger is implemented by storages backed by a remote database.
+type pinger interface {
+	ping() error
+}
+
+// openDB opens a database connection retrying with an exponential
+// backoff until it can be reached or configured retries are exhausted.
+func openDB(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	retries := config.DefaultConfig.Storage.ConnectRetries
+	backoff := time.Duration(config.DefaultConfig.Storage.ConnectBackoff) * time.Second
+	for i := 0; ; i++ {
+		err = db.Ping()
+		if err == nil {
+			return db, nil
+		}
+		if i == retries {
+			db.Close()
+			return nil, err
+		}
+		log.Warnf("storage: couldn't connect to %s database (retrying in %v): %v", driverName, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+func setHealthy(isHealthy bool, err error) {
+	var v int32
+	if isHealthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&healthy, v) == v {
+		return
+	}
+	if isHealthy {
+		log.Infof("storage: database connection restored")
+	} else {
+		log.Errorf("storage: database connection lost: %v", err)
+	}
+}
+
+// healthStorage decorates a storage failing fast with ErrUnavailable
+// while its database is unreachable.
+type healthStorage struct {
+	storage
+}
+
+func newHealthStorage(s storage, p pinger) storage {
+	go monitorHealth(p)
+	return &healthStorage{storage: s}
+}
+
+func monitorHealth(p pinger) {
+	tc := time.NewTicker(healthCheckInterval)
+	defer tc.Stop()
+	for range tc.C {
+		err := p.ping()
+		setHealthy(err == nil, err)
+	}
+}
+
+func (h *healthStorage) FetchUser(username string) (*User, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchUser(username)
+}
+
+func (h *healthStorage) InsertOrUpdateUser(user *User) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOrUpdateUser(user)
+}
+
+func (h *healthStorage) DeleteUser(username string) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.DeleteUser(username)
+}
+
+func (h *healthStorage) UserExists(username string) (bool, error) {
+	if !IsHealthy() {
+		return false, ErrUnavailable
+	}
+	return h.storage.UserExists(username)
+}
+
+func (h *healthStorage) InsertOrUpdateRosterItem(ri *RosterItem) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOrUpdateRosterItem(ri)
+}
+
+func (h *healthStorage) DeleteRosterItem(user, contact string) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.DeleteRosterItem(user, contact)
+}
+
+func (h *healthStorage) FetchRosterItem(user, contact string) (*RosterItem, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchRosterItem(user, contact)
+}
+
+func (h *healthStorage) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchRosterItemsAsUser(user)
+}
+
+func (h *healthStorage) FetchRosterItemsAsContact(contact string) ([]RosterItem, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchRosterItemsAsContact(contact)
+}
+
+func (h *healthStorage) InsertOrUpdateRosterNotification(rn *RosterNotification) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOrUpdateRosterNotification(rn)
+}
+
+func (h *healthStorage) DeleteRosterNotification(user, contact string) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.DeleteRosterNotification(user, contact)
+}
+
+func (h *healthStorage) FetchRosterNotifications(contact string) ([]RosterNotification, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchRosterNotifications(contact)
+}
+
+func (h *healthStorage) FetchVCard(username string) (xml.Element, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchVCard(username)
+}
+
+func (h *healthStorage) InsertOrUpdateVCard(vCard xml.Element, username string) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOrUpdateVCard(vCard, username)
+}
+
+func (h *healthStorage) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchPrivateXML(namespace, username)
+}
+
+func (h *healthStorage) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOrUpdatePrivateXML(privateXML, namespace, username)
+}
+
+func (h *healthStorage) InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOfflineMessage(message, username, expiresAt)
+}
+
+func (h *healthStorage) CountOfflineMessages(username string) (int, error) {
+	if !IsHealthy() {
+		return 0, ErrUnavailable
+	}
+	return h.storage.CountOfflineMessages(username)
+}
+
+func (h *healthStorage) FetchOfflineMessages(username string) ([]OfflineMessage, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchOfflineMessages(username)
+}
+
+func (h *healthStorage) DeleteOfflineMessages(username string, lastID int64) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.DeleteOfflineMessages(username, lastID)
+}
+
+func (h *healthStorage) DeleteExpiredOfflineMessages(maxAge time.Duration) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.DeleteExpiredOfflineMessages(maxAge)
+}
+
+func (h *healthStorage) InsertArchivedMessage(message *ArchivedMessage, username string) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertArchivedMessage(message, username)
+}
+
+func (h *healthStorage) FetchArchivedMessages(username string, query *ArchiveQuery) ([]ArchivedMessage, bool, error) {
+	if !IsHealthy() {
+		return nil, false, ErrUnavailable
+	}
+	return h.storage.FetchArchivedMessages(username, query)
+}
+
+func (h *healthStorage) FetchArchivePrefs(username string) (*ArchivePrefs, error) {
+	if !IsHealthy() {
+		return nil, ErrUnavailable
+	}
+	return h.storage.FetchArchivePrefs(username)
+}
+
+func (h *healthStorage) InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) error {
+	if !IsHealthy() {
+		return ErrUnavailable
+	}
+	return h.storage.InsertOrUpdateArchivePrefs(prefs)
+}
@@ -0,0 +1,30 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthStorage(t *testing.T) {
+	s := &healthStorage{storage: NewMemoryStorage()}
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "ortuman"}))
+
+	setHealthy(false, nil)
+	defer setHealthy(true, nil)
+	assert.False(t, IsHealthy())
+
+	_, err := s.FetchUser("ortuman")
+	assert.Equal(t, err, ErrUnavailable)
+	assert.Equal(t, s.DeleteUser("ortuman"), ErrUnavailable)
+
+	setHealthy(true, nil)
+	u, err := s.FetchUser("ortuman")
+	assert.Nil(t, err)
+	assert.NotNil(t, u)
+}
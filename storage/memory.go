@@ -0,0 +1,507 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+type memoryRosterItem struct {
+	RosterItem
+	seq uint64
+}
+
+type memoryRosterNotification struct {
+	user        string
+	contact     string
+	elementsXML string
+	seq         uint64
+}
+
+type memoryOfflineMessage struct {
+	id        int64
+	xml       string
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+type memoryArchivedMessage struct {
+	seq       int64
+	id        string
+	peer      string
+	barePeer  string
+	xml       string
+	createdAt time.Time
+}
+
+// memory implements an ephemeral storage that keeps
+// all its data in process memory.
+// XML payloads are stored serialized so that fetched elements
+// never alias those held by the caller, just like a database would behave.
+type memory struct {
+	mu                  sync.RWMutex
+	seq                 uint64
+	users               map[string]User
+	rosterItems         map[string]map[string]*memoryRosterItem
+	rosterNotifications map[string]map[string]*memoryRosterNotification
+	vCards              map[string]string
+	privateXML          map[string]map[string]string
+	offlineMessages     map[string][]memoryOfflineMessage
+	offlineSeq          int64
+	archivedMessages    map[string][]memoryArchivedMessage
+	archiveSeq          int64
+	archivePrefs        map[string]ArchivePrefs
+}
+
+// NewMemoryStorage returns an empty in-memory storage instance.
+func NewMemoryStorage() storage {
+	return &memory{
+		users:               make(map[string]User),
+		rosterItems:         make(map[string]map[string]*memoryRosterItem),
+		rosterNotifications: make(map[string]map[string]*memoryRosterNotification),
+		vCards:              make(map[string]string),
+		privateXML:          make(map[string]map[string]string),
+		offlineMessages:     make(map[string][]memoryOfflineMessage),
+		archivedMessages:    make(map[string][]memoryArchivedMessage),
+		archivePrefs:        make(map[string]ArchivePrefs),
+	}
+}
+
+func (m *memory) FetchUser(username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[username]
+	if !ok {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+func (m *memory) InsertOrUpdateUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[u.Username] = *u
+	return nil
+}
+
+func (m *memory) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.offlineMessages, username)
+	delete(m.archivedMessages, username)
+	delete(m.archivePrefs, username)
+	delete(m.rosterItems, username)
+	delete(m.rosterNotifications, username)
+	delete(m.privateXML, username)
+	delete(m.vCards, username)
+	delete(m.users, username)
+	return nil
+}
+
+func (m *memory) UserExists(username string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.users[username]
+	return ok, nil
+}
+
+func (m *memory) InsertOrUpdateRosterItem(ri *RosterItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	items := m.rosterItems[ri.User]
+	if items == nil {
+		items = make(map[string]*memoryRosterItem)
+		m.rosterItems[ri.User] = items
+	}
+	item := *ri
+	item.Groups = append([]string(nil), ri.Groups...)
+	if existing, ok := items[ri.Contact]; ok {
+		existing.RosterItem = item
+		return nil
+	}
+	m.seq++
+	items[ri.Contact] = &memoryRosterItem{RosterItem: item, seq: m.seq}
+	return nil
+}
+
+func (m *memory) DeleteRosterItem(user, contact string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if items := m.rosterItems[user]; items != nil {
+		delete(items, contact)
+		if len(items) == 0 {
+			delete(m.rosterItems, user)
+		}
+	}
+	return nil
+}
+
+func (m *memory) FetchRosterItem(user, contact string) (*RosterItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if items := m.rosterItems[user]; items != nil {
+		if item, ok := items[contact]; ok {
+			ri := item.copyRosterItem()
+			return &ri, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memory) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var items []*memoryRosterItem
+	for _, item := range m.rosterItems[user] {
+		items = append(items, item)
+	}
+	return sortedRosterItems(items), nil
+}
+
+func (m *memory) FetchRosterItemsAsContact(contact string) ([]RosterItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var items []*memoryRosterItem
+	for _, userItems := range m.rosterItems {
+		if item, ok := userItems[contact]; ok {
+			items = append(items, item)
+		}
+	}
+	return sortedRosterItems(items), nil
+}
+
+func (m *memory) InsertOrUpdateRosterNotification(rn *RosterNotification) error {
+	buf := new(bytes.Buffer)
+	for _, elem := range rn.Elements {
+		buf.WriteString(elem.String())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	notifications := m.rosterNotifications[rn.Contact]
+	if notifications == nil {
+		notifications = make(map[string]*memoryRosterNotification)
+		m.rosterNotifications[rn.Contact] = notifications
+	}
+	if existing, ok := notifications[rn.User]; ok {
+		existing.elementsXML = buf.String()
+		return nil
+	}
+	m.seq++
+	notifications[rn.User] = &memoryRosterNotification{
+		user:        rn.User,
+		contact:     rn.Contact,
+		elementsXML: buf.String(),
+		seq:         m.seq,
+	}
+	return nil
+}
+
+func (m *memory) DeleteRosterNotification(user, contact string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if notifications := m.rosterNotifications[contact]; notifications != nil {
+		delete(notifications, user)
+		if len(notifications) == 0 {
+			delete(m.rosterNotifications, contact)
+		}
+	}
+	return nil
+}
+
+func (m *memory) FetchRosterNotifications(contact string) ([]RosterNotification, error) {
+	m.mu.RLock()
+	var notifications []memoryRosterNotification
+	for _, n := range m.rosterNotifications[contact] {
+		notifications = append(notifications, *n)
+	}
+	m.mu.RUnlock()
+
+	// oldest notifications first
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].seq < notifications[j].seq })
+
+	var ret []RosterNotification
+	for _, n := range notifications {
+		elements, err := parseMemoryElements(n.elementsXML)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, RosterNotification{
+			User:     n.user,
+			Contact:  n.contact,
+			Elements: elements,
+		})
+	}
+	return ret, nil
+}
+
+func (m *memory) FetchVCard(username string) (xml.Element, error) {
+	m.mu.RLock()
+	vCard, ok := m.vCards[username]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	parser := xml.NewParser(bytes.NewBufferString(vCard))
+	return parser.ParseElement()
+}
+
+func (m *memory) InsertOrUpdateVCard(vCard xml.Element, username string) error {
+	rawXML := vCard.String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.vCards[username] = rawXML
+	return nil
+}
+
+func (m *memory) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
+	m.mu.RLock()
+	privateXML, ok := m.privateXML[username][namespace]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return parseMemoryElements(privateXML)
+}
+
+func (m *memory) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
+	buf := new(bytes.Buffer)
+	for _, elem := range privateXML {
+		elem.ToXML(buf, true)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nsXML := m.privateXML[username]
+	if nsXML == nil {
+		nsXML = make(map[string]string)
+		m.privateXML[username] = nsXML
+	}
+	nsXML[namespace] = buf.String()
+	return nil
+}
+
+func (m *memory) InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) error {
+	rawXML := message.String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offlineSeq++
+	m.offlineMessages[username] = append(m.offlineMessages[username], memoryOfflineMessage{
+		id:        m.offlineSeq,
+		xml:       rawXML,
+		createdAt: time.Now(),
+		expiresAt: expiresAt,
+	})
+	return nil
+}
+
+func (m *memory) CountOfflineMessages(username string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.offlineMessages[username]), nil
+}
+
+func (m *memory) FetchOfflineMessages(username string) ([]OfflineMessage, error) {
+	m.mu.RLock()
+	stored := append([]memoryOfflineMessage(nil), m.offlineMessages[username]...)
+	m.mu.RUnlock()
+
+	var ret []OfflineMessage
+	for _, msg := range stored {
+		elem, err := xml.NewParser(strings.NewReader(msg.xml)).ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, OfflineMessage{ID: msg.id, Message: elem, CreatedAt: msg.createdAt, ExpiresAt: msg.expiresAt})
+	}
+	return ret, nil
+}
+
+func (m *memory) DeleteOfflineMessages(username string, lastID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offlineMessages[username] = filterMemoryOfflineMessages(m.offlineMessages[username], func(msg *memoryOfflineMessage) bool {
+		return msg.id > lastID
+	})
+	if len(m.offlineMessages[username]) == 0 {
+		delete(m.offlineMessages, username)
+	}
+	return nil
+}
+
+func (m *memory) DeleteExpiredOfflineMessages(maxAge time.Duration) error {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for username, msgs := range m.offlineMessages {
+		msgs = filterMemoryOfflineMessages(msgs, func(msg *memoryOfflineMessage) bool {
+			if !msg.expiresAt.IsZero() && !msg.expiresAt.After(now) {
+				return false
+			}
+			return maxAge == 0 || now.Sub(msg.createdAt) <= maxAge
+		})
+		if len(msgs) == 0 {
+			delete(m.offlineMessages, username)
+		} else {
+			m.offlineMessages[username] = msgs
+		}
+	}
+	return nil
+}
+
+func (m *memory) InsertArchivedMessage(message *ArchivedMessage, username string) error {
+	peer, err := xml.NewJIDString(message.Peer, true)
+	if err != nil {
+		return err
+	}
+	rawXML := message.Message.String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.archiveSeq++
+	m.archivedMessages[username] = append(m.archivedMessages[username], memoryArchivedMessage{
+		seq:       m.archiveSeq,
+		id:        message.ID,
+		peer:      peer.String(),
+		barePeer:  peer.ToBareJID().String(),
+		xml:       rawXML,
+		createdAt: message.CreatedAt,
+	})
+	return nil
+}
+
+func (m *memory) FetchArchivedMessages(username string, query *ArchiveQuery) ([]ArchivedMessage, bool, error) {
+	m.mu.RLock()
+	stored := append([]memoryArchivedMessage(nil), m.archivedMessages[username]...)
+	m.mu.RUnlock()
+
+	var afterSeq, beforeSeq int64
+	if len(query.AfterID) > 0 {
+		if afterSeq = memoryArchiveSeq(stored, query.AfterID); afterSeq == 0 {
+			return nil, false, ErrArchiveItemNotFound
+		}
+	}
+	if len(query.BeforeID) > 0 {
+		if beforeSeq = memoryArchiveSeq(stored, query.BeforeID); beforeSeq == 0 {
+			return nil, false, ErrArchiveItemNotFound
+		}
+	}
+	var matching []memoryArchivedMessage
+	for _, msg := range stored {
+		switch {
+		case query.With != nil && query.With.IsFull() && msg.peer != query.With.String():
+			continue
+		case query.With != nil && !query.With.IsFull() && msg.barePeer != query.With.String():
+			continue
+		case !query.Start.IsZero() && msg.createdAt.Before(query.Start):
+			continue
+		case !query.End.IsZero() && msg.createdAt.After(query.End):
+			continue
+		case afterSeq > 0 && msg.seq <= afterSeq:
+			continue
+		case beforeSeq > 0 && msg.seq >= beforeSeq:
+			continue
+		}
+		matching = append(matching, msg)
+	}
+	complete := true
+	if query.Max > 0 && len(matching) > query.Max {
+		if len(query.BeforeID) > 0 || query.LastPage {
+			matching = matching[len(matching)-query.Max:]
+		} else {
+			matching = matching[:query.Max]
+		}
+		complete = false
+	}
+	var ret []ArchivedMessage
+	for _, msg := range matching {
+		elem, err := xml.NewParser(strings.NewReader(msg.xml)).ParseElement()
+		if err != nil {
+			return nil, false, err
+		}
+		ret = append(ret, ArchivedMessage{ID: msg.id, Peer: msg.peer, Message: elem, CreatedAt: msg.createdAt})
+	}
+	return ret, complete, nil
+}
+
+func (m *memory) FetchArchivePrefs(username string) (*ArchivePrefs, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	prefs, ok := m.archivePrefs[username]
+	if !ok {
+		return nil, nil
+	}
+	prefs.Always = append([]string(nil), prefs.Always...)
+	prefs.Never = append([]string(nil), prefs.Never...)
+	return &prefs, nil
+}
+
+func (m *memory) InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *prefs
+	stored.Always = append([]string(nil), prefs.Always...)
+	stored.Never = append([]string(nil), prefs.Never...)
+	m.archivePrefs[prefs.Username] = stored
+	return nil
+}
+
+func (ri *memoryRosterItem) copyRosterItem() RosterItem {
+	ret := ri.RosterItem
+	ret.Groups = append([]string(nil), ri.Groups...)
+	return ret
+}
+
+// sortedRosterItems returns roster items sorted by creation time, newest first.
+func sortedRosterItems(items []*memoryRosterItem) []RosterItem {
+	sort.Slice(items, func(i, j int) bool { return items[i].seq > items[j].seq })
+
+	var ret []RosterItem
+	for _, item := range items {
+		ret = append(ret, item.copyRosterItem())
+	}
+	return ret
+}
+
+func parseMemoryElements(rawXML string) ([]xml.Element, error) {
+	if len(rawXML) == 0 {
+		return nil, nil
+	}
+	buf := bytes.NewBufferString("<root>")
+	buf.WriteString(rawXML)
+	buf.WriteString("</root>")
+
+	parser := xml.NewParser(buf)
+	rootEl, err := parser.ParseElement()
+	if err != nil {
+		return nil, err
+	} else if rootEl == nil {
+		return nil, nil
+	}
+	return rootEl.Elements(), nil
+}
+
+func filterMemoryOfflineMessages(msgs []memoryOfflineMessage, keep func(*memoryOfflineMessage) bool) []memoryOfflineMessage {
+	var ret []memoryOfflineMessage
+	for i := range msgs {
+		if keep(&msgs[i]) {
+			ret = append(ret, msgs[i])
+		}
+	}
+	return ret
+}
+
+func memoryArchiveSeq(msgs []memoryArchivedMessage, id string) int64 {
+	for _, msg := range msgs {
+		if msg.id == id {
+			return msg.seq
+		}
+	}
+	return 0
+}
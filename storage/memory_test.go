@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	s := storage.NewMemoryStorage()
+
+	exists, err := s.UserExists("ortuman")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	assert.Nil(t, s.InsertOrUpdateUser(&storage.User{Username: "ortuman", Password: "1234"}))
+	u, err := s.FetchUser("ortuman")
+	assert.Nil(t, err)
+	assert.NotNil(t, u)
+	assert.Equal(t, u.Password, "1234")
+
+	assert.Nil(t, s.DeleteUser("ortuman"))
+	u, err = s.FetchUser("ortuman")
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+}
+
+func TestMemoryRosterItems(t *testing.T) {
+	s := storage.NewMemoryStorage()
+
+	ri1 := storage.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "both", Groups: []string{"friends"}}
+	ri2 := storage.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "none"}
+	ri3 := storage.RosterItem{User: "juliet", Contact: "romeo", Subscription: "to"}
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&ri1))
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&ri2))
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&ri3))
+
+	items, err := s.FetchRosterItemsAsUser("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, items[0].Contact, "romeo") // newest first
+
+	items, err = s.FetchRosterItemsAsContact("romeo")
+	assert.Nil(t, err)
+	assert.Equal(t, len(items), 2)
+
+	ri1.Subscription = "from"
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&ri1))
+	ri, err := s.FetchRosterItem("ortuman", "noelia")
+	assert.Nil(t, err)
+	assert.Equal(t, ri.Subscription, "from")
+	assert.Equal(t, ri.Groups, []string{"friends"})
+
+	assert.Nil(t, s.DeleteRosterItem("ortuman", "noelia"))
+	ri, err = s.FetchRosterItem("ortuman", "noelia")
+	assert.Nil(t, err)
+	assert.Nil(t, ri)
+}
+
+func TestMemoryRosterNotifications(t *testing.T) {
+	s := storage.NewMemoryStorage()
+
+	rn := storage.RosterNotification{
+		User:     "ortuman",
+		Contact:  "noelia",
+		Elements: []xml.Element{xml.NewElementName("status")},
+	}
+	assert.Nil(t, s.InsertOrUpdateRosterNotification(&rn))
+
+	rns, err := s.FetchRosterNotifications("noelia")
+	assert.Nil(t, err)
+	assert.Equal(t, len(rns), 1)
+	assert.Equal(t, rns[0].User, "ortuman")
+	assert.Equal(t, len(rns[0].Elements), 1)
+
+	assert.Nil(t, s.DeleteRosterNotification("ortuman", "noelia"))
+	rns, err = s.FetchRosterNotifications("noelia")
+	assert.Nil(t, err)
+	assert.Equal(t, len(rns), 0)
+}
+
+func TestMemoryVCardAndPrivateXML(t *testing.T) {
+	s := storage.NewMemoryStorage()
+
+	vCard := xml.NewElementNamespace("vCard", "vcard-temp")
+	fn := xml.NewElementName("FN")
+	fn.SetText("Miguel Ángel")
+	vCard.AppendElement(fn)
+	assert.Nil(t, s.InsertOrUpdateVCard(vCard, "ortuman"))
+
+	// mutating the original element must not affect stored data
+	fn.SetText("Noelia")
+
+	stored, err := s.FetchVCard("ortuman")
+	assert.Nil(t, err)
+	assert.NotNil(t, stored)
+	assert.Equal(t, stored.FindElement("FN").Text(), "Miguel Ángel")
+
+	priv := []xml.Element{xml.NewElementNamespace("exodus", "exodus:ns")}
+	assert.Nil(t, s.InsertOrUpdatePrivateXML(priv, "exodus:ns", "ortuman"))
+	elems, err := s.FetchPrivateXML("exodus:ns", "ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, len(elems), 1)
+
+	elems, err = s.FetchPrivateXML("other:ns", "ortuman")
+	assert.Nil(t, err)
+	assert.Nil(t, elems)
+}
+
+func TestMemoryOfflineMessages(t *testing.T) {
+	s := storage.NewMemoryStorage()
+
+	m1 := xml.NewElementName("message")
+	m1.SetID("1")
+	m2 := xml.NewElementName("message")
+	m2.SetID("2")
+	m3 := xml.NewElementName("message")
+	m3.SetID("3")
+	assert.Nil(t, s.InsertOfflineMessage(m1, "ortuman", time.Time{}))
+	assert.Nil(t, s.InsertOfflineMessage(m2, "ortuman", time.Time{}))
+	assert.Nil(t, s.InsertOfflineMessage(m3, "ortuman", time.Now().Add(-time.Second)))
+
+	count, err := s.CountOfflineMessages("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 3)
+
+	msgs, err := s.FetchOfflineMessages("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, len(msgs), 3)
+	assert.Equal(t, msgs[0].Message.ID(), "1")
+	assert.Equal(t, msgs[1].Message.ID(), "2")
+	assert.True(t, msgs[0].ID < msgs[1].ID)
+	assert.True(t, msgs[2].ExpiresAt.Before(time.Now()))
+
+	// only delivered messages are deleted
+	assert.Nil(t, s.DeleteOfflineMessages("ortuman", msgs[0].ID))
+	count, _ = s.CountOfflineMessages("ortuman")
+	assert.Equal(t, count, 2)
+
+	assert.Nil(t, s.DeleteExpiredOfflineMessages(0))
+	msgs, _ = s.FetchOfflineMessages("ortuman")
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Message.ID(), "2")
+
+	assert.Nil(t, s.DeleteExpiredOfflineMessages(time.Nanosecond))
+	count, _ = s.CountOfflineMessages("ortuman")
+	assert.Equal(t, count, 0)
+}
+
+func TestMemoryArchivedMessages(t *testing.T) {
+	s := storage.NewMemoryStorage()
+
+	now := time.Now()
+	peers := []string{"noelia@jackal.im/garden", "noelia@jackal.im/balcony", "romeo@jackal.im/orchard", "noelia@jackal.im/garden"}
+	for i, peer := range peers {
+		m := xml.NewElementName("message")
+		m.SetID(string(rune('a' + i)))
+		am := &storage.ArchivedMessage{ID: string(rune('A' + i)), Peer: peer, Message: m, CreatedAt: now.Add(time.Duration(i) * time.Minute)}
+		assert.Nil(t, s.InsertArchivedMessage(am, "ortuman"))
+	}
+	msgs, complete, err := s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{Max: 2})
+	assert.Nil(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, len(msgs), 2)
+	assert.Equal(t, msgs[0].ID, "A")
+	assert.Equal(t, msgs[1].Message.ID(), "b")
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{AfterID: "B", Max: 2})
+	assert.True(t, complete)
+	assert.Equal(t, len(msgs), 2)
+	assert.Equal(t, msgs[0].ID, "C")
+
+	// last page
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{LastPage: true, Max: 3})
+	assert.False(t, complete)
+	assert.Equal(t, len(msgs), 3)
+	assert.Equal(t, msgs[0].ID, "B")
+	assert.Equal(t, msgs[2].ID, "D")
+
+	bare, _ := xml.NewJIDString("noelia@jackal.im", false)
+	msgs, _, _ = s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{With: bare})
+	assert.Equal(t, len(msgs), 3)
+
+	full, _ := xml.NewJIDString("noelia@jackal.im/garden", false)
+	msgs, _, _ = s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{With: full, Start: now.Add(time.Minute)})
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].ID, "D")
+
+	_, _, err = s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{BeforeID: "Z"})
+	assert.Equal(t, err, storage.ErrArchiveItemNotFound)
+
+	prefs, err := s.FetchArchivePrefs("ortuman")
+	assert.Nil(t, err)
+	assert.Nil(t, prefs)
+
+	assert.Nil(t, s.InsertOrUpdateArchivePrefs(&storage.ArchivePrefs{Username: "ortuman", Default: "roster", Never: []string{"romeo@jackal.im"}}))
+	prefs, _ = s.FetchArchivePrefs("ortuman")
+	assert.Equal(t, prefs.Default, "roster")
+	assert.Equal(t, prefs.Never, []string{"romeo@jackal.im"})
+
+	assert.Nil(t, s.DeleteUser("ortuman"))
+	msgs, _, _ = s.FetchArchivedMessages("ortuman", &storage.ArchiveQuery{})
+	assert.Equal(t, len(msgs), 0)
+}
+
+func TestSetInstance(t *testing.T) {
+	s := storage.NewMemoryStorage()
+	storage.Set(s)
+	assert.Equal(t, storage.Instance(), s)
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// latency histogram bucket upper bounds (in milliseconds)
+var latencyBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// storage metrics are published through expvar (/debug/vars).
+var (
+	opLatencies = expvar.NewMap("storage_latency_ms")
+	opErrors    = expvar.NewMap("storage_errors")
+	opLock      sync.Mutex
+)
+
+// latencyHistogram is a cumulative latency histogram
+// satisfying expvar.Var interface.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range latencyBuckets {
+		if ms <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += ms
+}
+
+func (h *latencyHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `{"count": %d, "sum": %f, "buckets": {`, h.count, h.sum)
+	for i, b := range latencyBuckets {
+		fmt.Fprintf(buf, `"%g": %d, `, b, h.counts[i])
+	}
+	fmt.Fprintf(buf, `"+Inf": %d}}`, h.count)
+	return buf.String()
+}
+
+func opHistogram(op string) *latencyHistogram {
+	if v := opLatencies.Get(op); v != nil {
+		return v.(*latencyHistogram)
+	}
+	opLock.Lock()
+	defer opLock.Unlock()
+	if v := opLatencies.Get(op); v != nil {
+		return v.(*latencyHistogram)
+	}
+	h := newLatencyHistogram()
+	opLatencies.Set(op, h)
+	return h
+}
+
+// metricsStorage decorates a storage recording per operation
+// latencies and errors, and logging operations slower than slowThreshold.
+type metricsStorage struct {
+	storage
+	slowThreshold time.Duration
+}
+
+func newMetricsStorage(s storage, slowThreshold time.Duration) storage {
+	return &metricsStorage{storage: s, slowThreshold: slowThreshold}
+}
+
+func (m *metricsStorage) observe(op, user string, start time.Time, err *error) {
+	elapsed := time.Since(start)
+	opHistogram(op).observe(elapsed)
+	if *err != nil {
+		opErrors.Add(op, 1)
+	}
+	if m.slowThreshold > 0 && elapsed >= m.slowThreshold {
+		log.Warnf("storage: slow %s operation (user: %s): %v", op, user, elapsed)
+	}
+}
+
+func (m *metricsStorage) FetchUser(username string) (u *User, err error) {
+	defer m.observe("FetchUser", username, time.Now(), &err)
+	return m.storage.FetchUser(username)
+}
+
+func (m *metricsStorage) InsertOrUpdateUser(user *User) (err error) {
+	defer m.observe("InsertOrUpdateUser", user.Username, time.Now(), &err)
+	return m.storage.InsertOrUpdateUser(user)
+}
+
+func (m *metricsStorage) DeleteUser(username string) (err error) {
+	defer m.observe("DeleteUser", username, time.Now(), &err)
+	return m.storage.DeleteUser(username)
+}
+
+func (m *metricsStorage) UserExists(username string) (exists bool, err error) {
+	defer m.observe("UserExists", username, time.Now(), &err)
+	return m.storage.UserExists(username)
+}
+
+func (m *metricsStorage) InsertOrUpdateRosterItem(ri *RosterItem) (err error) {
+	defer m.observe("InsertOrUpdateRosterItem", ri.User, time.Now(), &err)
+	return m.storage.InsertOrUpdateRosterItem(ri)
+}
+
+func (m *metricsStorage) DeleteRosterItem(user, contact string) (err error) {
+	defer m.observe("DeleteRosterItem", user, time.Now(), &err)
+	return m.storage.DeleteRosterItem(user, contact)
+}
+
+func (m *metricsStorage) FetchRosterItem(user, contact string) (ri *RosterItem, err error) {
+	defer m.observe("FetchRosterItem", user, time.Now(), &err)
+	return m.storage.FetchRosterItem(user, contact)
+}
+
+func (m *metricsStorage) FetchRosterItemsAsUser(user string) (items []RosterItem, err error) {
+	defer m.observe("FetchRosterItemsAsUser", user, time.Now(), &err)
+	return m.storage.FetchRosterItemsAsUser(user)
+}
+
+func (m *metricsStorage) FetchRosterItemsAsContact(contact string) (items []RosterItem, err error) {
+	defer m.observe("FetchRosterItemsAsContact", contact, time.Now(), &err)
+	return m.storage.FetchRosterItemsAsContact(contact)
+}
+
+func (m *metricsStorage) InsertOrUpdateRosterNotification(rn *RosterNotification) (err error) {
+	defer m.observe("InsertOrUpdateRosterNotification", rn.Contact, time.Now(), &err)
+	return m.storage.InsertOrUpdateRosterNotification(rn)
+}
+
+func (m *metricsStorage) DeleteRosterNotification(user, contact string) (err error) {
+	defer m.observe("DeleteRosterNotification", contact, time.Now(), &err)
+	return m.storage.DeleteRosterNotification(user, contact)
+}
+
+func (m *metricsStorage) FetchRosterNotifications(contact string) (rns []RosterNotification, err error) {
+	defer m.observe("FetchRosterNotifications", contact, time.Now(), &err)
+	return m.storage.FetchRosterNotifications(contact)
+}
+
+func (m *metricsStorage) FetchVCard(username string) (vCard xml.Element, err error) {
+	defer m.observe("FetchVCard", username, time.Now(), &err)
+	return m.storage.FetchVCard(username)
+}
+
+func (m *metricsStorage) InsertOrUpdateVCard(vCard xml.Element, username string) (err error) {
+	defer m.observe("InsertOrUpdateVCard", username, time.Now(), &err)
+	return m.storage.InsertOrUpdateVCard(vCard, username)
+}
+
+func (m *metricsStorage) FetchPrivateXML(namespace string, username string) (elems []xml.Element, err error) {
+	defer m.observe("FetchPrivateXML", username, time.Now(), &err)
+	return m.storage.FetchPrivateXML(namespace, username)
+}
+
+func (m *metricsStorage) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) (err error) {
+	defer m.observe("InsertOrUpdatePrivateXML", username, time.Now(), &err)
+	return m.storage.InsertOrUpdatePrivateXML(privateXML, namespace, username)
+}
+
+func (m *metricsStorage) InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) (err error) {
+	defer m.observe("InsertOfflineMessage", username, time.Now(), &err)
+	return m.storage.InsertOfflineMessage(message, username, expiresAt)
+}
+
+func (m *metricsStorage) CountOfflineMessages(username string) (count int, err error) {
+	defer m.observe("CountOfflineMessages", username, time.Now(), &err)
+	return m.storage.CountOfflineMessages(username)
+}
+
+func (m *metricsStorage) FetchOfflineMessages(username string) (messages []OfflineMessage, err error) {
+	defer m.observe("FetchOfflineMessages", username, time.Now(), &err)
+	return m.storage.FetchOfflineMessages(username)
+}
+
+func (m *metricsStorage) DeleteOfflineMessages(username string, lastID int64) (err error) {
+	defer m.observe("DeleteOfflineMessages", username, time.Now(), &err)
+	return m.storage.DeleteOfflineMessages(username, lastID)
+}
+
+func (m *metricsStorage) DeleteExpiredOfflineMessages(maxAge time.Duration) (err error) {
+	defer m.observe("DeleteExpiredOfflineMessages", "", time.Now(), &err)
+	return m.storage.DeleteExpiredOfflineMessages(maxAge)
+}
+
+func (m *metricsStorage) InsertArchivedMessage(message *ArchivedMessage, username string) (err error) {
+	defer m.observe("InsertArchivedMessage", username, time.Now(), &err)
+	return m.storage.InsertArchivedMessage(message, username)
+}
+
+func (m *metricsStorage) FetchArchivedMessages(username string, query *ArchiveQuery) (messages []ArchivedMessage, complete bool, err error) {
+	defer m.observe("FetchArchivedMessages", username, time.Now(), &err)
+	return m.storage.FetchArchivedMessages(username, query)
+}
+
+func (m *metricsStorage) FetchArchivePrefs(username string) (prefs *ArchivePrefs, err error) {
+	defer m.observe("FetchArchivePrefs", username, time.Now(), &err)
+	return m.storage.FetchArchivePrefs(username)
+}
+
+func (m *metricsStorage) InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) (err error) {
+	defer m.observe("InsertOrUpdateArchivePrefs", prefs.Username, time.Now(), &err)
+	return m.storage.InsertOrUpdateArchivePrefs(prefs)
+}
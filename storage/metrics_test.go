@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingStorage struct {
+	storage
+}
+
+func (s *failingStorage) FetchVCard(username string) (xml.Element, error) {
+	return nil, errors.New("storage failure")
+}
+
+func TestMetricsStorage(t *testing.T) {
+	s := newMetricsStorage(&failingStorage{storage: NewMemoryStorage()}, time.Second)
+
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "ortuman"}))
+	u, err := s.FetchUser("ortuman")
+	assert.Nil(t, err)
+	assert.NotNil(t, u)
+	assert.Equal(t, opHistogram("FetchUser").count, uint64(1))
+
+	_, err = s.FetchVCard("ortuman")
+	assert.NotNil(t, err)
+	assert.Equal(t, opErrors.Get("FetchVCard").String(), "1")
+	assert.Nil(t, opErrors.Get("FetchUser"))
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	h.observe(3 * time.Millisecond)
+	h.observe(200 * time.Millisecond)
+	h.observe(10 * time.Second)
+
+	var v struct {
+		Count   uint64            `json:"count"`
+		Buckets map[string]uint64 `json:"buckets"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(h.String()), &v))
+	assert.Equal(t, v.Count, uint64(3))
+	assert.Equal(t, v.Buckets["1"], uint64(0))
+	assert.Equal(t, v.Buckets["5"], uint64(1))
+	assert.Equal(t, v.Buckets["250"], uint64(2))
+	assert.Equal(t, v.Buckets["5000"], uint64(2))
+	assert.Equal(t, v.Buckets["+Inf"], uint64(3))
+}
@@ -0,0 +1,446 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+)
+
+type sqlDialect int
+
+const (
+	mySQLDialect sqlDialect = iota
+	postgreSQLDialect
+	sqliteDialect
+)
+
+// migration represents a single schema change.
+// Statements are kept per SQL dialect and applied in order.
+type migration struct {
+	version     int
+	description string
+	mySQL       []string
+	postgreSQL  []string
+	sqlite      []string
+
+	// args returns the arguments of every migration statement, if any.
+	args func() []interface{}
+}
+
+func (m *migration) statements(d sqlDialect) []string {
+	switch d {
+	case mySQLDialect:
+		return m.mySQL
+	case postgreSQLDialect:
+		return m.postgreSQL
+	case sqliteDialect:
+		return m.sqlite
+	}
+	return nil
+}
+
+// migrations contains every schema change ordered by version.
+// Once released a migration must never be modified; append a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		mySQL: []string{`
+CREATE TABLE IF NOT EXISTS users (
+    username VARCHAR(256) PRIMARY KEY,
+    password TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`, `
+CREATE TABLE IF NOT EXISTS roster_items (
+    user VARCHAR(256) NOT NULL,
+    contact VARCHAR(256) NOT NULL,
+    name TEXT NOT NULL,
+    subscription TEXT NOT NULL,
+    groups TEXT NOT NULL,
+    ask BOOL NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user, contact),
+    INDEX i_roster_items_user (user),
+    INDEX i_roster_items_contact_domain (contact)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`, `
+CREATE TABLE IF NOT EXISTS roster_notifications (
+    user VARCHAR(256) NOT NULL,
+    contact VARCHAR(256) NOT NULL,
+    elements TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user, contact),
+    INDEX i_approval_notifications_jid (contact)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`, `
+CREATE TABLE IF NOT EXISTS private_storage (
+    username VARCHAR(256) NOT NULL,
+    namespace VARCHAR(512) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, namespace),
+    INDEX i_private_storage_username (username)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`, `
+CREATE TABLE IF NOT EXISTS vcards (
+    username VARCHAR(256) PRIMARY KEY,
+    vcard MEDIUMTEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`, `
+CREATE TABLE IF NOT EXISTS offline_messages (
+    username VARCHAR(256) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX i_offline_messages_username (username)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`,
+		},
+		postgreSQL: []string{`
+CREATE TABLE IF NOT EXISTS users (
+    username VARCHAR(256) PRIMARY KEY,
+    password TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+)`, `
+CREATE TABLE IF NOT EXISTS roster_items (
+    "user" VARCHAR(256) NOT NULL,
+    contact VARCHAR(256) NOT NULL,
+    name TEXT NOT NULL,
+    subscription TEXT NOT NULL,
+    groups TEXT NOT NULL,
+    ask BOOLEAN NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY ("user", contact)
+)`,
+			`CREATE INDEX IF NOT EXISTS i_roster_items_user ON roster_items("user")`,
+			`CREATE INDEX IF NOT EXISTS i_roster_items_contact_domain ON roster_items(contact)`, `
+CREATE TABLE IF NOT EXISTS roster_notifications (
+    "user" VARCHAR(256) NOT NULL,
+    contact VARCHAR(256) NOT NULL,
+    elements TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY ("user", contact)
+)`,
+			`CREATE INDEX IF NOT EXISTS i_approval_notifications_jid ON roster_notifications(contact)`, `
+CREATE TABLE IF NOT EXISTS private_storage (
+    username VARCHAR(256) NOT NULL,
+    namespace VARCHAR(512) NOT NULL,
+    data TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (username, namespace)
+)`,
+			`CREATE INDEX IF NOT EXISTS i_private_storage_username ON private_storage(username)`, `
+CREATE TABLE IF NOT EXISTS vcards (
+    username VARCHAR(256) PRIMARY KEY,
+    vcard TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+)`, `
+CREATE TABLE IF NOT EXISTS offline_messages (
+    id BIGSERIAL PRIMARY KEY,
+    username VARCHAR(256) NOT NULL,
+    data TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_username ON offline_messages(username)`,
+		},
+		sqlite: []string{`
+CREATE TABLE IF NOT EXISTS users (
+    username TEXT PRIMARY KEY,
+    password TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+)`, `
+CREATE TABLE IF NOT EXISTS roster_items (
+    user TEXT NOT NULL,
+    contact TEXT NOT NULL,
+    name TEXT NOT NULL,
+    subscription TEXT NOT NULL,
+    "groups" TEXT NOT NULL,
+    ask BOOL NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user, contact)
+)`,
+			`CREATE INDEX IF NOT EXISTS i_roster_items_user ON roster_items(user)`,
+			`CREATE INDEX IF NOT EXISTS i_roster_items_contact_domain ON roster_items(contact)`, `
+CREATE TABLE IF NOT EXISTS roster_notifications (
+    user TEXT NOT NULL,
+    contact TEXT NOT NULL,
+    elements TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user, contact)
+)`,
+			`CREATE INDEX IF NOT EXISTS i_approval_notifications_jid ON roster_notifications(contact)`, `
+CREATE TABLE IF NOT EXISTS private_storage (
+    username TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    data TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, namespace)
+)`,
+			`CREATE INDEX IF NOT EXISTS i_private_storage_username ON private_storage(username)`, `
+CREATE TABLE IF NOT EXISTS vcards (
+    username TEXT PRIMARY KEY,
+    vcard TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+)`, `
+CREATE TABLE IF NOT EXISTS offline_messages (
+    username TEXT NOT NULL,
+    data TEXT NOT NULL,
+    created_at DATETIME NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_username ON offline_messages(username)`,
+		},
+	},
+	{
+		version:     2,
+		description: "hashed user credentials",
+		mySQL: []string{`
+ALTER TABLE users
+    ADD COLUMN password_hash VARCHAR(256) NOT NULL DEFAULT '' AFTER password,
+    ADD COLUMN scram_sha1 VARCHAR(512) NOT NULL DEFAULT '' AFTER password_hash,
+    ADD COLUMN scram_sha256 VARCHAR(512) NOT NULL DEFAULT '' AFTER scram_sha1`,
+		},
+		postgreSQL: []string{`
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS password_hash VARCHAR(256) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS scram_sha1 VARCHAR(512) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS scram_sha256 VARCHAR(512) NOT NULL DEFAULT ''`,
+		},
+		sqlite: []string{
+			`ALTER TABLE users ADD COLUMN password_hash TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN scram_sha1 TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN scram_sha256 TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     3,
+		description: "offline message identifiers and expiration",
+		mySQL: []string{`
+ALTER TABLE offline_messages
+    ADD COLUMN id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST,
+    ADD COLUMN expires_at DATETIME NULL AFTER data,
+    ADD INDEX i_offline_messages_created_at (created_at),
+    ADD INDEX i_offline_messages_expires_at (expires_at)`,
+		},
+		postgreSQL: []string{
+			`ALTER TABLE offline_messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP NULL`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_created_at ON offline_messages(created_at)`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_expires_at ON offline_messages(expires_at)`,
+		},
+		sqlite: []string{`
+CREATE TABLE offline_messages_v3 (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL,
+    data TEXT NOT NULL,
+    expires_at DATETIME NULL,
+    created_at DATETIME NOT NULL
+)`, `
+INSERT INTO offline_messages_v3(username, data, created_at)
+    SELECT username, data, created_at FROM offline_messages ORDER BY created_at, rowid`,
+			`DROP TABLE offline_messages`,
+			`ALTER TABLE offline_messages_v3 RENAME TO offline_messages`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_username ON offline_messages(username)`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_created_at ON offline_messages(created_at)`,
+			`CREATE INDEX IF NOT EXISTS i_offline_messages_expires_at ON offline_messages(expires_at)`,
+		},
+	},
+	{
+		version:     4,
+		description: "message archive",
+		mySQL: []string{`
+CREATE TABLE IF NOT EXISTS archive_messages (
+    seq BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    id VARCHAR(64) NOT NULL,
+    username VARCHAR(256) NOT NULL,
+    peer VARCHAR(512) NOT NULL,
+    bare_peer VARCHAR(512) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    UNIQUE INDEX i_archive_messages_username_id (username, id),
+    INDEX i_archive_messages_username_created_at (username, created_at)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`, `
+CREATE TABLE IF NOT EXISTS archive_prefs (
+    username VARCHAR(256) PRIMARY KEY,
+    default_mode VARCHAR(16) NOT NULL,
+    always_jids TEXT NOT NULL,
+    never_jids TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`,
+		},
+		postgreSQL: []string{`
+CREATE TABLE IF NOT EXISTS archive_messages (
+    seq BIGSERIAL PRIMARY KEY,
+    id VARCHAR(64) NOT NULL,
+    username VARCHAR(256) NOT NULL,
+    peer VARCHAR(512) NOT NULL,
+    bare_peer VARCHAR(512) NOT NULL,
+    data TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS i_archive_messages_username_id ON archive_messages(username, id)`,
+			`CREATE INDEX IF NOT EXISTS i_archive_messages_username_created_at ON archive_messages(username, created_at)`, `
+CREATE TABLE IF NOT EXISTS archive_prefs (
+    username VARCHAR(256) PRIMARY KEY,
+    default_mode VARCHAR(16) NOT NULL,
+    always_jids TEXT NOT NULL,
+    never_jids TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+)`,
+		},
+		sqlite: []string{`
+CREATE TABLE IF NOT EXISTS archive_messages (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT NOT NULL,
+    username TEXT NOT NULL,
+    peer TEXT NOT NULL,
+    bare_peer TEXT NOT NULL,
+    data TEXT NOT NULL,
+    created_at DATETIME NOT NULL
+)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS i_archive_messages_username_id ON archive_messages(username, id)`,
+			`CREATE INDEX IF NOT EXISTS i_archive_messages_username_created_at ON archive_messages(username, created_at)`, `
+CREATE TABLE IF NOT EXISTS archive_prefs (
+    username TEXT PRIMARY KEY,
+    default_mode TEXT NOT NULL,
+    always_jids TEXT NOT NULL,
+    never_jids TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+)`,
+		},
+	},
+	{
+		version:     5,
+		description: "roster contact JIDs",
+		mySQL: []string{
+			`UPDATE roster_items SET contact = CONCAT(contact, '@', ?) WHERE contact NOT LIKE '%@%'`,
+			`UPDATE roster_notifications SET user = CONCAT(user, '@', ?) WHERE user NOT LIKE '%@%'`,
+		},
+		postgreSQL: []string{
+			`UPDATE roster_items SET contact = contact || '@' || $1::text WHERE contact NOT LIKE '%@%'`,
+			`UPDATE roster_notifications SET "user" = "user" || '@' || $1::text WHERE "user" NOT LIKE '%@%'`,
+		},
+		sqlite: []string{
+			`UPDATE roster_items SET contact = contact || '@' || ? WHERE contact NOT LIKE '%@%'`,
+			`UPDATE roster_notifications SET user = user || '@' || ? WHERE user NOT LIKE '%@%'`,
+		},
+		// contacts used to be stored by username, being users of default domain
+		args: func() []interface{} {
+			return []interface{}{config.DefaultConfig.C2S.Domains[0]}
+		},
+	},
+}
+
+// schemaVersion returns the latest schema version known by this build.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// prepareSchema brings database schema up to date when auto migration is enabled.
+// Otherwise it just verifies that the schema is not outdated.
+func prepareSchema(db *sql.DB, d sqlDialect) error {
+	if err := createSchemaVersionTable(db, d); err != nil {
+		return err
+	}
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > schemaVersion() {
+		return fmt.Errorf("storage: database schema version %d is newer than supported version %d", current, schemaVersion())
+	}
+	if current == schemaVersion() {
+		return nil
+	}
+	if !config.DefaultConfig.Storage.AutoMigrate {
+		return fmt.Errorf("storage: database schema version %d is outdated (expected %d): run jackal with -migrate flag", current, schemaVersion())
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, d, &m); err != nil {
+			return fmt.Errorf("storage: migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		log.Infof("applied schema migration %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+func createSchemaVersionTable(db *sql.DB, d sqlDialect) error {
+	var stmt string
+	switch d {
+	case mySQLDialect:
+		stmt = `` +
+			`CREATE TABLE IF NOT EXISTS schema_version (` +
+			` version INT NOT NULL PRIMARY KEY, description TEXT NOT NULL, applied_at DATETIME NOT NULL` +
+			`) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci`
+	case postgreSQLDialect:
+		stmt = `` +
+			`CREATE TABLE IF NOT EXISTS schema_version (` +
+			` version INT NOT NULL PRIMARY KEY, description TEXT NOT NULL, applied_at TIMESTAMP NOT NULL)`
+	case sqliteDialect:
+		stmt = `` +
+			`CREATE TABLE IF NOT EXISTS schema_version (` +
+			` version INT NOT NULL PRIMARY KEY, description TEXT NOT NULL, applied_at DATETIME NOT NULL)`
+	}
+	_, err := db.Exec(stmt)
+	return err
+}
+
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// applyMigration runs every migration statement and records its version within a single transaction.
+// Note that MySQL implicitly commits DDL statements, hence they can't be rolled back on failure.
+func applyMigration(db *sql.DB, d sqlDialect, m *migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var args []interface{}
+	if m.args != nil {
+		args = m.args()
+	}
+	for _, stmt := range m.statements(d) {
+		if _, err := tx.Exec(stmt, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var insertStmt string
+	switch d {
+	case postgreSQLDialect:
+		insertStmt = "INSERT INTO schema_version(version, description, applied_at) VALUES($1, $2, NOW())"
+	case sqliteDialect:
+		insertStmt = "INSERT INTO schema_version(version, description, applied_at) VALUES(?, ?, CURRENT_TIMESTAMP)"
+	default:
+		insertStmt = "INSERT INTO schema_version(version, description, applied_at) VALUES(?, ?, NOW())"
+	}
+	if _, err := tx.Exec(insertStmt, m.version, m.description); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,23 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsOrder(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, m.version, i+1)
+		assert.NotEqual(t, len(m.description), 0)
+		for _, d := range []sqlDialect{mySQLDialect, postgreSQLDialect, sqliteDialect} {
+			assert.NotEqual(t, len(m.statements(d)), 0)
+		}
+	}
+	assert.Equal(t, schemaVersion(), len(migrations))
+}
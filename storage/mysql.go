@@ -10,6 +10,8 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	// SQL driver implementation
 	_ "github.com/go-sql-driver/mysql"
@@ -21,8 +23,12 @@ import (
 
 const maxTransactionRetries = 4
 
+const replicaCheckInterval = 5 * time.Second
+
 type mySQL struct {
-	db *sql.DB
+	db       *sql.DB
+	replicas []*mySQLReplica
+	next     uint32
 }
 
 func newMySQLStorage() storage {
@@ -33,12 +39,8 @@ func newMySQLStorage() storage {
 	db := config.DefaultConfig.Storage.MySQL.Database
 	poolSize := config.DefaultConfig.Storage.MySQL.PoolSize
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", user, pass, host, db)
-	conn, err := sql.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("%v", err)
-	}
-	err = conn.Ping()
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", user, pass, host, db)
+	conn, err := openDB("mysql", dsn)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -46,16 +48,43 @@ func newMySQLStorage() storage {
 	// set max opened connection count
 	conn.SetMaxOpenConns(poolSize)
 
+	if err := prepareSchema(conn, mySQLDialect); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	s.db = conn
+
+	// open read replica connections
+	for _, replicaHost := range config.DefaultConfig.Storage.MySQL.Replicas {
+		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", user, pass, replicaHost, db)
+		r, err := newMySQLReplica(replicaHost, dsn, poolSize)
+		if err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		s.replicas = append(s.replicas, r)
+	}
+	if len(s.replicas) > 0 {
+		go s.monitorReplicas()
+	}
 	return s
 }
 
+func (s *mySQL) ping() error {
+	return s.db.Ping()
+}
+
 func (s *mySQL) FetchUser(username string) (*User, error) {
-	row := s.db.QueryRow("SELECT username, password FROM users WHERE username = ?", username)
+	stmt := "SELECT username, password, password_hash, scram_sha1, scram_sha256 FROM users WHERE username = ?"
+	row := s.db.QueryRow(stmt, username)
 	u := User{}
-	err := row.Scan(&u.Username, &u.Password)
+	var scramSHA1, scramSHA256 string
+	err := row.Scan(&u.Username, &u.Password, &u.PasswordHash, &scramSHA1, &scramSHA256)
 	switch err {
 	case nil:
+		if err := decodeUserCredentials(&u, scramSHA1, scramSHA256); err != nil {
+			return nil, err
+		}
 		return &u, nil
 	case sql.ErrNoRows:
 		return nil, nil
@@ -65,11 +94,23 @@ func (s *mySQL) FetchUser(username string) (*User, error) {
 }
 
 func (s *mySQL) InsertOrUpdateUser(u *User) error {
+	scramSHA1, scramSHA256 := encodeUserCredentials(u)
+	params := []interface{}{
+		u.Username,
+		u.Password,
+		u.PasswordHash,
+		scramSHA1,
+		scramSHA256,
+		u.Password,
+		u.PasswordHash,
+		scramSHA1,
+		scramSHA256,
+	}
 	stmt := `` +
-		`INSERT INTO users(username, password, updated_at, created_at)` +
-		`VALUES(?, ?, NOW(), NOW())` +
-		`ON DUPLICATE KEY UPDATE password = ?, updated_at = NOW()`
-	_, err := s.db.Exec(stmt, u.Username, u.Password, u.Password)
+		`INSERT INTO users(username, password, password_hash, scram_sha1, scram_sha256, updated_at, created_at)` +
+		`VALUES(?, ?, ?, ?, ?, NOW(), NOW())` +
+		`ON DUPLICATE KEY UPDATE password = ?, password_hash = ?, scram_sha1 = ?, scram_sha256 = ?, updated_at = NOW()`
+	_, err := s.db.Exec(stmt, params...)
 	return err
 }
 
@@ -80,7 +121,19 @@ func (s *mySQL) DeleteUser(username string) error {
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec("DELETE FROM roster_items WHERE username = ?", username)
+		_, err = tx.Exec("DELETE FROM archive_messages WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM archive_prefs WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM roster_items WHERE user = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM roster_notifications WHERE contact = ?", username)
 		if err != nil {
 			return err
 		}
@@ -101,7 +154,7 @@ func (s *mySQL) DeleteUser(username string) error {
 }
 
 func (s *mySQL) UserExists(username string) (bool, error) {
-	row := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username)
+	row := s.queryRow("SELECT COUNT(*) FROM users WHERE username = ?", username)
 	var count int
 	err := row.Scan(&count)
 	switch err {
@@ -162,7 +215,7 @@ func (s *mySQL) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
 		` FROM roster_items WHERE  user = ?` +
 		` ORDER BY created_at DESC`
 
-	rows, err := s.db.Query(stmt, user)
+	rows, err := s.query(stmt, user)
 	if err != nil {
 		return nil, err
 	}
@@ -238,7 +291,7 @@ func (s *mySQL) FetchRosterNotifications(contact string) ([]RosterNotification,
 }
 
 func (s *mySQL) FetchVCard(username string) (xml.Element, error) {
-	row := s.db.QueryRow("SELECT vcard FROM vcards WHERE username = ?", username)
+	row := s.queryRow("SELECT vcard FROM vcards WHERE username = ?", username)
 	var vCard string
 	err := row.Scan(&vCard)
 	switch err {
@@ -264,7 +317,7 @@ func (s *mySQL) InsertOrUpdateVCard(vCard xml.Element, username string) error {
 }
 
 func (s *mySQL) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
-	row := s.db.QueryRow("SELECT data FROM private_storage WHERE username = ? AND namespace = ?", username, namespace)
+	row := s.queryRow("SELECT data FROM private_storage WHERE username = ? AND namespace = ?", username, namespace)
 	var privateXML string
 	err := row.Scan(&privateXML)
 	switch err {
@@ -300,14 +353,14 @@ func (s *mySQL) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace str
 	return err
 }
 
-func (s *mySQL) InsertOfflineMessage(message xml.Element, username string) error {
-	stmt := `INSERT INTO offline_messages(username, data, created_at) VALUES(?, ?, NOW())`
-	_, err := s.db.Exec(stmt, username, message.String())
+func (s *mySQL) InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) error {
+	stmt := `INSERT INTO offline_messages(username, data, expires_at, created_at) VALUES(?, ?, ?, ?)`
+	_, err := s.db.Exec(stmt, username, message.String(), nullTime(expiresAt), time.Now().UTC())
 	return err
 }
 
 func (s *mySQL) CountOfflineMessages(username string) (int, error) {
-	row := s.db.QueryRow("SELECT COUNT(*) FROM offline_messages WHERE username = ? ORDER BY created_at", username)
+	row := s.db.QueryRow("SELECT COUNT(*) FROM offline_messages WHERE username = ?", username)
 	var count int
 	err := row.Scan(&count)
 	switch err {
@@ -318,36 +371,119 @@ func (s *mySQL) CountOfflineMessages(username string) (int, error) {
 	}
 }
 
-func (s *mySQL) FetchOfflineMessages(username string) ([]xml.Element, error) {
-	rows, err := s.db.Query("SELECT data FROM offline_messages WHERE username = ? ORDER BY created_at", username)
+func (s *mySQL) FetchOfflineMessages(username string) ([]OfflineMessage, error) {
+	stmt := "SELECT id, data, created_at, expires_at FROM offline_messages WHERE username = ? ORDER BY id"
+	rows, err := s.db.Query(stmt, username)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	buf := bytes.NewBufferString("<root>")
-	for rows.Next() {
-		var msg string
-		rows.Scan(&msg)
-		buf.WriteString(msg)
+	return offlineMessagesFromRows(rows)
+}
+
+func (s *mySQL) DeleteOfflineMessages(username string, lastID int64) error {
+	_, err := s.db.Exec("DELETE FROM offline_messages WHERE username = ? AND id <= ?", username, lastID)
+	return err
+}
+
+func (s *mySQL) DeleteExpiredOfflineMessages(maxAge time.Duration) error {
+	now := time.Now().UTC()
+	if maxAge == 0 {
+		_, err := s.db.Exec("DELETE FROM offline_messages WHERE expires_at <= ?", now)
+		return err
 	}
-	buf.WriteString("</root>")
+	stmt := "DELETE FROM offline_messages WHERE expires_at <= ? OR created_at < ?"
+	_, err := s.db.Exec(stmt, now, now.Add(-maxAge))
+	return err
+}
 
-	parser := xml.NewParser(bytes.NewReader(buf.Bytes()))
-	rootEl, err := parser.ParseElement()
+func (s *mySQL) InsertArchivedMessage(message *ArchivedMessage, username string) error {
+	peer, err := xml.NewJIDString(message.Peer, true)
 	if err != nil {
-		return nil, err
-	} else if rootEl == nil {
-		return nil, nil
+		return err
 	}
-	return rootEl.Elements(), nil
+	stmt := `INSERT INTO archive_messages(id, username, peer, bare_peer, data, created_at) VALUES(?, ?, ?, ?, ?, ?)`
+	_, err = s.db.Exec(stmt, message.ID, username, peer.String(), peer.ToBareJID().String(), message.Message.String(), message.CreatedAt.UTC())
+	return err
+}
+
+func (s *mySQL) FetchArchivedMessages(username string, query *ArchiveQuery) ([]ArchivedMessage, bool, error) {
+	return fetchArchivedMessages(s.db.Query, mySQLDialect, username, query)
+}
+
+func (s *mySQL) FetchArchivePrefs(username string) (*ArchivePrefs, error) {
+	row := s.db.QueryRow("SELECT default_mode, always_jids, never_jids FROM archive_prefs WHERE username = ?", username)
+	return archivePrefsFromRow(row, username)
 }
 
-func (s *mySQL) DeleteOfflineMessages(username string) error {
-	_, err := s.db.Exec("DELETE FROM offline_messages WHERE username = ?", username)
+func (s *mySQL) InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) error {
+	stmt := `` +
+		`INSERT INTO archive_prefs(username, default_mode, always_jids, never_jids, updated_at, created_at)` +
+		`VALUES(?, ?, ?, ?, NOW(), NOW())` +
+		`ON DUPLICATE KEY UPDATE default_mode = ?, always_jids = ?, never_jids = ?, updated_at = NOW()`
+
+	always := strings.Join(prefs.Always, archivePrefsSeparator)
+	never := strings.Join(prefs.Never, archivePrefsSeparator)
+	_, err := s.db.Exec(stmt, prefs.Username, prefs.Default, always, never, prefs.Default, always, never)
 	return err
 }
 
+// query executes a read-only query on an available replica,
+// falling back to primary database on failure.
+// Reads that may not lag behind the primary, such as those
+// preceding an update, must be run against s.db instead.
+func (s *mySQL) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if r := s.replica(); r != nil {
+		rows, err := r.db.Query(query, args...)
+		if err == nil {
+			return rows, nil
+		}
+		r.setAvailable(false, err)
+	}
+	return s.db.Query(query, args...)
+}
+
+// queryRow executes a read-only single row query on an available replica,
+// falling back to primary database on failure.
+func (s *mySQL) queryRow(query string, args ...interface{}) *sql.Row {
+	if r := s.replica(); r != nil {
+		row := r.db.QueryRow(query, args...)
+		err := row.Err()
+		if err == nil {
+			return row
+		}
+		r.setAvailable(false, err)
+	}
+	return s.db.QueryRow(query, args...)
+}
+
+// replica returns next available read replica in a round-robin fashion.
+func (s *mySQL) replica() *mySQLReplica {
+	n := len(s.replicas)
+	if n == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&s.next, 1)
+	for i := 0; i < n; i++ {
+		r := s.replicas[(int(start)+i)%n]
+		if r.isAvailable() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *mySQL) monitorReplicas() {
+	tc := time.NewTicker(replicaCheckInterval)
+	defer tc.Stop()
+	for range tc.C {
+		for _, r := range s.replicas {
+			r.check()
+		}
+	}
+}
+
 func (s *mySQL) inTransaction(f func(tx *sql.Tx) error) error {
 	var err error
 	for i := 0; i < maxTransactionRetries; i++ {
@@ -360,7 +496,7 @@ func (s *mySQL) inTransaction(f func(tx *sql.Tx) error) error {
 			tx.Rollback()
 			continue
 		}
-		tx.Commit()
+		return tx.Commit()
 	}
 	return err
 }
@@ -385,3 +521,49 @@ func (s *mySQL) rosterItemFromRows(rows *sql.Rows) (*RosterItem, error) {
 	ri.Groups = strings.Split(groups, ";")
 	return &ri, nil
 }
+
+type mySQLReplica struct {
+	host      string
+	db        *sql.DB
+	available int32
+}
+
+func newMySQLReplica(host, dsn string, poolSize int) (*mySQLReplica, error) {
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(poolSize)
+
+	r := &mySQLReplica{host: host, db: conn}
+	if err := conn.Ping(); err != nil {
+		log.Warnf("mysql: replica %s unavailable: %v", host, err)
+	} else {
+		r.available = 1
+	}
+	return r, nil
+}
+
+func (r *mySQLReplica) isAvailable() bool {
+	return atomic.LoadInt32(&r.available) == 1
+}
+
+func (r *mySQLReplica) check() {
+	err := r.db.Ping()
+	r.setAvailable(err == nil, err)
+}
+
+func (r *mySQLReplica) setAvailable(available bool, err error) {
+	var v int32
+	if available {
+		v = 1
+	}
+	if atomic.SwapInt32(&r.available, v) == v {
+		return
+	}
+	if available {
+		log.Infof("mysql: replica %s available", r.host)
+	} else {
+		log.Warnf("mysql: replica %s unavailable: %v", r.host, err)
+	}
+}
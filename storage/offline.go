@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// nullTime maps a zero time to SQL NULL.
+// Stored times are always kept in UTC.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+func offlineMessagesFromRows(rows *sql.Rows) ([]OfflineMessage, error) {
+	var ret []OfflineMessage
+	for rows.Next() {
+		var m OfflineMessage
+		var data string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&m.ID, &data, &m.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		elem, err := xml.NewParser(strings.NewReader(data)).ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		m.Message = elem
+		if expiresAt.Valid {
+			m.ExpiresAt = expiresAt.Time
+		}
+		ret = append(ret, m)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,436 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	// SQL driver implementation
+	_ "github.com/lib/pq"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+type postgreSQL struct {
+	db *sql.DB
+}
+
+func newPostgreSQLStorage() storage {
+	s := &postgreSQL{}
+	cfg := config.DefaultConfig.Storage.PostgreSQL
+
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.User, cfg.Password),
+		Host:     cfg.Host,
+		Path:     cfg.Database,
+		RawQuery: url.Values{"sslmode": []string{cfg.SSLMode}}.Encode(),
+	}
+	conn, err := openDB("postgres", dsn.String())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// set max opened connection count
+	conn.SetMaxOpenConns(cfg.PoolSize)
+
+	if err := prepareSchema(conn, postgreSQLDialect); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	s.db = conn
+	return s
+}
+
+func (s *postgreSQL) ping() error {
+	return s.db.Ping()
+}
+
+func (s *postgreSQL) FetchUser(username string) (*User, error) {
+	stmt := "SELECT username, password, password_hash, scram_sha1, scram_sha256 FROM users WHERE username = $1"
+	row := s.db.QueryRow(stmt, username)
+	u := User{}
+	var scramSHA1, scramSHA256 string
+	err := row.Scan(&u.Username, &u.Password, &u.PasswordHash, &scramSHA1, &scramSHA256)
+	switch err {
+	case nil:
+		if err := decodeUserCredentials(&u, scramSHA1, scramSHA256); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *postgreSQL) InsertOrUpdateUser(u *User) error {
+	scramSHA1, scramSHA256 := encodeUserCredentials(u)
+	stmt := `` +
+		`INSERT INTO users(username, password, password_hash, scram_sha1, scram_sha256, updated_at, created_at)` +
+		` VALUES($1, $2, $3, $4, $5, NOW(), NOW())` +
+		` ON CONFLICT (username) DO UPDATE SET password = $2, password_hash = $3, scram_sha1 = $4, scram_sha256 = $5,` +
+		` updated_at = NOW()`
+	_, err := s.db.Exec(stmt, u.Username, u.Password, u.PasswordHash, scramSHA1, scramSHA256)
+	return err
+}
+
+func (s *postgreSQL) DeleteUser(username string) error {
+	return s.inTransaction(func(tx *sql.Tx) error {
+		var err error
+		_, err = tx.Exec("DELETE FROM offline_messages WHERE username = $1", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM archive_messages WHERE username = $1", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM archive_prefs WHERE username = $1", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM roster_items WHERE "user" = $1`, username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM roster_notifications WHERE contact = $1", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM private_storage WHERE username = $1", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM vcards WHERE username = $1", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM users WHERE username = $1", username)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *postgreSQL) UserExists(username string) (bool, error) {
+	row := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = $1", username)
+	var count int
+	err := row.Scan(&count)
+	switch err {
+	case nil:
+		return count > 0, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *postgreSQL) InsertOrUpdateRosterItem(ri *RosterItem) error {
+	groups := strings.Join(ri.Groups, ";")
+	params := []interface{}{
+		ri.User,
+		ri.Contact,
+		ri.Name,
+		ri.Subscription,
+		groups,
+		ri.Ask,
+	}
+	stmt := `` +
+		`INSERT INTO roster_items("user", contact, name, subscription, groups, ask, updated_at, created_at)` +
+		` VALUES($1, $2, $3, $4, $5, $6, NOW(), NOW())` +
+		` ON CONFLICT ("user", contact) DO UPDATE SET name = $3, subscription = $4, groups = $5, ask = $6, updated_at = NOW()`
+	_, err := s.db.Exec(stmt, params...)
+	return err
+}
+
+func (s *postgreSQL) DeleteRosterItem(user, contact string) error {
+	stmt := `DELETE FROM roster_items WHERE "user" = $1 AND contact = $2`
+	_, err := s.db.Exec(stmt, user, contact)
+	return err
+}
+
+func (s *postgreSQL) FetchRosterItem(user, contact string) (*RosterItem, error) {
+	stmt := `` +
+		`SELECT "user", contact, name, subscription, groups, ask` +
+		` FROM roster_items WHERE "user" = $1 AND contact = $2`
+	rows, err := s.db.Query(stmt, user, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return s.rosterItemFromRows(rows)
+	}
+	return nil, nil
+}
+
+func (s *postgreSQL) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
+	stmt := `` +
+		`SELECT "user", contact, name, subscription, groups, ask` +
+		` FROM roster_items WHERE "user" = $1` +
+		` ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(stmt, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.rosterItemsFromRows(rows)
+}
+
+func (s *postgreSQL) FetchRosterItemsAsContact(contact string) ([]RosterItem, error) {
+	stmt := `` +
+		`SELECT "user", contact, name, subscription, groups, ask` +
+		` FROM roster_items WHERE contact = $1` +
+		` ORDER BY created_at DESC`
+	rows, err := s.db.Query(stmt, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.rosterItemsFromRows(rows)
+}
+
+func (s *postgreSQL) InsertOrUpdateRosterNotification(rn *RosterNotification) error {
+	stmt := `` +
+		`INSERT INTO roster_notifications("user", contact, elements, updated_at, created_at)` +
+		` VALUES($1, $2, $3, NOW(), NOW())` +
+		` ON CONFLICT ("user", contact) DO UPDATE SET elements = $3, updated_at = NOW()`
+
+	buf := new(bytes.Buffer)
+	for _, elem := range rn.Elements {
+		buf.WriteString(elem.String())
+	}
+	elementsXML := buf.String()
+	_, err := s.db.Exec(stmt, rn.User, rn.Contact, elementsXML)
+	return err
+}
+
+func (s *postgreSQL) DeleteRosterNotification(user, contact string) error {
+	_, err := s.db.Exec(`DELETE FROM roster_notifications WHERE "user" = $1 AND contact = $2`, user, contact)
+	return err
+}
+
+func (s *postgreSQL) FetchRosterNotifications(contact string) ([]RosterNotification, error) {
+	stmt := `SELECT "user", contact, elements FROM roster_notifications WHERE contact = $1 ORDER BY created_at`
+	rows, err := s.db.Query(stmt, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buf := new(bytes.Buffer)
+
+	var ret []RosterNotification
+	for rows.Next() {
+		var rn RosterNotification
+		var notificationXML string
+		rows.Scan(&rn.User, &rn.Contact, &notificationXML)
+		buf.Reset()
+		buf.WriteString("<root>")
+		buf.WriteString(notificationXML)
+		buf.WriteString("</root>")
+
+		parser := xml.NewParser(buf)
+		root, err := parser.ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		rn.Elements = root.Elements()
+
+		ret = append(ret, rn)
+	}
+	return ret, nil
+}
+
+func (s *postgreSQL) FetchVCard(username string) (xml.Element, error) {
+	row := s.db.QueryRow("SELECT vcard FROM vcards WHERE username = $1", username)
+	var vCard string
+	err := row.Scan(&vCard)
+	switch err {
+	case nil:
+		parser := xml.NewParser(strings.NewReader(vCard))
+		return parser.ParseElement()
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *postgreSQL) InsertOrUpdateVCard(vCard xml.Element, username string) error {
+	stmt := `` +
+		`INSERT INTO vcards(username, vcard, updated_at, created_at)` +
+		` VALUES($1, $2, NOW(), NOW())` +
+		` ON CONFLICT (username) DO UPDATE SET vcard = $2, updated_at = NOW()`
+
+	rawXML := vCard.String()
+	_, err := s.db.Exec(stmt, username, rawXML)
+	return err
+}
+
+func (s *postgreSQL) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
+	row := s.db.QueryRow("SELECT data FROM private_storage WHERE username = $1 AND namespace = $2", username, namespace)
+	var privateXML string
+	err := row.Scan(&privateXML)
+	switch err {
+	case nil:
+		reader := strings.NewReader(fmt.Sprintf("<root>%s</root>", privateXML))
+		parser := xml.NewParser(reader)
+		rootEl, err := parser.ParseElement()
+		if err != nil {
+			return nil, err
+		} else if rootEl != nil {
+			return rootEl.Elements(), nil
+		}
+		fallthrough
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *postgreSQL) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
+	stmt := `` +
+		`INSERT INTO private_storage(username, namespace, data, updated_at, created_at)` +
+		` VALUES($1, $2, $3, NOW(), NOW())` +
+		` ON CONFLICT (username, namespace) DO UPDATE SET data = $3, updated_at = NOW()`
+
+	buf := new(bytes.Buffer)
+	for _, elem := range privateXML {
+		elem.ToXML(buf, true)
+	}
+	rawXML := buf.String()
+	_, err := s.db.Exec(stmt, username, namespace, rawXML)
+	return err
+}
+
+func (s *postgreSQL) InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) error {
+	stmt := `INSERT INTO offline_messages(username, data, expires_at, created_at) VALUES($1, $2, $3, $4)`
+	_, err := s.db.Exec(stmt, username, message.String(), nullTime(expiresAt), time.Now().UTC())
+	return err
+}
+
+func (s *postgreSQL) CountOfflineMessages(username string) (int, error) {
+	row := s.db.QueryRow("SELECT COUNT(*) FROM offline_messages WHERE username = $1", username)
+	var count int
+	err := row.Scan(&count)
+	switch err {
+	case nil:
+		return count, nil
+	default:
+		return 0, err
+	}
+}
+
+func (s *postgreSQL) FetchOfflineMessages(username string) ([]OfflineMessage, error) {
+	stmt := "SELECT id, data, created_at, expires_at FROM offline_messages WHERE username = $1 ORDER BY id"
+	rows, err := s.db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return offlineMessagesFromRows(rows)
+}
+
+func (s *postgreSQL) DeleteOfflineMessages(username string, lastID int64) error {
+	_, err := s.db.Exec("DELETE FROM offline_messages WHERE username = $1 AND id <= $2", username, lastID)
+	return err
+}
+
+func (s *postgreSQL) DeleteExpiredOfflineMessages(maxAge time.Duration) error {
+	now := time.Now().UTC()
+	if maxAge == 0 {
+		_, err := s.db.Exec("DELETE FROM offline_messages WHERE expires_at <= $1", now)
+		return err
+	}
+	stmt := "DELETE FROM offline_messages WHERE expires_at <= $1 OR created_at < $2"
+	_, err := s.db.Exec(stmt, now, now.Add(-maxAge))
+	return err
+}
+
+func (s *postgreSQL) InsertArchivedMessage(message *ArchivedMessage, username string) error {
+	peer, err := xml.NewJIDString(message.Peer, true)
+	if err != nil {
+		return err
+	}
+	stmt := `INSERT INTO archive_messages(id, username, peer, bare_peer, data, created_at) VALUES($1, $2, $3, $4, $5, $6)`
+	_, err = s.db.Exec(stmt, message.ID, username, peer.String(), peer.ToBareJID().String(), message.Message.String(), message.CreatedAt.UTC())
+	return err
+}
+
+func (s *postgreSQL) FetchArchivedMessages(username string, query *ArchiveQuery) ([]ArchivedMessage, bool, error) {
+	return fetchArchivedMessages(s.db.Query, postgreSQLDialect, username, query)
+}
+
+func (s *postgreSQL) FetchArchivePrefs(username string) (*ArchivePrefs, error) {
+	row := s.db.QueryRow("SELECT default_mode, always_jids, never_jids FROM archive_prefs WHERE username = $1", username)
+	return archivePrefsFromRow(row, username)
+}
+
+func (s *postgreSQL) InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) error {
+	stmt := `` +
+		`INSERT INTO archive_prefs(username, default_mode, always_jids, never_jids, updated_at, created_at)` +
+		` VALUES($1, $2, $3, $4, NOW(), NOW())` +
+		` ON CONFLICT (username) DO UPDATE SET default_mode = $2, always_jids = $3, never_jids = $4, updated_at = NOW()`
+
+	always := strings.Join(prefs.Always, archivePrefsSeparator)
+	never := strings.Join(prefs.Never, archivePrefsSeparator)
+	_, err := s.db.Exec(stmt, prefs.Username, prefs.Default, always, never)
+	return err
+}
+
+func (s *postgreSQL) inTransaction(f func(tx *sql.Tx) error) error {
+	var err error
+	for i := 0; i < maxTransactionRetries; i++ {
+		tx, txErr := s.db.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		err = f(tx)
+		if err != nil {
+			tx.Rollback()
+			continue
+		}
+		return tx.Commit()
+	}
+	return err
+}
+
+func (s *postgreSQL) rosterItemsFromRows(rows *sql.Rows) ([]RosterItem, error) {
+	var result []RosterItem
+	for rows.Next() {
+		ri, err := s.rosterItemFromRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *ri)
+	}
+	return result, nil
+}
+
+func (s *postgreSQL) rosterItemFromRows(rows *sql.Rows) (*RosterItem, error) {
+	var ri RosterItem
+	var groups string
+
+	rows.Scan(&ri.User, &ri.Contact, &ri.Name, &ri.Subscription, &groups, &ri.Ask)
+	ri.Groups = strings.Split(groups, ";")
+	return &ri, nil
+}
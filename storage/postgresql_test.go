@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestPostgreSQLStorage connects to the database pointed by
+// JACKAL_POSTGRESQL_HOST (e.g. 127.0.0.1:5432) and migrates its schema.
+// Tests are skipped when no such database is available.
+func newTestPostgreSQLStorage(t *testing.T) *postgreSQL {
+	host := os.Getenv("JACKAL_POSTGRESQL_HOST")
+	if len(host) == 0 {
+		t.Skip("JACKAL_POSTGRESQL_HOST not set")
+	}
+	config.DefaultConfig.Storage.PostgreSQL = &config.PostgreSQLDb{
+		Host:     host,
+		User:     os.Getenv("JACKAL_POSTGRESQL_USER"),
+		Password: os.Getenv("JACKAL_POSTGRESQL_PASSWORD"),
+		Database: os.Getenv("JACKAL_POSTGRESQL_DATABASE"),
+		SSLMode:  "disable",
+		PoolSize: 4,
+	}
+	config.DefaultConfig.Storage.AutoMigrate = true
+	return newPostgreSQLStorage().(*postgreSQL)
+}
+
+func TestPostgreSQLUsers(t *testing.T) {
+	s := newTestPostgreSQLStorage(t)
+	defer s.DeleteUser("jackal_test")
+
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "jackal_test", Password: "1234"}))
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "jackal_test", Password: "5678"}))
+
+	u, err := s.FetchUser("jackal_test")
+	assert.Nil(t, err)
+	assert.NotNil(t, u)
+	assert.Equal(t, u.Password, "5678")
+
+	exists, err := s.UserExists("jackal_test")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&RosterItem{User: "jackal_test", Contact: "noelia", Subscription: "both"}))
+	assert.Nil(t, s.InsertOfflineMessage(xml.NewElementName("message"), "jackal_test", time.Time{}))
+
+	assert.Nil(t, s.DeleteUser("jackal_test"))
+	exists, _ = s.UserExists("jackal_test")
+	assert.False(t, exists)
+	items, _ := s.FetchRosterItemsAsUser("jackal_test")
+	assert.Equal(t, len(items), 0)
+	count, _ := s.CountOfflineMessages("jackal_test")
+	assert.Equal(t, count, 0)
+}
+
+func TestPostgreSQLOfflineMessagesOrder(t *testing.T) {
+	s := newTestPostgreSQLStorage(t)
+	defer s.DeleteUser("jackal_test")
+
+	for _, id := range []string{"1", "2", "3"} {
+		m := xml.NewElementName("message")
+		m.SetID(id)
+		assert.Nil(t, s.InsertOfflineMessage(m, "jackal_test", time.Time{}))
+	}
+	msgs, err := s.FetchOfflineMessages("jackal_test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(msgs), 3)
+	assert.Equal(t, msgs[0].Message.ID(), "1")
+	assert.Equal(t, msgs[2].Message.ID(), "3")
+
+	assert.Nil(t, s.DeleteOfflineMessages("jackal_test", msgs[1].ID))
+	msgs, _ = s.FetchOfflineMessages("jackal_test")
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Message.ID(), "3")
+}
+
+func TestPostgreSQLArchiveUnparsableMessage(t *testing.T) {
+	s := newTestPostgreSQLStorage(t)
+	defer s.DeleteUser("jackal_test")
+
+	for _, id := range []string{"a1", "a2", "a3"} {
+		m := xml.NewElementName("message")
+		m.SetID(id)
+		am := &ArchivedMessage{ID: id, Peer: "noelia@jackal.im", Message: m, CreatedAt: time.Now()}
+		assert.Nil(t, s.InsertArchivedMessage(am, "jackal_test"))
+	}
+	_, err := s.db.Exec("UPDATE archive_messages SET data = $1 WHERE username = $2 AND id = $3", "<message", "jackal_test", "a2")
+	assert.Nil(t, err)
+
+	msgs, complete, err := s.FetchArchivedMessages("jackal_test", &ArchiveQuery{})
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, len(msgs), 2)
+	assert.Equal(t, msgs[0].ID, "a1")
+	assert.Equal(t, msgs[1].ID, "a3")
+}
@@ -0,0 +1,447 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// SQL driver implementation
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+type sqlite struct {
+	db *sql.DB
+}
+
+func newSQLiteStorage() storage {
+	s := &sqlite{}
+	path := config.DefaultConfig.Storage.SQLite.Path
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		log.Fatalf("%v", err)
+	}
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", path)
+	conn, err := openDB("sqlite3", dsn)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	// SQLite allows a single writer at a time
+	conn.SetMaxOpenConns(1)
+
+	if err := prepareSchema(conn, sqliteDialect); err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.db = conn
+	return s
+}
+
+func (s *sqlite) ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqlite) FetchUser(username string) (*User, error) {
+	stmt := "SELECT username, password, password_hash, scram_sha1, scram_sha256 FROM users WHERE username = ?"
+	row := s.db.QueryRow(stmt, username)
+	u := User{}
+	var scramSHA1, scramSHA256 string
+	err := row.Scan(&u.Username, &u.Password, &u.PasswordHash, &scramSHA1, &scramSHA256)
+	switch err {
+	case nil:
+		if err := decodeUserCredentials(&u, scramSHA1, scramSHA256); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqlite) InsertOrUpdateUser(u *User) error {
+	scramSHA1, scramSHA256 := encodeUserCredentials(u)
+	params := []interface{}{
+		u.Username,
+		u.Password,
+		u.PasswordHash,
+		scramSHA1,
+		scramSHA256,
+		u.Password,
+		u.PasswordHash,
+		scramSHA1,
+		scramSHA256,
+	}
+	stmt := `` +
+		`INSERT INTO users(username, password, password_hash, scram_sha1, scram_sha256, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)` +
+		` ON CONFLICT(username) DO UPDATE SET password = ?, password_hash = ?, scram_sha1 = ?, scram_sha256 = ?,` +
+		` updated_at = CURRENT_TIMESTAMP`
+	_, err := s.db.Exec(stmt, params...)
+	return err
+}
+
+func (s *sqlite) DeleteUser(username string) error {
+	return s.inTransaction(func(tx *sql.Tx) error {
+		var err error
+		_, err = tx.Exec("DELETE FROM offline_messages WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM archive_messages WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM archive_prefs WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM roster_items WHERE user = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM roster_notifications WHERE contact = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM private_storage WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM vcards WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM users WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *sqlite) UserExists(username string) (bool, error) {
+	row := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username)
+	var count int
+	err := row.Scan(&count)
+	switch err {
+	case nil:
+		return count > 0, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *sqlite) InsertOrUpdateRosterItem(ri *RosterItem) error {
+	groups := strings.Join(ri.Groups, ";")
+	params := []interface{}{
+		ri.User,
+		ri.Contact,
+		ri.Name,
+		ri.Subscription,
+		groups,
+		ri.Ask,
+		ri.Name,
+		ri.Subscription,
+		groups,
+		ri.Ask,
+	}
+	stmt := `` +
+		`INSERT INTO roster_items(user, contact, name, subscription, "groups", ask, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)` +
+		` ON CONFLICT(user, contact) DO UPDATE SET name = ?, subscription = ?, "groups" = ?, ask = ?, updated_at = CURRENT_TIMESTAMP`
+	_, err := s.db.Exec(stmt, params...)
+	return err
+}
+
+func (s *sqlite) DeleteRosterItem(user, contact string) error {
+	stmt := "DELETE FROM roster_items WHERE user = ? AND contact = ?"
+	_, err := s.db.Exec(stmt, user, contact)
+	return err
+}
+
+func (s *sqlite) FetchRosterItem(user, contact string) (*RosterItem, error) {
+	stmt := `` +
+		`SELECT user, contact, name, subscription, "groups", ask` +
+		` FROM roster_items WHERE user = ? AND contact = ?`
+	rows, err := s.db.Query(stmt, user, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return s.rosterItemFromRows(rows)
+	}
+	return nil, nil
+}
+
+func (s *sqlite) FetchRosterItemsAsUser(user string) ([]RosterItem, error) {
+	stmt := `` +
+		`SELECT user, contact, name, subscription, "groups", ask` +
+		` FROM roster_items WHERE user = ?` +
+		` ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(stmt, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.rosterItemsFromRows(rows)
+}
+
+func (s *sqlite) FetchRosterItemsAsContact(contact string) ([]RosterItem, error) {
+	stmt := `` +
+		`SELECT user, contact, name, subscription, "groups", ask` +
+		` FROM roster_items WHERE contact = ?` +
+		` ORDER BY created_at DESC`
+	rows, err := s.db.Query(stmt, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.rosterItemsFromRows(rows)
+}
+
+func (s *sqlite) InsertOrUpdateRosterNotification(rn *RosterNotification) error {
+	stmt := `` +
+		`INSERT INTO roster_notifications(user, contact, elements, updated_at, created_at)` +
+		` VALUES(?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)` +
+		` ON CONFLICT(user, contact) DO UPDATE SET elements = ?, updated_at = CURRENT_TIMESTAMP`
+
+	buf := new(bytes.Buffer)
+	for _, elem := range rn.Elements {
+		buf.WriteString(elem.String())
+	}
+	elementsXML := buf.String()
+	_, err := s.db.Exec(stmt, rn.User, rn.Contact, elementsXML, elementsXML)
+	return err
+}
+
+func (s *sqlite) DeleteRosterNotification(user, contact string) error {
+	_, err := s.db.Exec("DELETE FROM roster_notifications WHERE user = ? AND contact = ?", user, contact)
+	return err
+}
+
+func (s *sqlite) FetchRosterNotifications(contact string) ([]RosterNotification, error) {
+	stmt := `SELECT user, contact, elements FROM roster_notifications WHERE contact = ? ORDER BY created_at`
+	rows, err := s.db.Query(stmt, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buf := new(bytes.Buffer)
+
+	var ret []RosterNotification
+	for rows.Next() {
+		var rn RosterNotification
+		var notificationXML string
+		rows.Scan(&rn.User, &rn.Contact, &notificationXML)
+		buf.Reset()
+		buf.WriteString("<root>")
+		buf.WriteString(notificationXML)
+		buf.WriteString("</root>")
+
+		parser := xml.NewParser(buf)
+		root, err := parser.ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		rn.Elements = root.Elements()
+
+		ret = append(ret, rn)
+	}
+	return ret, nil
+}
+
+func (s *sqlite) FetchVCard(username string) (xml.Element, error) {
+	row := s.db.QueryRow("SELECT vcard FROM vcards WHERE username = ?", username)
+	var vCard string
+	err := row.Scan(&vCard)
+	switch err {
+	case nil:
+		parser := xml.NewParser(strings.NewReader(vCard))
+		return parser.ParseElement()
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqlite) InsertOrUpdateVCard(vCard xml.Element, username string) error {
+	stmt := `` +
+		`INSERT INTO vcards(username, vcard, updated_at, created_at)` +
+		` VALUES(?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)` +
+		` ON CONFLICT(username) DO UPDATE SET vcard = ?, updated_at = CURRENT_TIMESTAMP`
+
+	rawXML := vCard.String()
+	_, err := s.db.Exec(stmt, username, rawXML, rawXML)
+	return err
+}
+
+func (s *sqlite) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
+	row := s.db.QueryRow("SELECT data FROM private_storage WHERE username = ? AND namespace = ?", username, namespace)
+	var privateXML string
+	err := row.Scan(&privateXML)
+	switch err {
+	case nil:
+		reader := strings.NewReader(fmt.Sprintf("<root>%s</root>", privateXML))
+		parser := xml.NewParser(reader)
+		rootEl, err := parser.ParseElement()
+		if err != nil {
+			return nil, err
+		} else if rootEl != nil {
+			return rootEl.Elements(), nil
+		}
+		fallthrough
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqlite) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
+	stmt := `` +
+		`INSERT INTO private_storage(username, namespace, data, updated_at, created_at)` +
+		` VALUES(?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)` +
+		` ON CONFLICT(username, namespace) DO UPDATE SET data = ?, updated_at = CURRENT_TIMESTAMP`
+
+	buf := new(bytes.Buffer)
+	for _, elem := range privateXML {
+		elem.ToXML(buf, true)
+	}
+	rawXML := buf.String()
+	_, err := s.db.Exec(stmt, username, namespace, rawXML, rawXML)
+	return err
+}
+
+func (s *sqlite) InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) error {
+	stmt := `INSERT INTO offline_messages(username, data, expires_at, created_at) VALUES(?, ?, ?, ?)`
+	_, err := s.db.Exec(stmt, username, message.String(), nullTime(expiresAt), time.Now().UTC())
+	return err
+}
+
+func (s *sqlite) CountOfflineMessages(username string) (int, error) {
+	row := s.db.QueryRow("SELECT COUNT(*) FROM offline_messages WHERE username = ?", username)
+	var count int
+	err := row.Scan(&count)
+	switch err {
+	case nil:
+		return count, nil
+	default:
+		return 0, err
+	}
+}
+
+func (s *sqlite) FetchOfflineMessages(username string) ([]OfflineMessage, error) {
+	stmt := "SELECT id, data, created_at, expires_at FROM offline_messages WHERE username = ? ORDER BY id"
+	rows, err := s.db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return offlineMessagesFromRows(rows)
+}
+
+func (s *sqlite) DeleteOfflineMessages(username string, lastID int64) error {
+	_, err := s.db.Exec("DELETE FROM offline_messages WHERE username = ? AND id <= ?", username, lastID)
+	return err
+}
+
+func (s *sqlite) DeleteExpiredOfflineMessages(maxAge time.Duration) error {
+	now := time.Now().UTC()
+	if maxAge == 0 {
+		_, err := s.db.Exec("DELETE FROM offline_messages WHERE expires_at <= ?", now)
+		return err
+	}
+	stmt := "DELETE FROM offline_messages WHERE expires_at <= ? OR created_at < ?"
+	_, err := s.db.Exec(stmt, now, now.Add(-maxAge))
+	return err
+}
+
+func (s *sqlite) InsertArchivedMessage(message *ArchivedMessage, username string) error {
+	peer, err := xml.NewJIDString(message.Peer, true)
+	if err != nil {
+		return err
+	}
+	stmt := `INSERT INTO archive_messages(id, username, peer, bare_peer, data, created_at) VALUES(?, ?, ?, ?, ?, ?)`
+	_, err = s.db.Exec(stmt, message.ID, username, peer.String(), peer.ToBareJID().String(), message.Message.String(), message.CreatedAt.UTC())
+	return err
+}
+
+func (s *sqlite) FetchArchivedMessages(username string, query *ArchiveQuery) ([]ArchivedMessage, bool, error) {
+	return fetchArchivedMessages(s.db.Query, sqliteDialect, username, query)
+}
+
+func (s *sqlite) FetchArchivePrefs(username string) (*ArchivePrefs, error) {
+	row := s.db.QueryRow("SELECT default_mode, always_jids, never_jids FROM archive_prefs WHERE username = ?", username)
+	return archivePrefsFromRow(row, username)
+}
+
+func (s *sqlite) InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) error {
+	stmt := `` +
+		`INSERT INTO archive_prefs(username, default_mode, always_jids, never_jids, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)` +
+		` ON CONFLICT(username) DO UPDATE SET default_mode = ?, always_jids = ?, never_jids = ?, updated_at = CURRENT_TIMESTAMP`
+
+	always := strings.Join(prefs.Always, archivePrefsSeparator)
+	never := strings.Join(prefs.Never, archivePrefsSeparator)
+	_, err := s.db.Exec(stmt, prefs.Username, prefs.Default, always, never, prefs.Default, always, never)
+	return err
+}
+
+func (s *sqlite) inTransaction(f func(tx *sql.Tx) error) error {
+	var err error
+	for i := 0; i < maxTransactionRetries; i++ {
+		tx, txErr := s.db.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		err = f(tx)
+		if err != nil {
+			tx.Rollback()
+			continue
+		}
+		return tx.Commit()
+	}
+	return err
+}
+
+func (s *sqlite) rosterItemsFromRows(rows *sql.Rows) ([]RosterItem, error) {
+	var result []RosterItem
+	for rows.Next() {
+		ri, err := s.rosterItemFromRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *ri)
+	}
+	return result, nil
+}
+
+func (s *sqlite) rosterItemFromRows(rows *sql.Rows) (*RosterItem, error) {
+	var ri RosterItem
+	var groups string
+
+	rows.Scan(&ri.User, &ri.Contact, &ri.Name, &ri.Subscription, &groups, &ri.Ask)
+	ri.Groups = strings.Split(groups, ";")
+	return &ri, nil
+}
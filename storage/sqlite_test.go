@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSQLiteStorage creates a migrated SQLite database within a temporary
+// directory, returning a function that removes it once done.
+func newTestSQLiteStorage(t *testing.T) (*sqlite, func()) {
+	dir, err := ioutil.TempDir("", "jackal_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *config.SQLiteDb, autoMigrate bool, c2s config.C2S) {
+		config.DefaultConfig.Storage.SQLite = s
+		config.DefaultConfig.Storage.AutoMigrate = autoMigrate
+		config.DefaultConfig.C2S = c2s
+	}(config.DefaultConfig.Storage.SQLite, config.DefaultConfig.Storage.AutoMigrate, config.DefaultConfig.C2S)
+
+	// roster contacts migration qualifies them with default domain
+	config.DefaultConfig.C2S = config.C2S{Domains: []string{"jackal.im"}}
+	config.DefaultConfig.Storage.SQLite = &config.SQLiteDb{Path: filepath.Join(dir, "jackal.db")}
+	config.DefaultConfig.Storage.AutoMigrate = true
+
+	s := newSQLiteStorage().(*sqlite)
+	return s, func() {
+		s.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	s, teardown := newTestSQLiteStorage(t)
+	defer teardown()
+
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "ortuman", Password: "1234"}))
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "ortuman", Password: "5678"}))
+
+	u, err := s.FetchUser("ortuman")
+	assert.Nil(t, err)
+	assert.NotNil(t, u)
+	assert.Equal(t, u.Password, "5678")
+
+	u, err = s.FetchUser("noelia")
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+
+	exists, err := s.UserExists("ortuman")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestSQLiteRoster(t *testing.T) {
+	s, teardown := newTestSQLiteStorage(t)
+	defer teardown()
+
+	ri := &RosterItem{User: "ortuman", Contact: "noelia@jackal.im", Name: "Noelia", Subscription: "to", Groups: []string{"family", "friends"}}
+	assert.Nil(t, s.InsertOrUpdateRosterItem(ri))
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&RosterItem{User: "romeo", Contact: "noelia@jackal.im", Subscription: "both"}))
+
+	ri.Subscription = "both"
+	assert.Nil(t, s.InsertOrUpdateRosterItem(ri))
+
+	item, err := s.FetchRosterItem("ortuman", "noelia@jackal.im")
+	assert.Nil(t, err)
+	assert.NotNil(t, item)
+	assert.Equal(t, item.Subscription, "both")
+	assert.Equal(t, item.Groups, []string{"family", "friends"})
+
+	items, err := s.FetchRosterItemsAsUser("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, len(items), 1)
+
+	items, err = s.FetchRosterItemsAsContact("noelia@jackal.im")
+	assert.Nil(t, err)
+	assert.Equal(t, len(items), 2)
+
+	assert.Nil(t, s.DeleteRosterItem("ortuman", "noelia@jackal.im"))
+	item, err = s.FetchRosterItem("ortuman", "noelia@jackal.im")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+
+	rn := &RosterNotification{User: "noelia@jackal.im", Contact: "ortuman", Elements: []xml.Element{xml.NewElementName("status")}}
+	assert.Nil(t, s.InsertOrUpdateRosterNotification(rn))
+	rns, err := s.FetchRosterNotifications("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, len(rns), 1)
+
+	assert.Nil(t, s.DeleteRosterNotification("noelia@jackal.im", "ortuman"))
+	rns, _ = s.FetchRosterNotifications("ortuman")
+	assert.Equal(t, len(rns), 0)
+}
+
+func TestSQLiteOfflineMessagesOrder(t *testing.T) {
+	s, teardown := newTestSQLiteStorage(t)
+	defer teardown()
+
+	for _, id := range []string{"1", "2", "3"} {
+		m := xml.NewElementName("message")
+		m.SetID(id)
+		assert.Nil(t, s.InsertOfflineMessage(m, "ortuman", time.Time{}))
+	}
+	count, err := s.CountOfflineMessages("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 3)
+
+	msgs, err := s.FetchOfflineMessages("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, len(msgs), 3)
+	assert.Equal(t, msgs[0].Message.ID(), "1")
+	assert.Equal(t, msgs[2].Message.ID(), "3")
+
+	assert.Nil(t, s.DeleteOfflineMessages("ortuman", msgs[1].ID))
+	msgs, _ = s.FetchOfflineMessages("ortuman")
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Message.ID(), "3")
+}
+
+func TestSQLiteArchivePaging(t *testing.T) {
+	s, teardown := newTestSQLiteStorage(t)
+	defer teardown()
+
+	insertTestArchivedMessages(t, s, "ortuman", "a1", "a2", "a3", "a4", "a5")
+
+	msgs, complete, err := s.FetchArchivedMessages("ortuman", &ArchiveQuery{Max: 2})
+	assert.Nil(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a1", "a2"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{AfterID: "a2", Max: 2})
+	assert.False(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a3", "a4"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{AfterID: "a4", Max: 2})
+	assert.True(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a5"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{LastPage: true, Max: 2})
+	assert.False(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a4", "a5"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{BeforeID: "a2", Max: 2})
+	assert.True(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a1"})
+
+	with, _ := xml.NewJID("noelia", "jackal.im", "", true)
+	msgs, _, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{With: with})
+	assert.Equal(t, len(msgs), 5)
+
+	_, _, err = s.FetchArchivedMessages("ortuman", &ArchiveQuery{AfterID: "a9"})
+	assert.Equal(t, err, ErrArchiveItemNotFound)
+
+	assert.Nil(t, s.InsertOrUpdateArchivePrefs(&ArchivePrefs{Username: "ortuman", Default: "roster", Never: []string{"romeo@jackal.im"}}))
+	prefs, err := s.FetchArchivePrefs("ortuman")
+	assert.Nil(t, err)
+	assert.Equal(t, prefs.Default, "roster")
+	assert.Equal(t, prefs.Never, []string{"romeo@jackal.im"})
+}
+
+func TestSQLiteArchiveUnparsableMessage(t *testing.T) {
+	s, teardown := newTestSQLiteStorage(t)
+	defer teardown()
+
+	insertTestArchivedMessages(t, s, "ortuman", "a1", "a2", "a3", "a4", "a5")
+	for _, id := range []string{"a2", "a4"} {
+		_, err := s.db.Exec("UPDATE archive_messages SET data = ? WHERE username = ? AND id = ?", "<message", "ortuman", id)
+		assert.Nil(t, err)
+	}
+	// skipped messages still count towards page size
+	msgs, complete, err := s.FetchArchivedMessages("ortuman", &ArchiveQuery{Max: 2})
+	assert.Nil(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a1"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{AfterID: "a1", Max: 2})
+	assert.False(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a3"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{LastPage: true, Max: 2})
+	assert.False(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a5"})
+
+	msgs, complete, _ = s.FetchArchivedMessages("ortuman", &ArchiveQuery{AfterID: "a3", Max: 2})
+	assert.True(t, complete)
+	assert.Equal(t, archivedMessageIDs(msgs), []string{"a5"})
+}
+
+func TestSQLiteDeleteUser(t *testing.T) {
+	s, teardown := newTestSQLiteStorage(t)
+	defer teardown()
+
+	assert.Nil(t, s.InsertOrUpdateUser(&User{Username: "ortuman", Password: "1234"}))
+	assert.Nil(t, s.InsertOrUpdateRosterItem(&RosterItem{User: "ortuman", Contact: "noelia@jackal.im", Subscription: "both"}))
+	assert.Nil(t, s.InsertOrUpdateRosterNotification(&RosterNotification{User: "romeo@jackal.im", Contact: "ortuman"}))
+	assert.Nil(t, s.InsertOfflineMessage(xml.NewElementName("message"), "ortuman", time.Time{}))
+	assert.Nil(t, s.InsertOrUpdateVCard(xml.NewElementNamespace("vCard", "vcard-temp"), "ortuman"))
+	assert.Nil(t, s.InsertOrUpdateArchivePrefs(&ArchivePrefs{Username: "ortuman", Default: "always"}))
+	insertTestArchivedMessages(t, s, "ortuman", "a1")
+
+	assert.Nil(t, s.DeleteUser("ortuman"))
+
+	exists, _ := s.UserExists("ortuman")
+	assert.False(t, exists)
+	items, _ := s.FetchRosterItemsAsUser("ortuman")
+	assert.Equal(t, len(items), 0)
+	rns, _ := s.FetchRosterNotifications("ortuman")
+	assert.Equal(t, len(rns), 0)
+	count, _ := s.CountOfflineMessages("ortuman")
+	assert.Equal(t, count, 0)
+	vCard, _ := s.FetchVCard("ortuman")
+	assert.Nil(t, vCard)
+	prefs, _ := s.FetchArchivePrefs("ortuman")
+	assert.Nil(t, prefs)
+	msgs, _, _ := s.FetchArchivedMessages("ortuman", &ArchiveQuery{})
+	assert.Equal(t, len(msgs), 0)
+}
+
+func insertTestArchivedMessages(t *testing.T, s storage, username string, ids ...string) {
+	now := time.Now()
+	for i, id := range ids {
+		m := xml.NewElementName("message")
+		m.SetID(id)
+		am := &ArchivedMessage{ID: id, Peer: "noelia@jackal.im/garden", Message: m, CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		assert.Nil(t, s.InsertArchivedMessage(am, username))
+	}
+}
+
+func archivedMessageIDs(msgs []ArchivedMessage) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
@@ -7,6 +7,7 @@ package storage
 
 import (
 	"sync"
+	"time"
 
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/xml"
@@ -14,9 +15,20 @@ import (
 
 type User struct {
 	Username string
+
+	// Password holds a legacy plaintext password.
+	// Empty once user credentials have been hashed.
 	Password string
+
+	// PasswordHash holds an optional bcrypt hash used to verify PLAIN authentication.
+	PasswordHash string
+
+	ScramSHA1   *ScramCredentials
+	ScramSHA256 *ScramCredentials
 }
 
+// RosterItem represents a user roster entry.
+// User is the local user username, while Contact holds the contact bare JID.
 type RosterItem struct {
 	User         string
 	Contact      string
@@ -26,12 +38,60 @@ type RosterItem struct {
 	Groups       []string
 }
 
+// RosterNotification represents a subscription request pending to be approved.
+// User holds the requester bare JID, while Contact is the local user username.
 type RosterNotification struct {
 	User     string
 	Contact  string
 	Elements []xml.Element
 }
 
+// OfflineMessage represents a message stored while its recipient was offline.
+type OfflineMessage struct {
+	ID        int64
+	Message   xml.Element
+	CreatedAt time.Time
+
+	// ExpiresAt is zero for messages that never expire.
+	ExpiresAt time.Time
+}
+
+// ArchivedMessage represents a message stored in a user archive (XEP-0313).
+type ArchivedMessage struct {
+	ID string
+
+	// Peer is the JID of the user's conversation partner.
+	Peer      string
+	Message   xml.Element
+	CreatedAt time.Time
+}
+
+// ArchiveQuery filters and pages the messages of a user archive.
+type ArchiveQuery struct {
+	// With matches messages exchanged with a bare JID,
+	// or with a full JID in case it has a resource part.
+	With  *xml.JID
+	Start time.Time
+	End   time.Time
+
+	// AfterID and BeforeID bound the requested page by archive identifiers,
+	// while LastPage requests the last one whenever BeforeID is empty.
+	AfterID  string
+	BeforeID string
+	LastPage bool
+
+	// Max limits the number of returned messages. Zero means no limit.
+	Max int
+}
+
+// ArchivePrefs represents the archiving preferences of a user.
+type ArchivePrefs struct {
+	Username string
+	Default  string
+	Always   []string
+	Never    []string
+}
+
 type storage interface {
 	// User
 	FetchUser(username string) (*User, error)
@@ -65,27 +125,81 @@ type storage interface {
 	InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error
 
 	// Offline messages
-	InsertOfflineMessage(message xml.Element, username string) error
+	InsertOfflineMessage(message xml.Element, username string, expiresAt time.Time) error
 	CountOfflineMessages(username string) (int, error)
-	FetchOfflineMessages(username string) ([]xml.Element, error)
-	DeleteOfflineMessages(username string) error
+
+	// FetchOfflineMessages returns user's offline messages ordered by ID.
+	FetchOfflineMessages(username string) ([]OfflineMessage, error)
+
+	// DeleteOfflineMessages deletes user's offline messages up to lastID (included).
+	DeleteOfflineMessages(username string, lastID int64) error
+
+	// DeleteExpiredOfflineMessages deletes messages older than maxAge
+	// or whose expiration time has passed. A zero maxAge doesn't expire messages by age.
+	DeleteExpiredOfflineMessages(maxAge time.Duration) error
+
+	// Message archive
+	InsertArchivedMessage(message *ArchivedMessage, username string) error
+
+	// FetchArchivedMessages returns a page of user's archived messages in chronological order,
+	// reporting whether it completes the result set in the paging direction.
+	// ErrArchiveItemNotFound is returned if any of the query bounding identifiers doesn't exist.
+	FetchArchivedMessages(username string, query *ArchiveQuery) ([]ArchivedMessage, bool, error)
+
+	FetchArchivePrefs(username string) (*ArchivePrefs, error)
+	InsertOrUpdateArchivePrefs(prefs *ArchivePrefs) error
 }
 
 // singleton interface
 var (
+	instMu   sync.RWMutex
 	instance storage
 	once     sync.Once
 )
 
 func Instance() storage {
 	once.Do(func() {
+		instMu.Lock()
+		defer instMu.Unlock()
 		switch config.DefaultConfig.Storage.Type {
 		case config.MySQL:
 			instance = newMySQLStorage()
+		case config.PostgreSQL:
+			instance = newPostgreSQLStorage()
+		case config.SQLite:
+			instance = newSQLiteStorage()
+		case config.Memory:
+			instance = NewMemoryStorage()
 		default:
 			// should not be reached
 			break
 		}
+		if instance == nil {
+			return
+		}
+		p, isPinger := instance.(pinger)
+
+		threshold := config.DefaultConfig.Storage.SlowQueryThreshold
+		instance = newMetricsStorage(instance, time.Duration(threshold)*time.Millisecond)
+
+		if isPinger {
+			instance = newHealthStorage(instance, p)
+		}
+
+		if c := config.DefaultConfig.Storage.Cache; c != nil {
+			instance = newCachedStorage(instance, c.Size, time.Duration(c.TTL)*time.Second)
+		}
 	})
+	instMu.RLock()
+	defer instMu.RUnlock()
 	return instance
 }
+
+// Set replaces the storage singleton instance.
+// Intended to swap in an alternative implementation (e.g. NewMemoryStorage) in tests.
+func Set(s storage) {
+	once.Do(func() {})
+	instMu.Lock()
+	instance = s
+	instMu.Unlock()
+}
@@ -34,12 +34,13 @@ type C2SStream interface {
 	PresenceElements() []xml.Element
 
 	IsRosterRequested() bool
+	IsCarbonsEnabled() bool
 }
 
 type C2SManager struct {
 	lock        sync.RWMutex
 	strms       map[string]C2SStream
-	authedStrms map[string][]C2SStream
+	authedStrms map[string][]C2SStream // keyed by bare JID
 }
 
 // singleton interface
@@ -80,22 +81,36 @@ func (m *C2SManager) RegisterStream(strm C2SStream) {
 	m.strms[strm.ID()] = strm
 }
 
+// Streams returns all registered streams.
+func (m *C2SManager) Streams() []C2SStream {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	strms := make([]C2SStream, 0, len(m.strms))
+	for _, strm := range m.strms {
+		strms = append(strms, strm)
+	}
+	return strms
+}
+
 func (m *C2SManager) UnregisterStream(strm C2SStream) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	log.Infof("unregistered stream... (id: %s)", strm.ID())
 
-	if authedStrms := m.authedStrms[strm.Username()]; authedStrms != nil {
-		res := strm.Resource()
+	key := strm.JID().ToBareJID().String()
+	if authedStrms := m.authedStrms[key]; authedStrms != nil {
 		for i := 0; i < len(authedStrms); i++ {
-			if res == authedStrms[i].Resource() {
+			if authedStrms[i] == strm {
 				authedStrms = append(authedStrms[:i], authedStrms[i+1:]...)
 				break
 			}
 		}
 		if len(authedStrms) == 0 {
-			delete(m.authedStrms, strm.Username())
+			delete(m.authedStrms, key)
+		} else {
+			m.authedStrms[key] = authedStrms
 		}
 	}
 	delete(m.strms, strm.ID())
@@ -107,15 +122,17 @@ func (m *C2SManager) AuthenticateStream(strm C2SStream) {
 
 	log.Infof("authenticated stream... (%s)", strm.Username())
 
-	if authedStrms := m.authedStrms[strm.Username()]; authedStrms != nil {
-		m.authedStrms[strm.Username()] = append(authedStrms, strm)
+	key := strm.JID().ToBareJID().String()
+	if authedStrms := m.authedStrms[key]; authedStrms != nil {
+		m.authedStrms[key] = append(authedStrms, strm)
 	} else {
-		m.authedStrms[strm.Username()] = []C2SStream{strm}
+		m.authedStrms[key] = []C2SStream{strm}
 	}
 }
 
-func (m *C2SManager) AvailableStreams(username string) []C2SStream {
+// AvailableStreams returns all authenticated streams bound to jid's bare JID.
+func (m *C2SManager) AvailableStreams(jid *xml.JID) []C2SStream {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	return m.authedStrms[username]
+	return m.authedStrms[jid.ToBareJID().String()]
 }
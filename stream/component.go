@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stream
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrComponentConflict is returned when registering a component
+// whose domain is already bound to another component stream.
+var ErrComponentConflict = errors.New("stream: component domain already registered")
+
+// ComponentStream represents an external component stream (XEP-0114).
+type ComponentStream interface {
+	ID() string
+	Domain() string
+
+	// SendElement queues element to be sent, returning false
+	// if the stream was already disconnected.
+	SendElement(element xml.Element) bool
+	Disconnect(err error)
+}
+
+type ComponentManager struct {
+	lock  sync.RWMutex
+	strms map[string]ComponentStream
+}
+
+// singleton interface
+var (
+	compInstance *ComponentManager
+	compOnce     sync.Once
+)
+
+func Components() *ComponentManager {
+	compOnce.Do(func() {
+		compInstance = &ComponentManager{
+			strms: make(map[string]ComponentStream),
+		}
+	})
+	return compInstance
+}
+
+func (m *ComponentManager) RegisterComponent(strm ComponentStream) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.strms[strm.Domain()]; ok {
+		return ErrComponentConflict
+	}
+	m.strms[strm.Domain()] = strm
+
+	log.Infof("registered component... (%s)", strm.Domain())
+	return nil
+}
+
+func (m *ComponentManager) UnregisterComponent(strm ComponentStream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.strms[strm.Domain()] == strm {
+		delete(m.strms, strm.Domain())
+		log.Infof("unregistered component... (%s)", strm.Domain())
+	}
+}
+
+// Component returns the component stream bound to domain, or nil if not found.
+func (m *ComponentManager) Component(domain string) ComponentStream {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.strms[domain]
+}
+
+// IsComponentDomain returns whether or not domain is served by any
+// of the configured components, regardless of it being connected.
+func (m *ComponentManager) IsComponentDomain(domain string) bool {
+	for _, srv := range config.DefaultConfig.Servers {
+		if srv.Type != config.ComponentServerType {
+			continue
+		}
+		for _, comp := range srv.Components {
+			if comp.Domain == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
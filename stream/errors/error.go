@@ -36,11 +36,26 @@ var (
 	// ErrUnsupportedVersion represents 'unsupported-version' stream error.
 	ErrUnsupportedVersion = newStreamError("unsupported-version")
 
+	// ErrConflict represents 'conflict' stream error.
+	ErrConflict = newStreamError("conflict")
+
 	// ErrNotAuthorized represents 'not-authorized' stream error.
 	ErrNotAuthorized = newStreamError("not-authorized")
 
 	// ErrInternalServerError represents 'internal-server-error' stream error.
 	ErrInternalServerError = newStreamError("internal-server-error")
+
+	// ErrPolicyViolation represents 'policy-violation' stream error.
+	ErrPolicyViolation = newStreamError("policy-violation")
+
+	// ErrResourceConstraint represents 'resource-constraint' stream error.
+	ErrResourceConstraint = newStreamError("resource-constraint")
+
+	// ErrUndefinedCondition represents 'undefined-condition' stream error.
+	ErrUndefinedCondition = newStreamError("undefined-condition")
+
+	// ErrSystemShutdown represents 'system-shutdown' stream error.
+	ErrSystemShutdown = newStreamError("system-shutdown")
 )
 
 func newStreamError(reason string) *Error {
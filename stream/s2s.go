@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stream
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrFederationDisabled is returned when routing a stanza to a remote
+// domain while no s2s server has been configured.
+var ErrFederationDisabled = errors.New("stream: federation disabled")
+
+// S2SOutStream represents an outgoing server-to-server stream.
+type S2SOutStream interface {
+	ID() string
+
+	LocalDomain() string
+	RemoteDomain() string
+
+	// SendElement queues element to be sent, returning false
+	// if the stream was already disconnected.
+	SendElement(element xml.Element) bool
+	Disconnect(err error)
+}
+
+// S2SDialer creates a new outgoing stream from localDomain to remoteDomain.
+type S2SDialer func(localDomain, remoteDomain string) S2SOutStream
+
+type S2SManager struct {
+	lock     sync.RWMutex
+	dialer   S2SDialer
+	outStrms map[string]S2SOutStream
+}
+
+// singleton interface
+var (
+	s2sInstance *S2SManager
+	s2sOnce     sync.Once
+)
+
+func S2S() *S2SManager {
+	s2sOnce.Do(func() {
+		s2sInstance = &S2SManager{
+			outStrms: make(map[string]S2SOutStream),
+		}
+	})
+	return s2sInstance
+}
+
+// SetDialer enables federation using d to establish outgoing streams.
+func (m *S2SManager) SetDialer(d S2SDialer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dialer = d
+}
+
+// IsEnabled returns whether or not federation is enabled.
+func (m *S2SManager) IsEnabled() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.dialer != nil
+}
+
+// Route sends a stanza to a remote domain, establishing
+// a new outgoing stream if none was already available.
+func (m *S2SManager) Route(element xml.Element, localDomain, remoteDomain string) error {
+	for {
+		strm, err := m.outStream(localDomain, remoteDomain)
+		if err != nil {
+			return err
+		}
+		if strm.SendElement(element) {
+			return nil
+		}
+		// stream went away in the meantime... try with a new one
+		m.UnregisterOutStream(strm)
+	}
+}
+
+func (m *S2SManager) outStream(localDomain, remoteDomain string) (S2SOutStream, error) {
+	key := outStreamKey(localDomain, remoteDomain)
+
+	m.lock.RLock()
+	strm := m.outStrms[key]
+	m.lock.RUnlock()
+	if strm != nil {
+		return strm, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.dialer == nil {
+		return nil, ErrFederationDisabled
+	}
+	strm = m.outStrms[key]
+	if strm == nil {
+		strm = m.dialer(localDomain, remoteDomain)
+		m.outStrms[key] = strm
+		log.Infof("registered s2s out stream... (id: %s)", strm.ID())
+	}
+	return strm, nil
+}
+
+func (m *S2SManager) UnregisterOutStream(strm S2SOutStream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := outStreamKey(strm.LocalDomain(), strm.RemoteDomain())
+	if m.outStrms[key] == strm {
+		delete(m.outStrms, key)
+		log.Infof("unregistered s2s out stream... (id: %s)", strm.ID())
+	}
+}
+
+func outStreamKey(localDomain, remoteDomain string) string {
+	return localDomain + " " + remoteDomain
+}
@@ -9,10 +9,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"unicode/utf8"
 )
 
+// escapers for serialized character data and (double quoted) attribute values.
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;")
+)
+
 var strBufs = sync.Pool{
 	New: func() interface{} { return new(bytes.Buffer) },
 }
@@ -355,7 +362,7 @@ func (e *XElement) ToXML(w io.Writer, includeClosing bool) {
 		w.Write([]byte(" "))
 		w.Write([]byte(e.attrs[i].Label))
 		w.Write([]byte(`="`))
-		w.Write([]byte(e.attrs[i].Value))
+		attrEscaper.WriteString(w, e.attrs[i].Value)
 		w.Write([]byte(`"`))
 	}
 	textLen := e.TextLen()
@@ -364,7 +371,7 @@ func (e *XElement) ToXML(w io.Writer, includeClosing bool) {
 
 		// serialize text
 		if textLen > 0 {
-			w.Write([]byte(e.text))
+			textEscaper.WriteString(w, e.text)
 		}
 		// serialize child elements
 		for j := 0; j < len(e.elements); j++ {
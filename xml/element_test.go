@@ -6,6 +6,7 @@
 package xml_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/ortuman/jackal/xml"
@@ -47,3 +48,16 @@ func TestElement(t *testing.T) {
 	assert.Equal(t, len(c1), 1)
 	assert.Equal(t, e.ElementsCount(), 6)
 }
+
+func TestElementEscaping(t *testing.T) {
+	e := xml.NewElementName("body")
+	e.SetAttribute("title", `"a" < b & c`)
+	e.SetText("<b>1 & 2</b>")
+	assert.Equal(t, e.String(), `<body title="&quot;a&quot; &lt; b &amp; c">&lt;b&gt;1 &amp; 2&lt;/b&gt;</body>`)
+
+	p := xml.NewParser(strings.NewReader(e.String()))
+	parsed, err := p.ParseElement()
+	assert.Nil(t, err)
+	assert.Equal(t, parsed.Attribute("title"), `"a" < b & c`)
+	assert.Equal(t, parsed.Text(), "<b>1 & 2</b>")
+}
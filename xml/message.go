@@ -81,7 +81,7 @@ func (m *Message) Copy() *Message {
 
 func isMessageType(messageType string) bool {
 	switch messageType {
-	case "", NormalType, HeadlineType, ChatType, GroupChatType:
+	case "", NormalType, HeadlineType, ChatType, GroupChatType, "error":
 		return true
 	default:
 		return false
@@ -16,11 +16,41 @@ const rootElementIndex = -1
 
 const streamName = "stream"
 
+// decoderBufferSize is the amount of input the decoder may read ahead of the element being parsed.
+const decoderBufferSize = 4096
+
 var ErrStreamClosedByPeer = errors.New("stream closed by peer")
 
+// LimitError is returned by a Parser whenever an element exceeds any of its limits.
+type LimitError struct {
+	Limit string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("xml: %s limit exceeded", e.Limit)
+}
+
+// ParserLimits defines the resources an element is allowed to consume while being parsed.
+// A zero value means no limit is enforced.
+type ParserLimits struct {
+	// MaxElementSize is the maximum number of input bytes per element.
+	MaxElementSize int
+
+	// MaxDepth is the maximum nesting depth of an element.
+	MaxDepth int
+
+	// MaxAttributes is the maximum number of attributes per element.
+	MaxAttributes int
+
+	// MaxTextLength is the maximum text length per element.
+	MaxTextLength int
+}
+
 // Parser parses arbitrary XML input and builds an array with the structure of all tag and data elements.
 type Parser struct {
 	dec          *xml.Decoder
+	lr           *limitReader
+	limits       ParserLimits
 	nextElement  *XElement
 	parsingIndex int
 	parsingStack []*XElement
@@ -29,30 +59,54 @@ type Parser struct {
 
 // NewParser creates an empty Parser instance.
 func NewParser(reader io.Reader) *Parser {
-	return &Parser{
-		dec:          xml.NewDecoder(reader),
+	return NewLimitedParser(reader, ParserLimits{})
+}
+
+// NewLimitedParser creates an empty Parser instance
+// enforcing limits on every parsed element.
+func NewLimitedParser(reader io.Reader, limits ParserLimits) *Parser {
+	p := &Parser{
+		limits:       limits,
 		parsingIndex: rootElementIndex,
 	}
+	if limits.MaxElementSize > 0 {
+		p.lr = &limitReader{r: reader}
+		reader = p.lr
+	}
+	p.dec = xml.NewDecoder(reader)
+	return p
 }
 
 // ParseElement parses next available XML element from reader.
 func (p *Parser) ParseElement() (*XElement, error) {
 	d := p.dec
+	offset := d.InputOffset()
+	if p.lr != nil {
+		// bound buffered input, not only the parsed one
+		p.lr.limit = offset + int64(p.limits.MaxElementSize) + decoderBufferSize
+	}
 	t, err := d.RawToken()
 	if err != nil {
 		return nil, err
 	}
 	for {
+		if p.limits.MaxElementSize > 0 && d.InputOffset()-offset > int64(p.limits.MaxElementSize) {
+			return nil, &LimitError{Limit: "element size"}
+		}
 		switch t1 := t.(type) {
 		case xml.StartElement:
-			p.startElement(t1)
+			if err := p.startElement(t1); err != nil {
+				return nil, err
+			}
 			if t1.Name.Local == streamName && t1.Name.Space == streamName {
 				p.closeElement()
 				goto done
 			}
 
 		case xml.CharData:
-			p.setElementText(t1)
+			if err := p.setElementText(t1); err != nil {
+				return nil, err
+			}
 
 		case xml.EndElement:
 			if t1.Name.Local == streamName && t1.Name.Space == streamName {
@@ -74,7 +128,13 @@ done:
 	return ret, nil
 }
 
-func (p *Parser) startElement(t xml.StartElement) {
+func (p *Parser) startElement(t xml.StartElement) error {
+	if p.limits.MaxDepth > 0 && p.parsingIndex+1 >= p.limits.MaxDepth {
+		return &LimitError{Limit: "element depth"}
+	}
+	if p.limits.MaxAttributes > 0 && len(t.Attr) > p.limits.MaxAttributes {
+		return &LimitError{Limit: "attribute count"}
+	}
 	var name string
 	if len(t.Name.Space) > 0 {
 		name = fmt.Sprintf("%s:%s", t.Name.Space, t.Name.Local)
@@ -91,13 +151,18 @@ func (p *Parser) startElement(t xml.StartElement) {
 	p.parsingStack = append(p.parsingStack, element)
 	p.parsingIndex++
 	p.inElement = true
+	return nil
 }
 
-func (p *Parser) setElementText(t xml.CharData) {
+func (p *Parser) setElementText(t xml.CharData) error {
 	if !p.inElement {
-		return
+		return nil
+	}
+	if p.limits.MaxTextLength > 0 && len(t) > p.limits.MaxTextLength {
+		return &LimitError{Limit: "text length"}
 	}
 	p.parsingStack[p.parsingIndex].SetText(string(t))
+	return nil
 }
 
 func (p *Parser) endElement(t xml.EndElement) error {
@@ -128,3 +193,22 @@ func xmlName(space, local string) string {
 	}
 	return local
 }
+
+// limitReader fails as soon as more than limit bytes have been read from r.
+type limitReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (lr *limitReader) Read(b []byte) (int, error) {
+	if lr.n >= lr.limit {
+		return 0, &LimitError{Limit: "element size"}
+	}
+	if rem := lr.limit - lr.n; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+	n, err := lr.r.Read(b)
+	lr.n += int64(n)
+	return n, err
+}
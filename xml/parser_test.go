@@ -65,3 +65,43 @@ func TestDocChildElements(t *testing.T) {
 	assert.Equal(t, childs[1].Name(), "b")
 	assert.Equal(t, childs[2].Name(), "c")
 }
+
+func TestParserLimits(t *testing.T) {
+	limits := xml.ParserLimits{MaxElementSize: 64, MaxDepth: 2, MaxAttributes: 2, MaxTextLength: 8}
+
+	p := xml.NewLimitedParser(strings.NewReader(`<a x="1" y="2"><b>12345678</b></a><c/>`), limits)
+	a, err := p.ParseElement()
+	assert.Nil(t, err)
+	assert.NotNil(t, a)
+	c, err := p.ParseElement()
+	assert.Nil(t, err)
+	assert.NotNil(t, c)
+
+	p = xml.NewLimitedParser(strings.NewReader(`<a><b><c/></b></a>`), limits)
+	_, err = p.ParseElement()
+	assert.Equal(t, err, &xml.LimitError{Limit: "element depth"})
+
+	p = xml.NewLimitedParser(strings.NewReader(`<a x="1" y="2" z="3"/>`), limits)
+	_, err = p.ParseElement()
+	assert.Equal(t, err, &xml.LimitError{Limit: "attribute count"})
+
+	p = xml.NewLimitedParser(strings.NewReader(`<a>123456789</a>`), limits)
+	_, err = p.ParseElement()
+	assert.Equal(t, err, &xml.LimitError{Limit: "text length"})
+
+	p = xml.NewLimitedParser(strings.NewReader(`<a>`+strings.Repeat("<b/>", 32)+`</a>`), limits)
+	_, err = p.ParseElement()
+	assert.Equal(t, err, &xml.LimitError{Limit: "element size"})
+
+	// unterminated elements can't exhaust memory
+	p = xml.NewLimitedParser(strings.NewReader(`<a>`+strings.Repeat("1", 1024*1024)), xml.ParserLimits{MaxElementSize: 64})
+	_, err = p.ParseElement()
+	assert.Equal(t, err, &xml.LimitError{Limit: "element size"})
+
+	// limits apply to every single element
+	p = xml.NewLimitedParser(strings.NewReader(strings.Repeat(`<a>1234567890</a>`, 16)), xml.ParserLimits{MaxElementSize: 32})
+	for i := 0; i < 16; i++ {
+		_, err = p.ParseElement()
+		assert.Nil(t, err)
+	}
+}
@@ -18,6 +18,7 @@ const (
 	UnsubscribeType  = "unsubscribe"
 	SubscribedType   = "subscribed"
 	UnsubscribedType = "unsubscribed"
+	ProbeType        = "probe"
 )
 
 type ShowState int
@@ -141,7 +142,7 @@ func (p *Presence) Copy() *Presence {
 
 func isPresenceType(presenceType string) bool {
 	switch presenceType {
-	case AvailableType, UnavailableType, SubscribeType, UnsubscribeType, SubscribedType, UnsubscribedType:
+	case AvailableType, UnavailableType, SubscribeType, UnsubscribeType, SubscribedType, UnsubscribedType, ProbeType:
 		return true
 	default:
 		return false